@@ -1,35 +1,87 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"time"
 
 	ping "github.com/scientiacoder/PingClient"
+	"github.com/scientiacoder/PingClient/prometheus"
+	"gopkg.in/yaml.v3"
 )
 
 var usage = `
 PingClient Usage:
 
-    go run cmd/ping.go [-n num] [-i interval] [-t timeout] [-c continuous] [--privileged] host
+    go run cmd/ping.go [-n num] [-i interval] [-t timeout] [-c continuous] [-a] [-r resolve] [-dns server] [-4] [-6] [-f hostsfile] [-o text|json] [-packets file.csv] [-summary file.csv] [-stats interval] [--privileged] host...
+    go run cmd/ping.go [-w] [flags] config.yaml
+    go run cmd/ping.go serve [-listen :9427] [flags] config.yaml|host...
+
+    Settings are layered: config file, then environment variables like
+    PINGCLIENT_INTERVAL=200ms, then flags. --print-config prints the result.
 
 Examples:
-    # ping with config yaml file
+    # ping with config yaml (or json) file
     go run cmd/ping.go config.yaml
 
+    # ping with config yaml file, reloading it on change or SIGHUP
+    go run cmd/ping.go -w config.yaml
+
+    # ping with config yaml file, every client at 200ms intervals 3 times
+    PINGCLIENT_INTERVAL=200ms go run cmd/ping.go -n 3 config.yaml
+
+    # print the effective config of every client without pinging
+    go run cmd/ping.go -n 3 --print-config config.yaml
+
     # ping github continuously
     go run cmd/ping.go -c www.github.com
 
+    # ping the hosts of 10.0.0.0/24 and 10.0.1.1 to 10.0.1.50
+    go run cmd/ping.go 10.0.0.0/24 10.0.1.1-10.0.1.50
+
+    # ping the hosts listed in hosts.txt, one per line
+    go run cmd/ping.go -f hosts.txt
+
+    # ping github writing one json object per line (packet, timeout, statistics)
+    go run cmd/ping.go -o json www.github.com
+
+    # ping github continuously, exporting every packet and the statistics every 10s (-stats) and at the end (.tsv for TSV)
+    go run cmd/ping.go -c -packets packets.csv -summary summary.csv www.github.com
+
+    # ping continuously and serve Prometheus metrics on http://localhost:9427/metrics
+    go run cmd/ping.go serve config.yaml
+    go run cmd/ping.go serve -listen 127.0.0.1:9100 -i 5s www.github.com 8.8.8.8
+
     # ping github 5 times
     go run cmd/ping.go -n 5 www.github.com
 
     # ping github 5 times at 500ms intervals
     go run cmd/ping.go -n 5 -i 500ms www.github.com
 
+    # ping every IP address github resolves to
+    go run cmd/ping.go -a www.github.com
+
+    # ping github continuously, following its DNS changes every minute
+    go run cmd/ping.go -c -r 1m www.github.com
+
+    # resolve github with the DNS server 1.1.1.1
+    go run cmd/ping.go -dns 1.1.1.1 www.github.com
+
+    # ping the IPv6 address of github
+    go run cmd/ping.go -6 www.github.com
+
+    # ping both the IPv4 and IPv6 address of github side by side
+    go run cmd/ping.go -4 -6 www.github.com
+
     # ping github for 10 seconds
     go run cmd/ping.go -t 10s www.github.com
 
@@ -38,56 +90,41 @@ Examples:
 `
 
 // run with config yaml file
-func runWithYaml() {
+func runWithYaml(overrides []*ping.Override, printOnly bool, out *outputs) {
 	yamlfile := flag.Arg(0)
 
-	pingClients, err := ping.InitWithYAMLFile(yamlfile)
+	if printOnly {
+		config, err := ping.ParseConfigFile(yamlfile, overrides...)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		printConfig(config)
+		return
+	}
+
+	pingClients, err := ping.InitWithYAMLFile(yamlfile, overrides...)
 	if err != nil {
 		log.Fatalf("%s", err)
 		return
 	}
-	// Listen for Ctrl-C.
+	// Listen for Ctrl-C, which ends the running client and the ones after
+	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
-		for range c {
-			for _, pingClient := range pingClients {
-				pingClient.Stop()
-			}
-		}
+		<-c
+		cancel()
 	}()
 
 	for _, pingClient := range pingClients {
-		pingClient.OnRecv = func(pkt *ping.Packet) {
-			fmt.Printf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v\n",
-				pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.Ttl)
-		}
-		pingClient.OnFinish = func(stats []*ping.Statistics) {
-			for _, stat := range stats {
-				fmt.Printf("\n--- %s %s ping statistics ---\n", stat.URL, stat.IP)
-				/*
-					for _, pkt := range stat.PacketsInfo {
-						fmt.Printf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v\n",
-							pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.Ttl)
-					}
-				*/
-				fmt.Printf("%d packets transmitted, %d packets received, %v%% packet loss\n",
-					stat.PacketsSent, stat.PacketsRecv, stat.PacketLoss)
-				fmt.Printf("round-trip min/avg/max/stddev = %v/%v/%v/%v\n",
-					stat.MinRtt, stat.AvgRtt, stat.MaxRtt, stat.StdDevRtt)
-			}
-		}
+		setCallbacks(pingClient, out)
 	}
 	for _, pingClient := range pingClients {
-		for i := range pingClient.IPs {
-			ipStr := pingClient.IPs[i].IP.String()
-			if url, ok := pingClient.IPToURL[ipStr]; ok {
-				fmt.Printf("PING %s %s:\n", url, pingClient.IPs[i].IP.String())
-			} else {
-				fmt.Printf("PING %s:\n", ipStr)
-			}
+		printTargets(pingClient, out.format)
+		err := pingClient.RunContext(ctx)
+		if ctx.Err() != nil {
+			return
 		}
-		err := pingClient.Run()
 		if err != nil {
 			log.Fatalf("%s", err)
 			return
@@ -95,36 +132,150 @@ func runWithYaml() {
 	}
 }
 
-// run with cmd flags
-func runWithCmd(timeout *time.Duration, interval *time.Duration, num *int,
-	continuous *bool, privileged *bool) {
-	var err error
-	pingClient := ping.New()
-	for i := 0; i < flag.NArg(); i++ {
-		err = pingClient.Add(flag.Arg(i))
+// run with config yaml file, reloading it on change or SIGHUP
+func runWithWatcher(overrides []*ping.Override, out *outputs) {
+	watcher := ping.NewWatcher(flag.Arg(0))
+	watcher.Overrides = overrides
+
+	// clients stopped or replaced by a reload leave the metrics
+	running := make(map[string]*ping.PingClient)
+	unregister := func(name string) {
+		if old, ok := running[name]; ok && out.exporter != nil {
+			out.exporter.Unregister(old)
+		}
+		delete(running, name)
 	}
-	if err != nil {
-		log.Fatalf("%s", err)
-		return
+	watcher.OnStart = func(pingClient *ping.PingClient) {
+		unregister(pingClient.Name)
+		running[pingClient.Name] = pingClient
+		setCallbacks(pingClient, out)
+		printTargets(pingClient, out.format)
+	}
+	watcher.OnReload = func(event *ping.ReloadEvent) {
+		for _, name := range event.Stopped {
+			unregister(name)
+		}
+		if out.format == "json" {
+			writeJSON(newJSONReload(event))
+			return
+		}
+		if event.Err != nil {
+			fmt.Printf("reload failed, keeping the running config: %s\n", event.Err)
+			return
+		}
+		if len(event.Started)+len(event.Stopped)+len(event.Updated) > 0 {
+			fmt.Printf("reloaded %s: started %v, stopped %v, updated %v\n",
+				watcher.File, event.Started, event.Stopped, event.Updated)
+		}
 	}
 
 	// Listen for Ctrl-C.
+	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
-		for range c {
-			pingClient.Stop()
-		}
+		<-c
+		cancel()
 	}()
 
-	pingClient.OnRecv = func(pkt *ping.Packet) {
-		fmt.Printf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v\n",
-			pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.Ttl)
+	if err := watcher.Run(ctx); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+// outputs are where the results of the ping clients go
+type outputs struct {
+	// format of the standard output, text or json
+	format string
+
+	// CSV (or TSV) exports of the packets and of the statistics, nil if
+	// not asked for
+	packets *ping.PacketCSVWriter
+	summary *ping.StatisticsCSVWriter
 
+	// exporter of the Prometheus metrics in serve mode, nil otherwise
+	exporter *prometheus.Exporter
+}
+
+// setCallbacks prints the packets and statistics of a ping client in the
+// output format, text or json, and exports them
+func setCallbacks(pingClient *ping.PingClient, out *outputs) {
+	if out.format == "json" {
+		setJSONCallbacks(pingClient)
+	} else {
+		setTextCallbacks(pingClient)
+	}
+	pingClient.OnSinkError = exportError
+	if out.packets != nil {
+		out.packets.Attach(pingClient)
+	}
+	if out.summary != nil {
+		out.summary.Attach(pingClient)
+	}
+	if out.exporter != nil {
+		out.exporter.Register(pingClient)
+	}
+}
+
+// serveMetrics serves the Prometheus metrics on /metrics of address listen
+func serveMetrics(listen string, exporter *prometheus.Exporter) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	log.Printf("serving metrics on http://%s/metrics", l.Addr())
+	go func() {
+		log.Fatalf("%s", http.Serve(l, mux))
+	}()
+}
+
+// openExport creates the CSV file name of an export, a TSV file if name ends
+// with .tsv
+func openExport(name string) (*os.File, rune) {
+	f, err := os.Create(name)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if strings.HasSuffix(name, ".tsv") {
+		return f, '\t'
+	}
+	return f, ','
+}
+
+// exportError reports the errors writing exports and pushing to sinks
+func exportError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+}
+
+// setTextCallbacks prints the packets and statistics of a ping client like
+// ping does
+func setTextCallbacks(pingClient *ping.PingClient) {
+	name := label(pingClient.Name)
+	pingClient.OnRecv = func(pkt *ping.Packet) {
+		var dup string
+		switch {
+		case pkt.Duplicate:
+			dup = " (DUP!)"
+		case pkt.Late:
+			dup = " (late)"
+		}
+		fmt.Printf("%s%d bytes from %s: icmp_seq=%d time=%v ttl=%v%s\n",
+			name, pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.Ttl, dup)
+	}
+	pingClient.OnTimeout = func(pkt *ping.Packet) {
+		fmt.Printf("%sRequest timeout for %s icmp_seq %d\n", name, pkt.IP, pkt.Seq)
+	}
+	pingClient.OnError = func(icmpErr *ping.ICMPError) {
+		fmt.Printf("%s%s\n", name, icmpErr)
+	}
+	pingClient.OnTargetChange = func(change *ping.TargetChange) {
+		fmt.Printf("%s%s now resolves to new %v, no longer to %v\n", name, change.URL, change.Added, change.Removed)
 	}
 	pingClient.OnFinish = func(stats []*ping.Statistics) {
 		for _, stat := range stats {
-			fmt.Printf("\n--- %s %s ping statistics ---\n", stat.URL, stat.IP)
+			fmt.Printf("\n--- %s%s %s ping statistics ---\n", label(stat.Name), stat.URL, stat.IP)
 			/*
 				for _, pkt := range stat.PacketsInfo {
 					fmt.Printf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v\n",
@@ -135,49 +286,506 @@ func runWithCmd(timeout *time.Duration, interval *time.Duration, num *int,
 				stat.PacketsSent, stat.PacketsRecv, stat.PacketLoss)
 			fmt.Printf("round-trip min/avg/max/stddev = %v/%v/%v/%v\n",
 				stat.MinRtt, stat.AvgRtt, stat.MaxRtt, stat.StdDevRtt)
+			fmt.Printf("round-trip p50/p90/p99 = %v/%v/%v, jitter = %v\n",
+				stat.P50Rtt, stat.P90Rtt, stat.P99Rtt, stat.Jitter)
+			if stat.DNSLookups > 0 {
+				fmt.Printf("dns lookups = %d, failures = %d, last/avg time = %v/%v\n",
+					stat.DNSLookups, stat.DNSFailures, stat.DNSLookupTime, stat.AvgDNSLookupTime)
+			}
 		}
+		if pingClient.Network() == "dual" {
+			printDualStatistics(stats)
+		}
+	}
+}
+
+// printTargets prints the IPs a ping client pings, only in text output
+func printTargets(pingClient *ping.PingClient, format string) {
+	if format == "json" {
+		return
 	}
-	pingClient.Timeout = *timeout
-	pingClient.Interval = *interval
-	pingClient.Num = *num
-	pingClient.Continuous = *continuous
-	pingClient.SetPrivileged(*privileged)
+	name := label(pingClient.Name)
 	for i := range pingClient.IPs {
-		ipStr := pingClient.IPs[i].IP.String()
-		if url, ok := pingClient.IPToURL[ipStr]; ok {
-			fmt.Printf("PING %s %s:\n", url, pingClient.IPs[i].IP.String())
+		ipStr := pingClient.IPs[i].String()
+		if urls, ok := pingClient.IPToURL[ipStr]; ok {
+			fmt.Printf("%sPING %s %s:\n", name, strings.Join(urls, ","), pingClient.IPs[i].String())
 		} else {
-			fmt.Printf("PING %s:\n", ipStr)
+			fmt.Printf("%sPING %s:\n", name, ipStr)
+		}
+	}
+}
+
+// label prefixes the output of a named ping client with its name
+func label(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "[" + name + "] "
+}
+
+// printDualStatistics prints the IPv4 and IPv6 statistics of every URL side by side
+func printDualStatistics(stats []*ping.Statistics) {
+	type dual struct {
+		ipv4, ipv6 *ping.Statistics
+	}
+	urls := make([]string, 0)
+	byURL := make(map[string]*dual)
+	for _, stat := range stats {
+		for _, url := range stat.URLs {
+			d, ok := byURL[url]
+			if !ok {
+				d = &dual{}
+				byURL[url] = d
+				urls = append(urls, url)
+			}
+			if ip := net.ParseIP(stat.IP); ip != nil && ip.To4() != nil {
+				d.ipv4 = stat
+			} else {
+				d.ipv6 = stat
+			}
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+	fmt.Printf("\n--- IPv4 / IPv6 ping statistics ---\n")
+	for _, url := range urls {
+		d := byURL[url]
+		fmt.Printf("%s: %s | %s\n", url, dualColumn("IPv4", d.ipv4), dualColumn("IPv6", d.ipv6))
+	}
+}
+
+func dualColumn(family string, stat *ping.Statistics) string {
+	if stat == nil {
+		return fmt.Sprintf("%s no address", family)
+	}
+	return fmt.Sprintf("%s %s avg %v loss %v%%", family, stat.IP, stat.AvgRtt, stat.PacketLoss)
+}
+
+// jsonOutput writes the json records, one object per line
+var jsonOutput = struct {
+	sync.Mutex
+	encoder *json.Encoder
+}{encoder: json.NewEncoder(os.Stdout)}
+
+// writeJSON writes record v on a line of its own, ping clients may run
+// concurrently
+func writeJSON(v interface{}) {
+	jsonOutput.Lock()
+	defer jsonOutput.Unlock()
+	if err := jsonOutput.encoder.Encode(v); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+// jsonPacket is the json record of a received packet, type "packet"
+type jsonPacket struct {
+	Type      string  `json:"type"`
+	Time      string  `json:"time"`
+	Client    string  `json:"client,omitempty"`
+	IP        string  `json:"ip"`
+	Seq       int     `json:"seq"`
+	Bytes     int     `json:"bytes"`
+	TTL       int     `json:"ttl"`
+	HopLimit  int     `json:"hop_limit,omitempty"`
+	RttMs     float64 `json:"rtt_ms"`
+	Duplicate bool    `json:"duplicate"`
+	Reordered bool    `json:"reordered"`
+	Late      bool    `json:"late"`
+}
+
+// jsonTimeout is the json record of an echo request without reply, type
+// "timeout"
+type jsonTimeout struct {
+	Type   string `json:"type"`
+	Time   string `json:"time"`
+	Client string `json:"client,omitempty"`
+	IP     string `json:"ip"`
+	Seq    int    `json:"seq"`
+}
+
+// jsonICMPError is the json record of an ICMP error message, type "error"
+type jsonICMPError struct {
+	Type      string `json:"type"`
+	Time      string `json:"time"`
+	Client    string `json:"client,omitempty"`
+	IP        string `json:"ip"`
+	Seq       int    `json:"seq"`
+	From      string `json:"from"`
+	ErrorType string `json:"error_type"`
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+}
+
+// jsonTargetChange is the json record of a URL resolving to other IPs, type
+// "target_change"
+type jsonTargetChange struct {
+	Type    string   `json:"type"`
+	Time    string   `json:"time"`
+	Client  string   `json:"client,omitempty"`
+	URL     string   `json:"url"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// jsonStatistics is the json record of the final statistics of an IP, type
+// "statistics"
+type jsonStatistics struct {
+	Type             string         `json:"type"`
+	Time             string         `json:"time"`
+	Client           string         `json:"client,omitempty"`
+	URL              string         `json:"url,omitempty"`
+	URLs             []string       `json:"urls,omitempty"`
+	IP               string         `json:"ip"`
+	PacketsSent      int            `json:"packets_sent"`
+	PacketsRecv      int            `json:"packets_recv"`
+	PacketLoss       float64        `json:"packet_loss"`
+	Duplicates       int            `json:"duplicates"`
+	Reordered        int            `json:"reordered"`
+	Late             int            `json:"late"`
+	MinRttMs         float64        `json:"min_rtt_ms"`
+	AvgRttMs         float64        `json:"avg_rtt_ms"`
+	MaxRttMs         float64        `json:"max_rtt_ms"`
+	StdDevRttMs      float64        `json:"stddev_rtt_ms"`
+	P50RttMs         float64        `json:"p50_rtt_ms"`
+	P90RttMs         float64        `json:"p90_rtt_ms"`
+	P95RttMs         float64        `json:"p95_rtt_ms"`
+	P99RttMs         float64        `json:"p99_rtt_ms"`
+	P999RttMs        float64        `json:"p999_rtt_ms"`
+	JitterMs         float64        `json:"jitter_ms"`
+	Unreachable      map[string]int `json:"unreachable,omitempty"`
+	TimeExceeded     int            `json:"time_exceeded"`
+	ParameterProblem int            `json:"parameter_problem"`
+	DNSLookups       int            `json:"dns_lookups,omitempty"`
+	DNSFailures      int            `json:"dns_failures,omitempty"`
+	DNSLookupTimeMs  float64        `json:"dns_lookup_time_ms,omitempty"`
+	AvgDNSLookupMs   float64        `json:"avg_dns_lookup_time_ms,omitempty"`
+	DNSError         string         `json:"dns_error,omitempty"`
+}
+
+// jsonReload is the json record of a reload of the config file, type
+// "reload"
+type jsonReload struct {
+	Type    string   `json:"type"`
+	Time    string   `json:"time"`
+	Started []string `json:"started"`
+	Stopped []string `json:"stopped"`
+	Updated []string `json:"updated"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// setJSONCallbacks writes the packets and statistics of a ping client as
+// json records
+func setJSONCallbacks(pingClient *ping.PingClient) {
+	name := pingClient.Name
+	pingClient.OnRecv = func(pkt *ping.Packet) {
+		writeJSON(&jsonPacket{
+			Type:      "packet",
+			Time:      now(),
+			Client:    name,
+			IP:        pkt.IP,
+			Seq:       pkt.Seq,
+			Bytes:     pkt.Nbytes,
+			TTL:       pkt.Ttl,
+			HopLimit:  pkt.HopLimit,
+			RttMs:     ms(pkt.Rtt),
+			Duplicate: pkt.Duplicate,
+			Reordered: pkt.Reordered,
+			Late:      pkt.Late,
+		})
+	}
+	pingClient.OnTimeout = func(pkt *ping.Packet) {
+		writeJSON(&jsonTimeout{Type: "timeout", Time: now(), Client: name, IP: pkt.IP, Seq: pkt.Seq})
+	}
+	pingClient.OnError = func(icmpErr *ping.ICMPError) {
+		errorType := icmpErr.Type.String()
+		if icmpErr.Type == ping.ICMPUnreachable {
+			errorType = icmpErr.Unreachable.String()
+		}
+		writeJSON(&jsonICMPError{
+			Type:      "error",
+			Time:      now(),
+			Client:    name,
+			IP:        icmpErr.IP,
+			Seq:       icmpErr.Seq,
+			From:      icmpErr.From,
+			ErrorType: errorType,
+			Code:      icmpErr.Code,
+			Message:   icmpErr.Error(),
+		})
+	}
+	pingClient.OnTargetChange = func(change *ping.TargetChange) {
+		writeJSON(&jsonTargetChange{
+			Type:    "target_change",
+			Time:    now(),
+			Client:  name,
+			URL:     change.URL,
+			Added:   ipStrings(change.Added),
+			Removed: ipStrings(change.Removed),
+		})
+	}
+	pingClient.OnFinish = func(stats []*ping.Statistics) {
+		for _, stat := range stats {
+			writeJSON(newJSONStatistics(stat))
+		}
+	}
+}
+
+func newJSONStatistics(stat *ping.Statistics) *jsonStatistics {
+	record := &jsonStatistics{
+		Type:             "statistics",
+		Time:             now(),
+		Client:           stat.Name,
+		URL:              stat.URL,
+		URLs:             stat.URLs,
+		IP:               stat.IP,
+		PacketsSent:      stat.PacketsSent,
+		PacketsRecv:      stat.PacketsRecv,
+		PacketLoss:       stat.PacketLoss,
+		Duplicates:       stat.Duplicates,
+		Reordered:        stat.Reordered,
+		Late:             stat.Late,
+		MinRttMs:         ms(stat.MinRtt),
+		AvgRttMs:         ms(stat.AvgRtt),
+		MaxRttMs:         ms(stat.MaxRtt),
+		StdDevRttMs:      ms(stat.StdDevRtt),
+		P50RttMs:         ms(stat.P50Rtt),
+		P90RttMs:         ms(stat.P90Rtt),
+		P95RttMs:         ms(stat.P95Rtt),
+		P99RttMs:         ms(stat.P99Rtt),
+		P999RttMs:        ms(stat.P999Rtt),
+		JitterMs:         ms(stat.Jitter),
+		TimeExceeded:     stat.TimeExceeded,
+		ParameterProblem: stat.ParameterProblem,
+		DNSLookups:       stat.DNSLookups,
+		DNSFailures:      stat.DNSFailures,
+		DNSLookupTimeMs:  ms(stat.DNSLookupTime),
+		AvgDNSLookupMs:   ms(stat.AvgDNSLookupTime),
+		DNSError:         stat.DNSError,
+	}
+	if len(stat.Unreachable) > 0 {
+		record.Unreachable = make(map[string]int, len(stat.Unreachable))
+		for code, n := range stat.Unreachable {
+			record.Unreachable[code.String()] += n
 		}
 	}
+	return record
+}
+
+func newJSONReload(event *ping.ReloadEvent) *jsonReload {
+	record := &jsonReload{
+		Type: "reload",
+		Time: now(),
+		// lists are never null
+		Started: append([]string{}, event.Started...),
+		Stopped: append([]string{}, event.Stopped...),
+		Updated: append([]string{}, event.Updated...),
+	}
+	if event.Err != nil {
+		record.Error = event.Err.Error()
+	}
+	return record
+}
 
-	err = pingClient.Run()
+// now is the time of a json record
+func now() string {
+	return time.Now().Format(time.RFC3339Nano)
+}
+
+// ms converts d to milliseconds with a fractional part
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func ipStrings(ipAddrs []*net.IPAddr) []string {
+	ips := make([]string, 0, len(ipAddrs))
+	for _, ipAddr := range ipAddrs {
+		ips = append(ips, ipAddr.String())
+	}
+	return ips
+}
+
+// run with cmd flags
+func runWithCmd(overrides []*ping.Override, hostsFile *string, printOnly bool, out *outputs) {
+	// DNS servers given on the command line time out after 5s unless set
+	// otherwise
+	for _, o := range overrides {
+		if o.Key == "dns_server" {
+			overrides = append(overrides, &ping.Override{Key: "dns_timeout", Value: "5s", Source: "default", Default: true})
+			break
+		}
+	}
+	conf, err := ping.NewPingClientConfigWithOverrides(overrides...)
 	if err != nil {
 		log.Fatalf("%s", err)
 		return
 	}
+	pingClient := ping.NewPingClientWithConfig(conf)
+
+	// hosts are resolved once all the settings are applied
+	for i := 0; i < flag.NArg(); i++ {
+		if err = pingClient.Add(flag.Arg(i)); err != nil {
+			log.Fatalf("%s", err)
+			return
+		}
+	}
+	if *hostsFile != "" {
+		if err = pingClient.AddHostsFile(*hostsFile); err != nil {
+			log.Fatalf("%s", err)
+			return
+		}
+	}
+	if printOnly {
+		conf.IPs, conf.URLs, conf.IPToURL = pingClient.IPs, pingClient.URLs, pingClient.IPToURL
+		printConfig(conf)
+		return
+	}
+
+	// Listen for Ctrl-C, also before the client runs
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	setCallbacks(pingClient, out)
+	printTargets(pingClient, out.format)
+
+	err = pingClient.RunContext(ctx)
+	if err != nil && ctx.Err() == nil {
+		log.Fatalf("%s", err)
+		return
+	}
 }
 
 func main() {
-	timeout := flag.Duration("t", 5*time.Second, "")
-	interval := flag.Duration("i", 1*time.Second, "")
-	num := flag.Int("n", 5, "")
-	continuous := flag.Bool("c", false, "")
-	privileged := flag.Bool("privileged", false, "")
+	// the flags of config keys are read as overrides, see flagOverrides
+	flag.Duration("t", 5*time.Second, "")
+	flag.Duration("i", 1*time.Second, "")
+	flag.Int("n", 5, "")
+	flag.Bool("c", false, "")
+	flag.Bool("privileged", false, "")
+	flag.Bool("a", false, "")
+	flag.Duration("r", 0, "")
+	flag.String("dns", "", "")
+	flag.Duration("stats", 0, "")
+	ipv4 := flag.Bool("4", false, "")
+	ipv6 := flag.Bool("6", false, "")
+	watch := flag.Bool("w", false, "")
+	hostsFile := flag.String("f", "", "")
+	printOnly := flag.Bool("print-config", false, "")
+	format := flag.String("o", "text", "")
+	packetsFile := flag.String("packets", "", "")
+	summaryFile := flag.String("summary", "", "")
+	listen := flag.String("listen", ":9427", "")
 
 	flag.Usage = func() {
 		fmt.Print(usage)
 	}
 	flag.Parse()
 
-	if flag.NArg() == 0 {
+	// in serve mode the flags follow serve
+	serve := flag.Arg(0) == "serve"
+	if serve {
+		//nolint:errcheck
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	// nothing to ping, before anything is started like the metrics server
+	if flag.NArg() == 0 && *hostsFile == "" {
 		flag.Usage()
 		return
 	}
 
-	if host := flag.Arg(0); strings.HasSuffix(host, ".yaml") || strings.HasSuffix(host, ".yml") {
-		runWithYaml()
+	if *format != "text" && *format != "json" {
+		log.Fatalf("error main(): output format %s should be text or json", *format)
+	}
+	out := &outputs{format: *format}
+	if *packetsFile != "" && !*printOnly {
+		f, comma := openExport(*packetsFile)
+		defer f.Close()
+		out.packets = ping.NewPacketCSVWriter(f, comma)
+		out.packets.OnError = exportError
+	}
+	if *summaryFile != "" && !*printOnly {
+		f, comma := openExport(*summaryFile)
+		defer f.Close()
+		out.summary = ping.NewStatisticsCSVWriter(f, comma)
+		out.summary.OnError = exportError
+	}
+	if serve && !*printOnly {
+		out.exporter = prometheus.NewExporter()
+		serveMetrics(*listen, out.exporter)
+	}
+
+	// environment variables override the config file, flags override both
+	overrides := make([]*ping.Override, 0)
+	if serve {
+		// metrics are served as long as the ping clients run
+		overrides = append(overrides, &ping.Override{Key: "continuous", Value: "true", Source: "serve"})
+	}
+	// the statistics export streams every 10s unless set otherwise, by the
+	// config file too
+	if out.summary != nil {
+		overrides = append(overrides, &ping.Override{Key: "stats_interval", Value: "10s", Source: "default", Default: true})
+	}
+	overrides = append(overrides, ping.EnvOverrides(os.Environ())...)
+	overrides = append(overrides, flagOverrides(*ipv4, *ipv6)...)
+
+	if host := flag.Arg(0); strings.HasSuffix(host, ".yaml") || strings.HasSuffix(host, ".yml") ||
+		strings.HasSuffix(host, ".json") {
+		// ping clients served run side by side
+		if (*watch || serve) && !*printOnly {
+			runWithWatcher(overrides, out)
+		} else {
+			runWithYaml(overrides, *printOnly, out)
+		}
 	} else {
-		runWithCmd(timeout, interval, num, continuous, privileged)
+		runWithCmd(overrides, hostsFile, *printOnly, out)
+	}
+}
+
+// flagKeys are the config keys set by flags
+var flagKeys = map[string]string{
+	"t":          "timeout",
+	"i":          "interval",
+	"n":          "num",
+	"c":          "continuous",
+	"privileged": "privileged",
+	"a":          "resolve_all",
+	"r":          "resolve_interval",
+	"dns":        "dns_server",
+	"stats":      "stats_interval",
+}
+
+// flagOverrides returns the overrides of the flags set on the command line,
+// flags left to their default don't override the config file
+func flagOverrides(ipv4 bool, ipv6 bool) []*ping.Override {
+	overrides := make([]*ping.Override, 0)
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok {
+			overrides = append(overrides, &ping.Override{Key: key, Value: f.Value.String(), Source: "flag -" + f.Name})
+		}
+	})
+	switch {
+	case ipv4 && ipv6:
+		overrides = append(overrides, &ping.Override{Key: "network", Value: "dual", Source: "flags -4 -6"})
+	case ipv4:
+		overrides = append(overrides, &ping.Override{Key: "network", Value: "ip4", Source: "flag -4"})
+	case ipv6:
+		overrides = append(overrides, &ping.Override{Key: "network", Value: "ip6", Source: "flag -6"})
+	}
+	return overrides
+}
+
+// printConfig prints the effective config in yaml
+func printConfig(config interface{}) {
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		log.Fatalf("%s", err)
 	}
+	encoder.Close()
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ping "github.com/scientiacoder/PingClient"
+	"gopkg.in/yaml.v3"
+)
+
+// TestMain runs main instead of the tests in the processes started by
+// runMain
+func TestMain(m *testing.M) {
+	if os.Getenv("PING_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the command with args and the environment variables env, and
+// returns what it printed on stdout
+func runMain(t *testing.T, env []string, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), "PING_TEST_MAIN=1"), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("ping %v: %v: %s", args, err, stderr.String())
+	}
+	return out
+}
+
+func TestPrintConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pingclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(config, []byte("app:\n  p:\n    ips: 10.0.0.1\n    interval: 2s\n    timeout: 3s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// flags override environment variables, which override the config file
+	out := runMain(t, []string{"PINGCLIENT_INTERVAL=200ms", "PINGCLIENT_NUM=7"}, "-n", "3", "-print-config", config)
+	var got struct {
+		App map[string]map[string]interface{}
+	}
+	if err := yaml.Unmarshal(out, &got); err != nil {
+		t.Fatalf("%v in\n%s", err, out)
+	}
+	p := got.App["p"]
+	if p["interval"] != "200ms" || p["num"] != 3 || p["timeout"] != "3s" {
+		t.Errorf("interval %v, num %v, timeout %v; want 200ms, 3, 3s in\n%s", p["interval"], p["num"], p["timeout"], out)
+	}
+
+	out = runMain(t, nil, "-i", "500ms", "-print-config", "10.0.0.2")
+	var conf map[string]interface{}
+	if err := yaml.Unmarshal(out, &conf); err != nil {
+		t.Fatalf("%v in\n%s", err, out)
+	}
+	if ips, ok := conf["ips"].([]interface{}); conf["interval"] != "500ms" || !ok || len(ips) != 1 || ips[0] != "10.0.0.2" {
+		t.Errorf("interval %v, ips %v; want 500ms, [10.0.0.2] in\n%s", conf["interval"], conf["ips"], out)
+	}
+}
+
+func TestServeUsage(t *testing.T) {
+	// the port is taken, serving would fail
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	out := runMain(t, nil, "serve", "-listen", l.Addr().String())
+	if !bytes.Contains(out, []byte("PingClient Usage:")) {
+		t.Errorf("serve without hosts printed %q, want the usage", out)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	jsonOutput.encoder = json.NewEncoder(&buf)
+	defer func() { jsonOutput.encoder = json.NewEncoder(os.Stdout) }()
+
+	sim := ping.NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &ping.SimLink{Latency: time.Millisecond})
+	sim.SetLink("10.0.0.2", &ping.SimLink{Loss: 1})
+	pingClient := ping.New()
+	pingClient.Transport = sim
+	pingClient.Name = "sim"
+	pingClient.Num = 3
+	pingClient.Interval = 20 * time.Millisecond
+	pingClient.ReplyTimeout = 5 * time.Millisecond
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := pingClient.Add(ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setCallbacks(pingClient, &outputs{format: "json"})
+	if err := pingClient.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every line is a json object of its own
+	counts := make(map[string]int)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%v in line %q", err, scanner.Text())
+		}
+		if record["client"] != "sim" {
+			t.Errorf("client %v, want sim in line %q", record["client"], scanner.Text())
+		}
+		typ, _ := record["type"].(string)
+		counts[typ+" "+record["ip"].(string)]++
+		if _, err := time.Parse(time.RFC3339Nano, record["time"].(string)); err != nil {
+			t.Errorf("time: %v in line %q", err, scanner.Text())
+		}
+	}
+	if counts["packet 10.0.0.1"] == 0 || counts["timeout 10.0.0.2"] == 0 || counts["packet 10.0.0.2"] != 0 {
+		t.Errorf("records %v, want packets of 10.0.0.1 and timeouts of 10.0.0.2", counts)
+	}
+	if counts["statistics 10.0.0.1"] != 1 || counts["statistics 10.0.0.2"] != 1 {
+		t.Errorf("records %v, want the statistics of both IPs", counts)
+	}
+}
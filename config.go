@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 // Config helps parsing config.yaml or config.yml
@@ -18,6 +20,9 @@ type Config struct {
 
 // PingClientConfig represents config struct for single PingClient
 type PingClientConfig struct {
+	// name of the ping client, its key under app
+	Name string
+
 	// time interval of sending packets in milliseconds
 	Interval time.Duration
 
@@ -33,14 +38,51 @@ type PingClientConfig struct {
 	// number of packets be going to send
 	Num int
 
-	// inverted index after resolve IP address of URL
-	IPToURL map[string]string
+	// size of the packets sent
+	Size int
+
+	// how long to wait for the reply to an echo request before it times out
+	ReplyTimeout time.Duration
+
+	// overrides of Size and ReplyTimeout for single urls or ips, fully
+	// populated with the values of the ping client
+	TargetOptions map[string]*TargetOptions
+
+	// inverted index after resolve IP address of URL, several URLs may
+	// resolve to the same IP
+	IPToURL map[string][]string
+
+	// ips given as such, by ips, hosts_file or targets, rather than
+	// resolved from urls
+	literal map[string]bool
+
+	// whether URLs are resolved to all their A and AAAA records
+	ResolveAll bool
+
+	// time interval of resolving urls again in milliseconds, 0 never does
+	ResolveInterval time.Duration
+
+	// DNS resolver urls are looked up with, nil uses the system resolver
+	Resolver *DNSResolver
+
+	// time interval of pushing statistics to the sinks, 0 only does when
+	// the ping client finishes
+	StatsInterval time.Duration
+
+	// sinks the packets and statistics are pushed to
+	Sinks []*SinkConfig
+
+	// DNS lookups of the urls while parsing
+	dnsStats map[string]*dnsStats
 
 	// whether run continuously(forever)
 	Continuous bool
 
 	// privileged uses icmp raw socket to ping while non-privileged uses udp
 	Privileged bool
+
+	// network urls are resolved for: ip, ip4, ip6 or dual (both)
+	Network string
 }
 
 // NewConfig returns an instance of Config which includes list of PingClientConfig
@@ -53,112 +95,911 @@ func NewConfig() *Config {
 // NewDefaultPingClientConfig inits a PingClientConfig with default value
 func NewDefaultPingClientConfig() *PingClientConfig {
 	return &PingClientConfig{
-		Interval:   time.Second,     // default ping interval on Linux is 1 second
-		Timeout:    5 * time.Second, // MSDN(windows) waits 5 seconds, Linux waits 2 maximum RTT
-		IPs:        make([]*net.IPAddr, 0),
-		URLs:       make([]string, 0),
-		Num:        5, // default num is 5 on most UNIX systems
-		IPToURL:    make(map[string]string),
-		Continuous: false,
-		Privileged: false,
+		Interval:      time.Second,     // default ping interval on Linux is 1 second
+		Timeout:       5 * time.Second, // MSDN(windows) waits 5 seconds, Linux waits 2 maximum RTT
+		IPs:           make([]*net.IPAddr, 0),
+		URLs:          make([]string, 0),
+		Num:           5, // default num is 5 on most UNIX systems
+		Size:          timeSliceLength + trackerLength,
+		ReplyTimeout:  2 * time.Second,
+		TargetOptions: make(map[string]*TargetOptions),
+		IPToURL:       make(map[string][]string),
+		literal:       make(map[string]bool),
+		dnsStats:      make(map[string]*dnsStats),
+		Continuous:    false,
+		Privileged:    false,
+		Network:       "ip",
 	}
 }
 
 // parsePingClientConfig parses values of key app(like PingClient1: PingClient2: ) in yaml file
-// and returns the ping client config set by the user
-func parsePingClientConfig(conf map[interface{}]interface{}) (*PingClientConfig, error) {
+// and returns the ping client config set by the user, on top of the layers
+// of defaults (the lowest first, nil ones skipped) and beneath the overrides
+// (nil if there are none). Relative hosts files are in dir, the directory of
+// the config file.
+func parsePingClientConfig(defaults []*yaml.Node, conf *yaml.Node, overrides *yaml.Node, dir string) (*PingClientConfig, error) {
 	pingClientConf := NewDefaultPingClientConfig()
 
-	for key := range conf {
-		k := key.(string)
-		stringKey := key.(string)
-
-		switch k = strings.ToLower(strings.TrimSpace(k)); k {
-		case "interval":
-			intervalInt := conf[stringKey].(int)
-			pingClientConf.Interval = time.Duration(intervalInt) * time.Millisecond
-		case "timeout":
-			timeoutInt := conf[stringKey].(int)
-			pingClientConf.Timeout = time.Duration(timeoutInt) * time.Millisecond
-		case "ips":
-			ipStr := conf[stringKey].(string)
-			ipStrList := strings.Split(ipStr, " ")
-			var ip net.IP
-			for _, v := range ipStrList {
-				if ip = parseIP(v); ip == nil {
-					return nil, fmt.Errorf("Error ParsePingClient(): %s should be in IP format x.x.x.x", v)
+	// a ping client without any key keeps the defaults
+	if conf != nil && isNull(conf) {
+		conf = nil
+	}
+	if conf != nil && conf.Kind != yaml.MappingNode {
+		return nil, configError(conf, "ping client should be a mapping of keys like interval, ips, urls")
+	}
+
+	// keys of the client are decoded after the defaults to override them,
+	// and before the overrides
+	var in pingClientYAML
+	for _, layer := range append(defaults, conf, overrides) {
+		if layer == nil {
+			continue
+		}
+		key, err := decodeMapping(layer, &in, &in.Unknown)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			return nil, configError(key, "unknown key %s", key.Value)
+		}
+	}
+
+	var urlList []*yaml.Node
+	// IPs added so far, so that large ranges and hosts files are added
+	// without going through all the IPs every time
+	seen := make(map[string]bool)
+	resolver := &DNSResolver{}
+	err := decodeKeys([]keyDecoder{
+		{&in.Interval, func(n *yaml.Node) (err error) {
+			if pingClientConf.Interval, err = decodeDuration("interval", n); err == nil && pingClientConf.Interval == 0 {
+				err = configError(n, "interval should be more than 0")
+			}
+			return err
+		}},
+		{&in.Timeout, func(n *yaml.Node) (err error) {
+			pingClientConf.Timeout, err = decodeDuration("timeout", n)
+			return err
+		}},
+		{&in.Num, func(n *yaml.Node) (err error) {
+			if pingClientConf.Num, err = decodeInt("num", n); err == nil && pingClientConf.Num < 0 {
+				err = configError(n, "num should not be negative, got %d", pingClientConf.Num)
+			}
+			return err
+		}},
+		{&in.Privileged, func(n *yaml.Node) (err error) {
+			pingClientConf.Privileged, err = decodeBool("privileged", n)
+			return err
+		}},
+		{&in.Continuous, func(n *yaml.Node) (err error) {
+			pingClientConf.Continuous, err = decodeBool("continuous", n)
+			return err
+		}},
+		{&in.Size, func(n *yaml.Node) (err error) {
+			pingClientConf.Size, err = decodeSize("size", n)
+			return err
+		}},
+		{&in.ReplyTimeout, func(n *yaml.Node) (err error) {
+			pingClientConf.ReplyTimeout, err = decodeDuration("reply_timeout", n)
+			return err
+		}},
+		{&in.Network, func(n *yaml.Node) error {
+			network, err := decodeString("network", n)
+			if err != nil {
+				return err
+			}
+			switch network = strings.ToLower(network); network {
+			case "ip", "ip4", "ip6", "dual":
+				pingClientConf.Network = network
+				return nil
+			}
+			return configError(n, "network %s should be one of ip, ip4, ip6 or dual", network)
+		}},
+		{&in.ResolveAll, func(n *yaml.Node) (err error) {
+			pingClientConf.ResolveAll, err = decodeBool("resolve_all", n)
+			return err
+		}},
+		{&in.ResolveInterval, func(n *yaml.Node) (err error) {
+			pingClientConf.ResolveInterval, err = decodeDuration("resolve_interval", n)
+			return err
+		}},
+		{&in.StatsInterval, func(n *yaml.Node) (err error) {
+			pingClientConf.StatsInterval, err = decodeDuration("stats_interval", n)
+			return err
+		}},
+		{&in.DNSServer, func(n *yaml.Node) (err error) {
+			resolver.Server, err = decodeString("dns_server", n)
+			return err
+		}},
+		{&in.DNSProtocol, func(n *yaml.Node) (err error) {
+			if resolver.Protocol, err = decodeString("dns_protocol", n); err == nil {
+				if resolver.Protocol != "udp" && resolver.Protocol != "tcp" {
+					err = configError(n, "dns_protocol %s should be udp or tcp", resolver.Protocol)
+				}
+			}
+			return err
+		}},
+		{&in.DNSTimeout, func(n *yaml.Node) (err error) {
+			resolver.Timeout, err = decodeDuration("dns_timeout", n)
+			return err
+		}},
+		{&in.Sinks, func(n *yaml.Node) (err error) {
+			// sinks of a ping client replace those of defaults
+			pingClientConf.Sinks, err = parseSinks(n)
+			return err
+		}},
+		{&in.IPs, func(n *yaml.Node) error {
+			ipList, err := decodeList("ips", n)
+			if err != nil {
+				return err
+			}
+			for _, v := range ipList {
+				ipAddrs, ok, err := expandIPs(v.Value)
+				if !ok {
+					return configError(v, "%s should be in IP format x.x.x.x, x:x::x or fe80::x%%zone, "+
+						"or a range like 10.0.0.0/24 or 10.0.0.1-10.0.0.50", v.Value)
 				}
-				pingClientConf.IPs = append(pingClientConf.IPs, &net.IPAddr{IP: ip})
-			}
-		case "urls":
-			urls := make([]string, 0)
-			urlStr := conf[stringKey].(string)
-			urlList := strings.Split(urlStr, " ")
-			for _, url := range urlList {
-				ipaddr, err := parseURL("ip", url)
 				if err != nil {
-					return nil, fmt.Errorf("Error ParsePingClient(): can not resolve the IP address of url %s", url)
+					return configError(v, "%s", err)
 				}
+				pingClientConf.addLiteral(ipAddrs, seen)
+			}
+			return nil
+		}},
+		{&in.URLs, func(n *yaml.Node) error {
+			// resolved once all the keys are parsed, see resolve_all
+			list, err := decodeList("urls", n)
+			urlList = append(urlList, list...)
+			return err
+		}},
+		{&in.HostsFile, func(n *yaml.Node) error {
+			files, err := decodeList("hosts_file", n)
+			if err != nil {
+				return err
+			}
+			for _, v := range files {
+				list, err := parseHostsFile(v, dir, pingClientConf, seen)
+				if err != nil {
+					return err
+				}
+				urlList = append(urlList, list...)
+			}
+			return nil
+		}},
+		{&in.Targets, func(n *yaml.Node) error {
+			targetURLs, err := parseTargets(n, pingClientConf, seen)
+			urlList = append(urlList, targetURLs...)
+			return err
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if *resolver != (DNSResolver{}) {
+		pingClientConf.Resolver = resolver
+	}
+	if len(pingClientConf.Sinks) > 0 && isUnset(&in.StatsInterval) {
+		pingClientConf.StatsInterval = defaultSinkStatsInterval
+	}
+	for _, o := range pingClientConf.TargetOptions {
+		if o.Size == 0 {
+			o.Size = pingClientConf.Size
+		}
+		if o.ReplyTimeout == 0 {
+			o.ReplyTimeout = pingClientConf.ReplyTimeout
+		}
+	}
+
+	urls := make([]string, 0)
+	for _, v := range urlList {
+		url := v.Value
+		ipaddrs, elapsed, err := pingClientConf.Resolver.lookup(pingClientConf.Network, url, pingClientConf.ResolveAll)
+		d, ok := pingClientConf.dnsStats[url]
+		if !ok {
+			d = &dnsStats{}
+			pingClientConf.dnsStats[url] = d
+		}
+		d.add(elapsed, err)
+		if err != nil {
+			return nil, configError(v, "can not resolve the IP address of url %s", url)
+		}
+		for _, ipaddr := range ipaddrs {
+			ipStr := ipaddr.String()
+			if !seen[ipStr] {
+				seen[ipStr] = true
 				pingClientConf.IPs = append(pingClientConf.IPs, ipaddr)
-				// construct inverted map
-				pingClientConf.IPToURL[ipaddr.IP.String()] = url
-				urls = append(urls, url)
-			}
-			pingClientConf.URLs = urls
-		case "num":
-			n := conf[stringKey].(int)
-			pingClientConf.Num = n
-		case "privileged":
-			p := conf[stringKey].(bool)
-			pingClientConf.Privileged = p
-		case "continuous":
-			con := conf[stringKey].(bool)
-			pingClientConf.Continuous = con
+			}
+			// construct inverted map
+			if !containsString(pingClientConf.IPToURL[ipStr], url) {
+				pingClientConf.IPToURL[ipStr] = append(pingClientConf.IPToURL[ipStr], url)
+			}
+		}
+		if !containsString(urls, url) {
+			urls = append(urls, url)
 		}
 	}
+	pingClientConf.URLs = urls
 	return pingClientConf, nil
 }
 
+// parseSinks parses the list of key sinks, the sinks are checked by creating
+// them
+func parseSinks(n *yaml.Node) ([]*SinkConfig, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, configError(n, "sinks should be a list, got %s", describeNode(n))
+	}
+	sinks := make([]*SinkConfig, 0, len(n.Content))
+	for _, sink := range n.Content {
+		sink = resolveAlias(sink)
+		if sink.Kind != yaml.MappingNode {
+			return nil, configError(sink, "sink should be a mapping with keys type and address, got %s", describeNode(sink))
+		}
+		var in sinkYAML
+		key, err := decodeMapping(sink, &in, &in.Unknown)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			return nil, configError(key, "unknown key %s, sinks take type, address, token, measurement, prefix and dogstatsd", key.Value)
+		}
+		c := &SinkConfig{}
+		err = decodeKeys([]keyDecoder{
+			{&in.Type, func(n *yaml.Node) (err error) {
+				if c.Type, err = decodeString("type", n); err == nil {
+					c.Type = strings.ToLower(c.Type)
+				}
+				return err
+			}},
+			{&in.Address, func(n *yaml.Node) (err error) {
+				c.Address, err = decodeString("address", n)
+				return err
+			}},
+			{&in.Token, func(n *yaml.Node) (err error) {
+				c.Token, err = decodeString("token", n)
+				return err
+			}},
+			{&in.Measurement, func(n *yaml.Node) (err error) {
+				c.Measurement, err = decodeString("measurement", n)
+				return err
+			}},
+			{&in.Prefix, func(n *yaml.Node) (err error) {
+				c.Prefix, err = decodeString("prefix", n)
+				return err
+			}},
+			{&in.DogStatsD, func(n *yaml.Node) (err error) {
+				c.DogStatsD, err = decodeBool("dogstatsd", n)
+				return err
+			}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if c.Type == "" || c.Address == "" {
+			return nil, configError(sink, "sink should have a type and an address")
+		}
+		if _, err := NewSink(c); err != nil {
+			// without the prefix of the function, configError adds its own
+			msg := err.Error()
+			if i := strings.Index(msg, "(): "); i >= 0 {
+				msg = msg[i+len("(): "):]
+			}
+			return nil, configError(sink, "%s", msg)
+		}
+		sinks = append(sinks, c)
+	}
+	return sinks, nil
+}
+
+// parseHostsFile reads the hosts file named by n, relative to dir, adds its
+// ips unless seen and returns its urls, with the position of n for errors
+func parseHostsFile(n *yaml.Node, dir string, pingClientConf *PingClientConfig, seen map[string]bool) ([]*yaml.Node, error) {
+	name := n.Value
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+	hosts, err := ReadHostsFile(name)
+	if err != nil {
+		return nil, configError(n, "%s", err)
+	}
+	urlList := make([]*yaml.Node, 0)
+	for _, host := range hosts {
+		ipAddrs, ok, err := expandIPs(host)
+		if err != nil {
+			return nil, configError(n, "hosts file %s: %s", n.Value, err)
+		}
+		if !ok {
+			item := *n
+			item.Value = host
+			urlList = append(urlList, &item)
+			continue
+		}
+		pingClientConf.addLiteral(ipAddrs, seen)
+	}
+	return urlList, nil
+}
+
+// parseTargets parses the list of key targets, urls or ips with options of
+// their own, adds the ips unless seen and the options to pingClientConf and
+// returns the urls
+func parseTargets(n *yaml.Node, pingClientConf *PingClientConfig, seen map[string]bool) ([]*yaml.Node, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, configError(n, "targets should be a list, got %s", describeNode(n))
+	}
+	urlList := make([]*yaml.Node, 0)
+	for _, target := range n.Content {
+		target = resolveAlias(target)
+		if target.Kind != yaml.MappingNode {
+			return nil, configError(target, "target should be a mapping with key url or ip, got %s", describeNode(target))
+		}
+		var in targetYAML
+		key, err := decodeMapping(target, &in, &in.Unknown)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			return nil, configError(key, "unknown key %s, targets take url or ip, size and reply_timeout", key.Value)
+		}
+		if !isUnset(&in.URL) && !isUnset(&in.IP) {
+			return nil, configError(&in.IP, "target should have only one url or ip")
+		}
+
+		var name string
+		options := &TargetOptions{}
+		err = decodeKeys([]keyDecoder{
+			{&in.URL, func(n *yaml.Node) (err error) {
+				if name, err = decodeString("url", n); err == nil {
+					urlList = append(urlList, n)
+				}
+				return err
+			}},
+			{&in.IP, func(n *yaml.Node) error {
+				s, err := decodeString("ip", n)
+				if err != nil {
+					return err
+				}
+				ipAddr := parseIPAddr(s)
+				if ipAddr == nil {
+					return configError(n, "%s should be in IP format x.x.x.x, x:x::x or fe80::x%%zone", s)
+				}
+				name = ipAddr.String()
+				pingClientConf.addLiteral([]*net.IPAddr{ipAddr}, seen)
+				return nil
+			}},
+			{&in.Size, func(n *yaml.Node) (err error) {
+				options.Size, err = decodeSize("size", n)
+				return err
+			}},
+			{&in.ReplyTimeout, func(n *yaml.Node) (err error) {
+				options.ReplyTimeout, err = decodeDuration("reply_timeout", n)
+				return err
+			}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, configError(target, "target should have a url or an ip")
+		}
+		pingClientConf.TargetOptions[name] = options
+	}
+	return urlList, nil
+}
+
+// copyTargets returns copies of the IPs, URLs, IPToURL, literal IPs and
+// TargetOptions of c, a PingClient changes its own (see ResolveInterval)
+// while c may still be read, e.g. by a Watcher
+func (c *PingClientConfig) copyTargets() ([]*net.IPAddr, []string, map[string][]string, map[string]bool, map[string]*TargetOptions) {
+	ipAddrs := make([]*net.IPAddr, 0, len(c.IPs))
+	for _, ipAddr := range c.IPs {
+		copied := *ipAddr
+		ipAddrs = append(ipAddrs, &copied)
+	}
+	urls := append([]string{}, c.URLs...)
+	ipToURL := make(map[string][]string, len(c.IPToURL))
+	for ipStr, urls := range c.IPToURL {
+		ipToURL[ipStr] = append([]string(nil), urls...)
+	}
+	literal := make(map[string]bool, len(c.literal))
+	for ipStr := range c.literal {
+		literal[ipStr] = true
+	}
+	targetOptions := make(map[string]*TargetOptions, len(c.TargetOptions))
+	for name, o := range c.TargetOptions {
+		copied := *o
+		targetOptions[name] = &copied
+	}
+	return ipAddrs, urls, ipToURL, literal, targetOptions
+}
+
+// addLiteral adds ipAddrs, given as such rather than resolved from urls,
+// unless seen
+func (c *PingClientConfig) addLiteral(ipAddrs []*net.IPAddr, seen map[string]bool) {
+	c.IPs = appendIPs(c.IPs, ipAddrs, seen)
+	for _, ipAddr := range ipAddrs {
+		c.literal[ipAddr.String()] = true
+	}
+}
+
+// containsIP checks whether ipAddrs has ip, with the same zone
+func containsIP(ipAddrs []*net.IPAddr, ip *net.IPAddr) bool {
+	for _, ipAddr := range ipAddrs {
+		if ipAddr.IP.Equal(ip.IP) && ipAddr.Zone == ip.Zone {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseConfig parses config from yaml file
+// Values decoded by yaml.Unmarshal carry no position, use ParseConfigBytes
+// to get the line and column of invalid values in errors. The order of the
+// ping clients is lost as well, they are sorted by name.
 func ParseConfig(conf map[interface{}]interface{}) (*Config, error) {
-	_, ok := conf["app"]
-	if !ok {
+	var node yaml.Node
+	if err := node.Encode(conf); err != nil {
+		return nil, fmt.Errorf("error ParseConfig(): %s", err)
+	}
+	return parseConfigNode(&node, nil, "")
+}
+
+// ParseConfigFile parses config from a yaml (or json) file, hosts files are
+// relative to its directory.
+// The overrides are applied to every ping client, see Override.
+func ParseConfigFile(name string, overrides ...*Override) (*Config, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error ParseConfig(): %s", err)
+	}
+	return parseConfigBytes(data, filepath.Dir(name), overrides)
+}
+
+// ParseConfigBytes parses config from the content of a yaml (or json) file
+// The ping clients are in the order of the file, hosts files are relative
+// to the current directory.
+// The overrides are applied to every ping client, see Override.
+func ParseConfigBytes(data []byte, overrides ...*Override) (*Config, error) {
+	return parseConfigBytes(data, "", overrides)
+}
+
+func parseConfigBytes(data []byte, dir string, overrides []*Override) (*Config, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error ParseConfig(): %s", err)
+	}
+	if len(doc.Content) == 0 {
 		return nil, fmt.Errorf("error ParseConfig(): key app does not exist")
 	}
+	return parseConfigNode(doc.Content[0], overrides, dir)
+}
+
+// parseConfigNode parses the root mapping of a config file in directory dir
+func parseConfigNode(root *yaml.Node, overrides []*Override, dir string) (*Config, error) {
+	beneath, above, err := parseOverrides(overrides)
+	if err != nil {
+		return nil, err
+	}
 
-	m, _ := conf["app"].(map[interface{}]interface{})
+	if root.Kind != yaml.MappingNode {
+		return nil, configError(root, "config should be a mapping with key app")
+	}
+
+	var app, defaults *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], resolveAlias(root.Content[i+1])
+		switch strings.ToLower(strings.TrimSpace(key.Value)) {
+		case "app":
+			app = value
+		case "defaults":
+			if isNull(value) {
+				continue
+			}
+			if value.Kind != yaml.MappingNode {
+				return nil, configError(value, "defaults should be a mapping of keys like interval, timeout, num")
+			}
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				if k := value.Content[j].Value; isTargetKey(k) {
+					return nil, configError(value.Content[j], "key %s can not be set in defaults", strings.ToLower(strings.TrimSpace(k)))
+				}
+			}
+			defaults = value
+		default:
+			return nil, configError(key, "unknown key %s", key.Value)
+		}
+	}
+	if app == nil {
+		return nil, fmt.Errorf("error ParseConfig(): key app does not exist")
+	}
+	if app.Kind != yaml.MappingNode {
+		return nil, configError(app, "app should be a mapping of ping clients")
+	}
 
 	config := NewConfig()
 
-	var p *PingClientConfig
-	var err error
-	for key := range m {
-		v, _ := m[key].(map[interface{}]interface{})
-		if p, err = parsePingClientConfig(v); err != nil {
-			return nil, fmt.Errorf("%s", err)
+	// ping clients keep the order of the file
+	names := make([]string, 0)
+	for i := 0; i+1 < len(app.Content); i += 2 {
+		key := app.Content[i]
+		name := strings.TrimSpace(key.Value)
+		if key.Kind != yaml.ScalarNode || name == "" {
+			return nil, configError(key, "ping client name should be a string, got %s", describeNode(key))
+		}
+		if containsString(names, name) {
+			return nil, configError(key, "duplicate ping client name %s", name)
+		}
+		names = append(names, name)
+
+		p, err := parsePingClientConfig([]*yaml.Node{beneath, defaults}, resolveAlias(app.Content[i+1]), above, dir)
+		if err != nil {
+			return nil, err
 		}
+		p.Name = name
 
 		config.PingClientsConf = append(config.PingClientsConf, p)
 	}
 	return config, nil
 }
 
-// InitWithYAMLFile inits a ping client with given yaml file
-func InitWithYAMLFile(name string) ([]*PingClient, error) {
-	data, err := ioutil.ReadFile(name)
+// InitWithYAMLFile inits a ping client with given yaml (or json) file
+// The overrides are applied to every ping client, see Override.
+func InitWithYAMLFile(name string, overrides ...*Override) ([]*PingClient, error) {
+	config, err := ParseConfigFile(name, overrides...)
 	if err != nil {
 		return nil, fmt.Errorf("Error main(): %s", err)
 	}
-	configYaml := make(map[interface{}]interface{})
-	err = yaml.Unmarshal([]byte(data), &configYaml)
-	if err != nil {
-		return nil, fmt.Errorf("Error main(): %s", err)
+
+	return InitWithConfig(config), nil
+}
+
+// pingClientYAML is the layout of a ping client in a config file. Values are
+// kept as nodes, converted and checked once decoded so that errors point at
+// them; a zero node is a key that is not set.
+type pingClientYAML struct {
+	Interval        yaml.Node `yaml:"interval"`
+	Timeout         yaml.Node `yaml:"timeout"`
+	Num             yaml.Node `yaml:"num"`
+	Privileged      yaml.Node `yaml:"privileged"`
+	Continuous      yaml.Node `yaml:"continuous"`
+	Size            yaml.Node `yaml:"size"`
+	ReplyTimeout    yaml.Node `yaml:"reply_timeout"`
+	Network         yaml.Node `yaml:"network"`
+	ResolveAll      yaml.Node `yaml:"resolve_all"`
+	ResolveInterval yaml.Node `yaml:"resolve_interval"`
+	StatsInterval   yaml.Node `yaml:"stats_interval"`
+	DNSServer       yaml.Node `yaml:"dns_server,omitempty"`
+	DNSProtocol     yaml.Node `yaml:"dns_protocol,omitempty"`
+	DNSTimeout      yaml.Node `yaml:"dns_timeout,omitempty"`
+	IPs             yaml.Node `yaml:"ips,omitempty"`
+	URLs            yaml.Node `yaml:"urls,omitempty"`
+	HostsFile       yaml.Node `yaml:"hosts_file,omitempty"`
+	Targets         yaml.Node `yaml:"targets,omitempty"`
+	Sinks           yaml.Node `yaml:"sinks,omitempty"`
+
+	// keys of none of the fields
+	Unknown map[string]yaml.Node `yaml:",inline"`
+}
+
+// sinkYAML is the layout of a sink in a config file
+type sinkYAML struct {
+	Type        yaml.Node `yaml:"type"`
+	Address     yaml.Node `yaml:"address"`
+	Token       yaml.Node `yaml:"token,omitempty"`
+	Measurement yaml.Node `yaml:"measurement,omitempty"`
+	Prefix      yaml.Node `yaml:"prefix,omitempty"`
+	DogStatsD   yaml.Node `yaml:"dogstatsd,omitempty"`
+
+	Unknown map[string]yaml.Node `yaml:",inline"`
+}
+
+// targetYAML is the layout of a target in a config file
+type targetYAML struct {
+	URL          yaml.Node `yaml:"url,omitempty"`
+	IP           yaml.Node `yaml:"ip,omitempty"`
+	Size         yaml.Node `yaml:"size"`
+	ReplyTimeout yaml.Node `yaml:"reply_timeout"`
+
+	Unknown map[string]yaml.Node `yaml:",inline"`
+}
+
+// MarshalYAML writes the effective config of the ping client with every key
+// set, such that parsing it gives the same config. IPs resolved from URLs are
+// left out, the URLs are resolved again.
+func (c *PingClientConfig) MarshalYAML() (interface{}, error) {
+	var err error
+	valueNode := func(v interface{}) yaml.Node {
+		var n yaml.Node
+		if e := n.Encode(v); e != nil && err == nil {
+			err = e
+		}
+		return n
+	}
+	out := &pingClientYAML{
+		Interval:        valueNode(c.Interval.String()),
+		Timeout:         valueNode(c.Timeout.String()),
+		Num:             valueNode(c.Num),
+		Privileged:      valueNode(c.Privileged),
+		Continuous:      valueNode(c.Continuous),
+		Size:            valueNode(c.Size),
+		ReplyTimeout:    valueNode(c.ReplyTimeout.String()),
+		Network:         valueNode(c.Network),
+		ResolveAll:      valueNode(c.ResolveAll),
+		ResolveInterval: valueNode(c.ResolveInterval.String()),
+		StatsInterval:   valueNode(c.StatsInterval.String()),
+	}
+	sinks := make([]*sinkYAML, 0, len(c.Sinks))
+	for _, s := range c.Sinks {
+		sink := &sinkYAML{Type: valueNode(s.Type), Address: valueNode(s.Address)}
+		for _, f := range []struct {
+			n     *yaml.Node
+			value string
+		}{{&sink.Token, s.Token}, {&sink.Measurement, s.Measurement}, {&sink.Prefix, s.Prefix}} {
+			if f.value != "" {
+				*f.n = valueNode(f.value)
+			}
+		}
+		if s.DogStatsD {
+			sink.DogStatsD = valueNode(true)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) > 0 {
+		out.Sinks = valueNode(sinks)
+	}
+	if r := c.Resolver; r != nil {
+		if r.Server != "" {
+			out.DNSServer = valueNode(r.Server)
+		}
+		if r.Protocol != "" {
+			out.DNSProtocol = valueNode(r.Protocol)
+		}
+		if r.Timeout > 0 {
+			out.DNSTimeout = valueNode(r.Timeout.String())
+		}
+	}
+
+	names := make([]string, 0, len(c.TargetOptions))
+	for name := range c.TargetOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	targets := make([]*targetYAML, 0, len(names))
+	for _, name := range names {
+		o := c.TargetOptions[name]
+		target := &targetYAML{Size: valueNode(o.Size), ReplyTimeout: valueNode(o.ReplyTimeout.String())}
+		if parseIPAddr(name) != nil {
+			target.IP = valueNode(name)
+		} else {
+			target.URL = valueNode(name)
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) > 0 {
+		out.Targets = valueNode(targets)
+	}
+	ips := make([]string, 0)
+	for _, ipAddr := range c.IPs {
+		ipStr := ipAddr.String()
+		if _, ok := c.IPToURL[ipStr]; ok && !c.literal[ipStr] {
+			continue
+		}
+		if _, ok := c.TargetOptions[ipStr]; ok {
+			continue
+		}
+		ips = append(ips, ipAddr.String())
+	}
+	if len(ips) > 0 {
+		out.IPs = valueNode(ips)
+	}
+	urls := make([]string, 0)
+	for _, url := range c.URLs {
+		if _, ok := c.TargetOptions[url]; !ok {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) > 0 {
+		out.URLs = valueNode(urls)
+	}
+	return out, err
+}
+
+// MarshalYAML writes the config with key app, ping clients in order.
+func (c *Config) MarshalYAML() (interface{}, error) {
+	app := &yaml.Node{Kind: yaml.MappingNode}
+	for _, p := range c.PingClientsConf {
+		value := &yaml.Node{}
+		if err := value.Encode(p); err != nil {
+			return nil, err
+		}
+		app.Content = append(app.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: p.Name}, value)
+	}
+	return &yaml.Node{
+		Kind:    yaml.MappingNode,
+		Content: []*yaml.Node{{Kind: yaml.ScalarNode, Value: "app"}, app},
+	}, nil
+}
+
+// configError reports an invalid config value at the position of node n
+func configError(n *yaml.Node, format string, args ...interface{}) error {
+	return &parseError{line: n.Line, column: n.Column, msg: fmt.Sprintf(format, args...)}
+}
+
+// parseError is an invalid config value, see configError
+type parseError struct {
+	line   int
+	column int
+	// source of a value set outside the config file, see Override
+	source string
+	msg    string
+}
+
+func (e *parseError) Error() string {
+	switch {
+	case e.source != "":
+		return fmt.Sprintf("error ParseConfig(): %s: %s", e.source, e.msg)
+	case e.line == 0:
+		// nodes encoded from decoded values have no position
+		return fmt.Sprintf("error ParseConfig(): %s", e.msg)
+	}
+	return fmt.Sprintf("error ParseConfig(): line %d, column %d: %s", e.line, e.column, e.msg)
+}
+
+// decodeMapping decodes mapping n into out, a layout like pingClientYAML
+// whose inline map unknown collects the keys it has no field for. Keys are
+// matched whatever their case and surrounding spaces, fields of keys not in
+// n are left as they are. It returns the first key of n that is unknown, nil
+// if there is none.
+func decodeMapping(n *yaml.Node, out interface{}, unknown *map[string]yaml.Node) (*yaml.Node, error) {
+	normalized := &yaml.Node{Kind: yaml.MappingNode, Line: n.Line, Column: n.Column}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key := *n.Content[i]
+		key.Value = strings.ToLower(strings.TrimSpace(key.Value))
+		for j := 0; j < i; j += 2 {
+			if normalized.Content[j].Value == key.Value {
+				return nil, configError(n.Content[i], "key %s is set twice", key.Value)
+			}
+		}
+		normalized.Content = append(normalized.Content, &key, resolveAlias(n.Content[i+1]))
+	}
+	*unknown = nil
+	if err := normalized.Decode(out); err != nil {
+		return nil, configError(n, "%s", err)
+	}
+	for i := 0; i+1 < len(normalized.Content); i += 2 {
+		if _, ok := (*unknown)[normalized.Content[i].Value]; ok {
+			return n.Content[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// keyDecoder converts the value of a key decoded by decodeMapping
+type keyDecoder struct {
+	n      *yaml.Node
+	decode func(n *yaml.Node) error
+}
+
+// decodeKeys runs the decoders of the keys that are set in order, and stops
+// at the first error
+func decodeKeys(decoders []keyDecoder) error {
+	for _, d := range decoders {
+		if isUnset(d.n) {
+			continue
+		}
+		if err := d.decode(d.n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUnset tells whether n is the zero node of a key decodeMapping didn't set
+func isUnset(n *yaml.Node) bool {
+	return n.Kind == 0
+}
+
+// resolveAlias returns the node an alias (*name) refers to
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	if n.Kind == yaml.AliasNode && n.Alias != nil {
+		return n.Alias
+	}
+	return n
+}
+
+func isNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null"
+}
+
+// decodeDuration decodes value of key k, either milliseconds (200) or a
+// duration string ("200ms", "5s")
+func decodeDuration(k string, n *yaml.Node) (time.Duration, error) {
+	if n.Kind == yaml.ScalarNode {
+		switch n.ShortTag() {
+		case "!!int":
+			var ms int
+			if err := n.Decode(&ms); err == nil && ms >= 0 {
+				return time.Duration(ms) * time.Millisecond, nil
+			}
+		case "!!str":
+			if d, err := time.ParseDuration(strings.TrimSpace(n.Value)); err == nil && d >= 0 {
+				return d, nil
+			}
+		}
 	}
+	return 0, configError(n, "%s should be milliseconds like 200 or a duration like 200ms or 5s, got %s", k, describeNode(n))
+}
 
-	config, err := ParseConfig(configYaml)
+// decodeSize decodes a packet size, which has room for the timestamp and
+// tracker at least
+func decodeSize(k string, n *yaml.Node) (int, error) {
+	size, err := decodeInt(k, n)
 	if err != nil {
-		return nil, fmt.Errorf("Error main(): %s", err)
+		return 0, err
+	}
+	if min := timeSliceLength + trackerLength; size < min {
+		return 0, configError(n, "%s should be at least %d bytes, got %d", k, min, size)
 	}
+	return size, nil
+}
 
-	return InitWithConfig(config), nil
+func decodeInt(k string, n *yaml.Node) (int, error) {
+	var i int
+	if n.Kind != yaml.ScalarNode || n.ShortTag() != "!!int" || n.Decode(&i) != nil {
+		return 0, configError(n, "%s should be an integer, got %s", k, describeNode(n))
+	}
+	return i, nil
+}
+
+func decodeBool(k string, n *yaml.Node) (bool, error) {
+	var b bool
+	if n.Kind != yaml.ScalarNode || n.ShortTag() != "!!bool" || n.Decode(&b) != nil {
+		return false, configError(n, "%s should be true or false, got %s", k, describeNode(n))
+	}
+	return b, nil
+}
+
+func decodeString(k string, n *yaml.Node) (string, error) {
+	if n.Kind != yaml.ScalarNode || isNull(n) || strings.TrimSpace(n.Value) == "" {
+		return "", configError(n, "%s should be a string, got %s", k, describeNode(n))
+	}
+	return strings.TrimSpace(n.Value), nil
+}
+
+// decodeList decodes value of key k, either a yaml list or a string of
+// space separated items, into scalar nodes with one item each
+func decodeList(k string, n *yaml.Node) ([]*yaml.Node, error) {
+	switch {
+	case n.Kind == yaml.ScalarNode && !isNull(n):
+		items := make([]*yaml.Node, 0)
+		for _, v := range strings.Fields(n.Value) {
+			item := *n
+			item.Value = v
+			items = append(items, &item)
+		}
+		return items, nil
+	case n.Kind == yaml.SequenceNode:
+		items := make([]*yaml.Node, 0, len(n.Content))
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode || isNull(item) {
+				return nil, configError(item, "%s should be a list of strings, got %s", k, describeNode(item))
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, configError(n, "%s should be a list or a space separated string, got %s", k, describeNode(n))
+}
+
+// describeNode names what n holds for error messages
+func describeNode(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.AliasNode:
+		return "an alias"
+	}
+	if isNull(n) {
+		return "nothing"
+	}
+	return fmt.Sprintf("%q", n.Value)
 }
@@ -0,0 +1,346 @@
+package pingclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseConfigBytes(t *testing.T) {
+	conf, err := ParseConfigBytes([]byte(`
+app:
+  second:
+    ips: 10.0.0.1
+  first:
+    ips:
+      - 10.0.0.2
+      - fe80::1%eth0
+    interval: 200
+    timeout: 2s
+    num: 3
+    continuous: true
+    network: IP6
+  empty:
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.PingClientsConf) != 3 {
+		t.Fatalf("got %d ping clients, want 3", len(conf.PingClientsConf))
+	}
+
+	second, first, empty := conf.PingClientsConf[0], conf.PingClientsConf[1], conf.PingClientsConf[2]
+	if second.Name != "second" || first.Name != "first" || empty.Name != "empty" {
+		t.Errorf("ping clients %s, %s, %s; want the order of the file", second.Name, first.Name, empty.Name)
+	}
+	if first.Interval != 200*time.Millisecond || first.Timeout != 2*time.Second || first.Num != 3 || !first.Continuous || first.Network != "ip6" {
+		t.Errorf("first: interval %s, timeout %s, num %d, continuous %v, network %s; want 200ms, 2s, 3, true, ip6",
+			first.Interval, first.Timeout, first.Num, first.Continuous, first.Network)
+	}
+	if len(first.IPs) != 2 || first.IPs[0].IP.String() != "10.0.0.2" || first.IPs[1].Zone != "eth0" {
+		t.Errorf("first: IPs %v, want 10.0.0.2 and the zone of fe80::1%%eth0 kept", first.IPs)
+	}
+
+	def := NewDefaultPingClientConfig()
+	if empty.Interval != def.Interval || empty.Num != def.Num || empty.Timeout != def.Timeout ||
+		empty.Size != def.Size || empty.ReplyTimeout != def.ReplyTimeout || empty.Privileged || empty.Network != "ip" {
+		t.Errorf("empty: %+v, want the defaults", empty)
+	}
+
+	p := NewPingClientWithConfig(second)
+	if s := p.Statistics(); p.Name != "second" || len(s) != 1 || s[0].Name != "second" {
+		t.Errorf("PingClient named %q with statistics %+v, want the name of the config", p.Name, s)
+	}
+}
+
+func TestParseConfigBytesDefaults(t *testing.T) {
+	conf, err := ParseConfigBytes([]byte(`
+defaults:
+  interval: 200
+  num: 3
+app:
+  p:
+    ips: 10.0.0.1 10.0.0.2
+    interval: 2s
+    reply_timeout: 500ms
+    targets:
+      - ip: 10.0.0.3
+        size: 64
+      - ip: 10.0.0.2
+        reply_timeout: 1s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := conf.PingClientsConf[0]
+	// a ping client overrides the defaults, which override the built-in ones
+	if p.Interval != 2*time.Second || p.Num != 3 || p.ReplyTimeout != 500*time.Millisecond {
+		t.Errorf("interval %s, num %d, reply_timeout %s; want 2s, 3, 500ms", p.Interval, p.Num, p.ReplyTimeout)
+	}
+	if got := ipStrings(p.IPs); got != "10.0.0.1 10.0.0.2 10.0.0.3" {
+		t.Errorf("IPs %s, want 10.0.0.1 10.0.0.2 10.0.0.3", got)
+	}
+	// target options are filled in with the values of the ping client
+	if o := p.TargetOptions["10.0.0.3"]; o == nil || o.Size != 64 || o.ReplyTimeout != 500*time.Millisecond {
+		t.Errorf("TargetOptions[10.0.0.3] = %+v, want size 64 and the reply_timeout of the ping client", o)
+	}
+	if o := p.TargetOptions["10.0.0.2"]; o == nil || o.Size != p.Size || o.ReplyTimeout != time.Second {
+		t.Errorf("TargetOptions[10.0.0.2] = %+v, want the size of the ping client and reply_timeout 1s", o)
+	}
+}
+
+func TestParseConfigBytesHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pingclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "hosts.txt")
+	if err := ioutil.WriteFile(name, []byte("# lab\n10.0.0.1\n10.0.1.0/30 # two hosts\n\n10.0.2.1-10.0.2.2\n10.0.3.2\n10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := ParseConfigBytes([]byte("app:\n  p:\n    ips: 10.0.3.1-10.0.3.2\n    hosts_file: " + name + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ipStrings(conf.PingClientsConf[0].IPs); got != "10.0.3.1 10.0.3.2 10.0.0.1 10.0.1.1 10.0.1.2 10.0.2.1 10.0.2.2" {
+		t.Errorf("IPs %s, want the range of ips and those of hosts.txt, once each", got)
+	}
+
+	_, err = ParseConfigBytes([]byte("app:\n  p:\n    hosts_file: " + filepath.Join(dir, "missing.txt") + "\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "error ParseConfig(): line 3, column 17: ") {
+		t.Errorf("ParseConfigBytes() with a missing hosts file = %v, want an error at line 3, column 17", err)
+	}
+}
+
+func TestParseConfigBytesErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"app:\n  p:\n    interval: soon\n",
+			`line 3, column 15: interval should be milliseconds like 200 or a duration like 200ms or 5s, got "soon"`},
+		{"app:\n  p:\n    num: many\n", `line 3, column 10: num should be an integer, got "many"`},
+		{"app:\n  p:\n    interval: 0\n", "line 3, column 15: interval should be more than 0"},
+		{"app:\n  p:\n    num: -1\n", "line 3, column 10: num should not be negative, got -1"},
+		{"app:\n  p:\n    ips: 10.0.0.1 10.0.0.300\n", "line 3, column 10: 10.0.0.300 should be in IP format"},
+		{"app:\n  p:\n    ips:\n      - [10.0.0.1]\n", "line 4, column 9: ips should be a list of strings, got a list"},
+		{"app:\n  p:\n    colour: blue\n", "line 3, column 5: unknown key colour"},
+		{"app:\n  p:\n    Colour: blue\n", "line 3, column 5: unknown key Colour"},
+		{"app:\n  p:\n    num: 1\n    Num: 2\n", "line 4, column 5: key num is set twice"},
+		{"app:\n  p:\n    sinks:\n      - type: statsd\n        port: 8125\n", "line 5, column 9: unknown key port, sinks take"},
+		{"app:\n  p:\n    network: ip5\n", "line 3, column 14: network ip5 should be one of ip, ip4, ip6 or dual"},
+		{"app:\n  p:\n    dns_protocol: http\n", "line 3, column 19: dns_protocol http should be udp or tcp"},
+		{"app:\n  p:\n    privileged: sure\n", `line 3, column 17: privileged should be true or false, got "sure"`},
+		{"app:\n  p:\n    size: 8\n", "line 3, column 11: size should be at least 16 bytes, got 8"},
+		{"app:\n  p:\n    targets:\n      - size: 64\n", "line 4, column 9: target should have a url or an ip"},
+		{"app:\n  p:\n    targets:\n      - ip: 10.0.0.1\n        ttl: 3\n", "line 5, column 9: unknown key ttl, targets take url or ip"},
+		{"defaults:\n  ips: 10.0.0.1\napp:\n  p:\n", "line 2, column 3: key ips can not be set in defaults"},
+		{"defaults:\n  hosts_file: hosts.txt\napp:\n  p:\n", "line 2, column 3: key hosts_file can not be set in defaults"},
+		{"defaults:\n  num: x\napp:\n  p:\n", `line 2, column 8: num should be an integer, got "x"`},
+		{"app:\n  p:\n  p:\n", "line 3, column 3: duplicate ping client name p"},
+		{"app:\n  p: 5\n", "line 2, column 6: ping client should be a mapping"},
+		{"app: 5\n", "line 1, column 6: app should be a mapping of ping clients"},
+		{"apps:\n  p:\n", "line 1, column 1: unknown key apps"},
+		{"defaults:\n  num: 1\n", "key app does not exist"},
+		{"", "key app does not exist"},
+	}
+	for _, tt := range tests {
+		_, err := ParseConfigBytes([]byte(tt.config))
+		if err == nil {
+			t.Errorf("ParseConfigBytes(%q) succeeded, want error %q", tt.config, tt.want)
+			continue
+		}
+		if got := err.Error(); !strings.HasPrefix(got, "error ParseConfig(): "+tt.want) {
+			t.Errorf("ParseConfigBytes(%q) = %q, want %q", tt.config, got, "error ParseConfig(): "+tt.want)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	conf, err := ParseConfig(map[interface{}]interface{}{
+		"app": map[interface{}]interface{}{
+			"p": map[interface{}]interface{}{"ips": "10.0.0.1", "interval": "2s", "num": 2},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := conf.PingClientsConf[0]; ipStrings(p.IPs) != "10.0.0.1" || p.Interval != 2*time.Second || p.Num != 2 {
+		t.Errorf("IPs %s, interval %s, num %d; want 10.0.0.1, 2s, 2", ipStrings(p.IPs), p.Interval, p.Num)
+	}
+
+	// decoded values have no position to report
+	_, err = ParseConfig(map[interface{}]interface{}{
+		"app": map[interface{}]interface{}{"p": map[interface{}]interface{}{"num": "many"}},
+	})
+	if want := `error ParseConfig(): num should be an integer, got "many"`; err == nil || err.Error() != want {
+		t.Errorf("ParseConfig() with an invalid num = %v, want %q", err, want)
+	}
+}
+
+func TestConfigMarshalYAML(t *testing.T) {
+	config := []byte("app:\n  p:\n    ips: 10.0.0.1 10.0.0.2\n    interval: 250ms\n    num: 2\n    targets:\n      - ip: 10.0.0.2\n        size: 64\n")
+	conf, err := ParseConfigBytes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := yaml.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ParseConfigBytes(out)
+	if err != nil {
+		t.Fatalf("ParseConfigBytes() of the marshaled config:\n%s\n%s", out, err)
+	}
+	p, q := conf.PingClientsConf[0], again.PingClientsConf[0]
+	if q.Name != p.Name || q.Interval != p.Interval || q.Num != p.Num || ipStrings(q.IPs) != ipStrings(p.IPs) ||
+		q.TargetOptions["10.0.0.2"] == nil || q.TargetOptions["10.0.0.2"].Size != 64 {
+		t.Errorf("marshaled config:\n%s\nparses to %+v, want %+v", out, q, p)
+	}
+}
+
+func TestParseConfigLiteralIP(t *testing.T) {
+	config := []byte("app:\n  p:\n    ips: 127.0.0.1\n    urls: localhost\n    network: ip4\n")
+	conf, err := ParseConfigBytes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := conf.PingClientsConf[0]
+	if !p.literal["127.0.0.1"] || len(p.IPToURL["127.0.0.1"]) != 1 {
+		t.Fatalf("127.0.0.1: literal %v, urls %v; want an ip localhost also resolves to", p.literal["127.0.0.1"], p.IPToURL["127.0.0.1"])
+	}
+	// the ip is kept along with the url it is resolved from
+	out, err := yaml.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ParseConfigBytes(out)
+	if err != nil {
+		t.Fatalf("ParseConfigBytes() of the marshaled config:\n%s\n%s", out, err)
+	}
+	if q := again.PingClientsConf[0]; !q.literal["127.0.0.1"] {
+		t.Errorf("marshaled config:\n%s\nlost ip 127.0.0.1", out)
+	}
+}
+
+func TestParseConfigBytesOverrides(t *testing.T) {
+	config := []byte("defaults:\n  num: 3\napp:\n  p:\n    ips: 10.0.0.1\n    interval: 2s\n    continuous: true\n")
+	overrides := EnvOverrides([]string{
+		"HOME=/root",
+		"PINGCLIENT_INTERVAL=200ms",
+		"PINGCLIENT_NUM=7",
+	})
+	overrides = append(overrides, &Override{Key: "num", Value: "9", Source: "flag -n"})
+	conf, err := ParseConfigBytes(config, overrides...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := conf.PingClientsConf[0]
+	// the last override wins, keys without override keep their value
+	if p.Interval != 200*time.Millisecond || p.Num != 9 || !p.Continuous {
+		t.Errorf("interval %s, num %d, continuous %v; want 200ms, 9, true", p.Interval, p.Num, p.Continuous)
+	}
+
+	tests := []struct {
+		override *Override
+		want     string
+	}{
+		{&Override{Key: "interval", Value: "soon", Source: "PINGCLIENT_INTERVAL"},
+			"error ParseConfig(): PINGCLIENT_INTERVAL: interval should be milliseconds"},
+		{&Override{Key: "ips", Value: "10.0.0.2", Source: "flag -ips"},
+			"error ParseConfig(): flag -ips: key ips can not be overridden"},
+		{&Override{Key: "colour", Value: "blue", Source: "PINGCLIENT_COLOUR"},
+			"error ParseConfig(): PINGCLIENT_COLOUR: unknown key colour"},
+	}
+	for _, tt := range tests {
+		_, err := ParseConfigBytes(config, tt.override)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("ParseConfigBytes() with override %+v = %v, want %q", tt.override, err, tt.want)
+		}
+	}
+}
+
+func TestParseConfigBytesDefaultOverrides(t *testing.T) {
+	config := []byte("defaults:\n  num: 3\napp:\n  p:\n    ips: 10.0.0.1\n    stats_interval: 1s\n  q:\n    ips: 10.0.0.2\n")
+	conf, err := ParseConfigBytes(config,
+		&Override{Key: "stats_interval", Value: "10s", Source: "default", Default: true},
+		&Override{Key: "num", Value: "7", Source: "default", Default: true},
+		&Override{Key: "interval", Value: "2s", Source: "default", Default: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the config file overrides the Default overrides
+	p, q := conf.PingClientsConf[0], conf.PingClientsConf[1]
+	if p.StatsInterval != time.Second || q.StatsInterval != 10*time.Second {
+		t.Errorf("stats_interval %s and %s, want 1s of the ping client and 10s of the default", p.StatsInterval, q.StatsInterval)
+	}
+	if p.Num != 3 || p.Interval != 2*time.Second {
+		t.Errorf("num %d, interval %s; want 3 of defaults and 2s of the default", p.Num, p.Interval)
+	}
+}
+
+func TestNewPingClientConfigWithOverrides(t *testing.T) {
+	conf, err := NewPingClientConfigWithOverrides(&Override{Key: "size", Value: "64", Source: "flag -s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Size != 64 || conf.Num != 5 || conf.Interval != time.Second {
+		t.Errorf("size %d, num %d, interval %s; want 64 and the defaults", conf.Size, conf.Num, conf.Interval)
+	}
+}
+
+func TestPingClientConfigCopyTargets(t *testing.T) {
+	conf, err := ParseConfigBytes([]byte("app:\n  p:\n    ips: 10.0.0.1\n    targets:\n      - ip: 10.0.0.2\n        size: 64\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conf.PingClientsConf[0]
+	p := NewPingClientWithConfig(c)
+
+	// the ping client changes its own targets, not those of the config
+	p.IPs[0].Zone = "eth0"
+	p.TargetOptions["10.0.0.2"].Size = 128
+	if err := p.Add("10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if c.IPs[0].Zone != "" || c.TargetOptions["10.0.0.2"].Size != 64 || len(c.IPs) != 2 {
+		t.Errorf("config changed with the ping client: IPs %v, size %d", c.IPs, c.TargetOptions["10.0.0.2"].Size)
+	}
+}
+
+func TestParseConfigFileHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pingclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("hosts.txt", "# lab\n10.0.0.1\n10.0.1.0/30 # two hosts\n\n10.0.2.1-10.0.2.2\n")
+	write("config.yaml", "app:\n  p:\n    hosts_file: hosts.txt\n")
+
+	// hosts files are relative to the config file, not the current directory
+	conf, err := ParseConfigFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ipStrings(conf.PingClientsConf[0].IPs); got != "10.0.0.1 10.0.1.1 10.0.1.2 10.0.2.1 10.0.2.2" {
+		t.Errorf("IPs %s, want those of hosts.txt", got)
+	}
+
+	write("config.yaml", "app:\n  p:\n    hosts_file: missing.txt\n")
+	if _, err := ParseConfigFile(filepath.Join(dir, "config.yaml")); err == nil ||
+		!strings.HasPrefix(err.Error(), "error ParseConfig(): line 3, column 17: ") {
+		t.Errorf("ParseConfigFile() with a missing hosts file = %v, want an error at line 3, column 17", err)
+	}
+}
@@ -0,0 +1,240 @@
+package pingclient
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// csvStream writes records to a csv.Writer, flushing them at most
+// FlushInterval after they are written so that long running pings stream
+// their results
+type csvStream struct {
+	// FlushInterval is how long records stay buffered at most while
+	// PingClients run. Default is 1s. Records are always flushed when a
+	// PingClient finishes.
+	FlushInterval time.Duration
+
+	mu        sync.Mutex
+	w         *csv.Writer
+	header    []string
+	lastFlush time.Time
+	// flushes the records buffered when no record follows them in time
+	timer *time.Timer
+}
+
+func newCSVStream(w io.Writer, comma rune, header []string) csvStream {
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	return csvStream{
+		FlushInterval: time.Second,
+		w:             cw,
+		header:        header,
+	}
+}
+
+// write writes the header first, then the records, it must be called with
+// s.mu held
+func (s *csvStream) write(records ...[]string) error {
+	if s.header != nil {
+		if err := s.w.Write(s.header); err != nil {
+			return err
+		}
+		s.header = nil
+		s.lastFlush = time.Now()
+	}
+	for _, record := range records {
+		if err := s.w.Write(record); err != nil {
+			return err
+		}
+	}
+	wait := s.FlushInterval - time.Since(s.lastFlush)
+	if wait <= 0 {
+		return s.flush()
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(wait, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			// an error is kept by s.w, the next write or Flush returns it
+			//nolint:errcheck
+			s.flush()
+		})
+	}
+	return nil
+}
+
+// flush must be called with s.mu held
+func (s *csvStream) flush() error {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.w.Flush()
+	s.lastFlush = time.Now()
+	return s.w.Error()
+}
+
+// Flush writes the records buffered to the underlying writer.
+func (s *csvStream) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// PacketCSVWriter writes a CSV (or TSV) record for every packet of the
+// PingClients attached to it, with columns timestamp, client, url, ip, seq,
+// bytes, ttl, rtt_ms and status. Status is ok, duplicate, late, timeout,
+// unreachable, time_exceeded or parameter_problem. Records are streamed, they
+// don't need RecordRtts and PacketsInfo.
+type PacketCSVWriter struct {
+	csvStream
+
+	// OnError is called with the errors writing records, which are dropped
+	// otherwise.
+	OnError func(error)
+}
+
+// NewPacketCSVWriter returns a PacketCSVWriter to w, comma is the field
+// delimiter: ',' for CSV or '\t' for TSV.
+func NewPacketCSVWriter(w io.Writer, comma rune) *PacketCSVWriter {
+	return &PacketCSVWriter{
+		csvStream: newCSVStream(w, comma, []string{
+			"timestamp", "client", "url", "ip", "seq", "bytes", "ttl", "rtt_ms", "status",
+		}),
+	}
+}
+
+// Attach writes the packets of p, chaining OnRecv, OnTimeout, OnError and
+// OnFinish: the callbacks set before are still called. Attach must be
+// called before p runs.
+func (w *PacketCSVWriter) Attach(p *PingClient) {
+	onRecv, onTimeout, onError, onFinish := p.OnRecv, p.OnTimeout, p.OnError, p.OnFinish
+	p.OnRecv = func(pkt *Packet) {
+		if onRecv != nil {
+			onRecv(pkt)
+		}
+		w.writePacket(p, pkt.IP, pkt.Seq, []string{
+			strconv.Itoa(pkt.Nbytes), strconv.Itoa(pkt.Ttl), formatMs(pkt.Rtt), packetStatus(pkt),
+		})
+	}
+	p.OnTimeout = func(pkt *Packet) {
+		if onTimeout != nil {
+			onTimeout(pkt)
+		}
+		w.writePacket(p, pkt.IP, pkt.Seq, []string{"", "", "", "timeout"})
+	}
+	p.OnError = func(icmpErr *ICMPError) {
+		if onError != nil {
+			onError(icmpErr)
+		}
+		w.writePacket(p, icmpErr.IP, icmpErr.Seq, []string{"", "", "", lostStatus(icmpErr)})
+	}
+	p.OnFinish = func(stats []*Statistics) {
+		if onFinish != nil {
+			onFinish(stats)
+		}
+		w.report(w.Flush())
+	}
+}
+
+// writePacket writes the record of a packet of p, fields follow ip and seq
+func (w *PacketCSVWriter) writePacket(p *PingClient, ip string, seq int, fields []string) {
+	record := append([]string{
+		time.Now().Format(time.RFC3339Nano), p.Name, strings.Join(p.urlsOf(ip), " "), ip, strconv.Itoa(seq),
+	}, fields...)
+	w.mu.Lock()
+	err := w.write(record)
+	w.mu.Unlock()
+	w.report(err)
+}
+
+func (w *PacketCSVWriter) report(err error) {
+	if handler := w.OnError; err != nil && handler != nil {
+		handler(fmt.Errorf("error PacketCSVWriter: %s", err))
+	}
+}
+
+// StatisticsCSVWriter writes a CSV (or TSV) record with the Statistics of
+// every IP of the PingClients attached to it every StatsInterval while they
+// run, and when they finish.
+type StatisticsCSVWriter struct {
+	csvStream
+
+	// OnError is called with the errors writing records, which are dropped
+	// otherwise.
+	OnError func(error)
+}
+
+// NewStatisticsCSVWriter returns a StatisticsCSVWriter to w, comma is the
+// field delimiter: ',' for CSV or '\t' for TSV.
+func NewStatisticsCSVWriter(w io.Writer, comma rune) *StatisticsCSVWriter {
+	return &StatisticsCSVWriter{
+		csvStream: newCSVStream(w, comma, []string{
+			"timestamp", "client", "url", "ip", "packets_sent", "packets_recv", "packet_loss", "duplicates",
+			"min_rtt_ms", "avg_rtt_ms", "max_rtt_ms", "stddev_rtt_ms", "p50_rtt_ms", "p90_rtt_ms", "p99_rtt_ms",
+			"jitter_ms",
+		}),
+	}
+}
+
+// Attach writes the cumulative Statistics of p every StatsInterval, if set,
+// and when it finishes, chaining OnStats and OnFinish. It must be called
+// before p runs.
+func (w *StatisticsCSVWriter) Attach(p *PingClient) {
+	onStats, onFinish := p.OnStats, p.OnFinish
+	p.OnStats = func(cumulative []*Statistics, delta []*Statistics) {
+		if onStats != nil {
+			onStats(cumulative, delta)
+		}
+		w.report(w.Write(cumulative))
+	}
+	p.OnFinish = func(stats []*Statistics) {
+		if onFinish != nil {
+			onFinish(stats)
+		}
+		err := w.Write(stats)
+		if err == nil {
+			err = w.Flush()
+		}
+		w.report(err)
+	}
+}
+
+func (w *StatisticsCSVWriter) report(err error) {
+	if handler := w.OnError; err != nil && handler != nil {
+		handler(fmt.Errorf("error StatisticsCSVWriter: %s", err))
+	}
+}
+
+// Write writes a record for every Statistics, e.g. the snapshots of
+// OnStats.
+func (w *StatisticsCSVWriter) Write(stats []*Statistics) error {
+	now := time.Now().Format(time.RFC3339Nano)
+	records := make([][]string, 0, len(stats))
+	for _, s := range stats {
+		url := s.URL
+		if len(s.URLs) > 0 {
+			url = strings.Join(s.URLs, " ")
+		}
+		records = append(records, []string{
+			now, s.Name, url, s.IP,
+			strconv.Itoa(s.PacketsSent), strconv.Itoa(s.PacketsRecv),
+			strconv.FormatFloat(s.PacketLoss, 'f', -1, 64), strconv.Itoa(s.Duplicates),
+			formatMs(s.MinRtt), formatMs(s.AvgRtt), formatMs(s.MaxRtt), formatMs(s.StdDevRtt),
+			formatMs(s.P50Rtt), formatMs(s.P90Rtt), formatMs(s.P99Rtt), formatMs(s.Jitter),
+		})
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.write(records...)
+}
+
+// formatMs formats d in milliseconds with microsecond precision
+func formatMs(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
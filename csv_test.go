@@ -0,0 +1,151 @@
+package pingclient
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the writes of the flush timer
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// records parses the CSV written to b
+func (b *syncBuffer) records(t *testing.T, comma rune) [][]string {
+	t.Helper()
+	r := csv.NewReader(strings.NewReader(b.String()))
+	r.Comma = comma
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestPacketCSVWriter(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond, TTL: 60})
+	sim.SetLink("10.0.0.2", &SimLink{Loss: 1})
+	p := newSimClient(t, sim, "10.0.0.1", "10.0.0.2")
+	p.Name = "lab"
+	p.ReplyTimeout = 10 * time.Millisecond
+
+	var b syncBuffer
+	w := NewPacketCSVWriter(&b, '\t')
+	w.OnError = func(err error) { t.Errorf("OnError(%s)", err) }
+	w.Attach(p)
+	runFor(t, p, 50*time.Millisecond)
+
+	records := b.records(t, '\t')
+	if want := "timestamp client url ip seq bytes ttl rtt_ms status"; len(records) == 0 || strings.Join(records[0], " ") != want {
+		t.Fatalf("header %q, want %q", records[0], want)
+	}
+	count := make(map[string]int)
+	for _, r := range records[1:] {
+		if len(r) != 9 || r[1] != "lab" {
+			t.Fatalf("record %q, want 9 columns of client lab", r)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, r[0]); err != nil {
+			t.Errorf("record %q: %s", r, err)
+		}
+		count[r[3]+" "+r[8]]++
+		switch r[8] {
+		case "ok":
+			if r[3] != "10.0.0.1" || r[5] != "24" || r[6] != "60" || r[7] == "" {
+				t.Errorf("record %q, want a reply of 10.0.0.1 with 24 bytes and TTL 60", r)
+			}
+		case "timeout":
+			if r[3] != "10.0.0.2" || r[5] != "" || r[6] != "" || r[7] != "" {
+				t.Errorf("record %q, want a timeout of 10.0.0.2 without reply fields", r)
+			}
+		default:
+			t.Errorf("record %q, want status ok or timeout", r)
+		}
+	}
+	if recv := statsOf(t, p, "10.0.0.1").PacketsRecv; count["10.0.0.1 ok"] != recv {
+		t.Errorf("%d ok records, want %d", count["10.0.0.1 ok"], recv)
+	}
+	if count["10.0.0.2 timeout"] == 0 {
+		t.Errorf("no timeout record for 10.0.0.2")
+	}
+}
+
+func TestStatisticsCSVWriter(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Name = "lab"
+	p.StatsInterval = 20 * time.Millisecond
+
+	var b syncBuffer
+	w := NewStatisticsCSVWriter(&b, ',')
+	w.FlushInterval = 10 * time.Millisecond
+	w.OnError = func(err error) { t.Errorf("OnError(%s)", err) }
+
+	// the snapshots of OnStats are streamed while p runs
+	streamed := make(chan int, 10)
+	p.OnStats = func(cumulative []*Statistics, delta []*Statistics) {
+		select {
+		case streamed <- strings.Count(b.String(), "\n"):
+		default:
+		}
+	}
+	w.Attach(p)
+	runFor(t, p, 100*time.Millisecond)
+
+	records := b.records(t, ',')
+	if len(records) < 4 || records[0][0] != "timestamp" || records[0][4] != "packets_sent" {
+		t.Fatalf("records %q, want a header, several snapshots and the final statistics", records)
+	}
+	last := records[len(records)-1]
+	s := statsOf(t, p, "10.0.0.1")
+	if last[1] != "lab" || last[3] != "10.0.0.1" || last[4] != strconv.Itoa(s.PacketsSent) || last[5] != strconv.Itoa(s.PacketsRecv) {
+		t.Errorf("last record %q, want the final statistics of 10.0.0.1", last)
+	}
+	close(streamed)
+	lines := 0
+	for n := range streamed {
+		lines = n
+	}
+	if lines == 0 {
+		t.Errorf("nothing written before p finished, want the snapshots streamed")
+	}
+}
+
+func TestCSVStreamFlushTimer(t *testing.T) {
+	var b syncBuffer
+	w := NewStatisticsCSVWriter(&b, ',')
+	w.FlushInterval = 20 * time.Millisecond
+	if err := w.Write([]*Statistics{{Name: "lab", IP: "10.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != "" {
+		t.Fatalf("wrote %q right away, want the records buffered", got)
+	}
+	// the records are flushed without another write
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(b.String(), "\n") != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("wrote %q, want the header and the record flushed within FlushInterval", b.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -4,5 +4,5 @@ go 1.15
 
 require (
 	golang.org/x/net v0.0.0-20201224014010-6772e930b67b
-	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,174 @@
+package pingclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// maxExpandedIPs bounds the number of addresses a CIDR or IP range expands to
+const maxExpandedIPs = 1 << 16
+
+// ExpandIPs parses s as an IP address, a CIDR range like "10.0.0.0/24" or an
+// IP range like "10.0.0.1-10.0.0.50" and returns the addresses it holds. The
+// network and broadcast addresses of a CIDR range are left out, except in
+// the /31 and /32 (/127 and /128 for IPv6) ranges that have none. Ranges may
+// hold up to 65536 addresses.
+func ExpandIPs(s string) ([]*net.IPAddr, error) {
+	ipAddrs, ok, err := expandIPs(s)
+	if !ok {
+		return nil, fmt.Errorf("error ExpandIPs(): %s is not an IP address, a CIDR range or an IP range", s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error ExpandIPs(): %s", err)
+	}
+	return ipAddrs, nil
+}
+
+// expandIPs is ExpandIPs, ok is false if s doesn't look like an IP address
+// or a range at all, e.g. it is a URL
+func expandIPs(s string) (ipAddrs []*net.IPAddr, ok bool, err error) {
+	if ipAddr := parseIPAddr(s); ipAddr != nil {
+		return []*net.IPAddr{ipAddr}, true, nil
+	}
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		if parseIP(s[:i]) == nil {
+			return nil, false, nil
+		}
+		ipAddrs, err = expandCIDR(s)
+		return ipAddrs, true, err
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		// host names may have dashes too
+		start := parseIP(s[:i])
+		if start == nil {
+			return nil, false, nil
+		}
+		end := parseIP(s[i+1:])
+		if end == nil {
+			return nil, true, fmt.Errorf("%s should be an IP range like 10.0.0.1-10.0.0.50", s)
+		}
+		ipAddrs, err = expandRange(s, start, end)
+		return ipAddrs, true, err
+	}
+	return nil, false, nil
+}
+
+// expandCIDR returns the host addresses of the CIDR range s
+func expandCIDR(s string) ([]*net.IPAddr, error) {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s should be a CIDR range like 10.0.0.0/24", s)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("CIDR range %s is larger than %d addresses", s, maxExpandedIPs)
+	}
+	first := ipNet.IP
+	if isIPv4(ip) {
+		first = first.To4()
+	}
+	count := 1 << uint(bits-ones)
+	// no network and broadcast addresses in IPv4 ranges of more than two,
+	// IPv6 has no broadcast address
+	skipEnds := isIPv4(ip) && count > 2
+
+	ipAddrs := make([]*net.IPAddr, 0, count)
+	current := first
+	for i := 0; i < count; i++ {
+		if !skipEnds || (i != 0 && i != count-1) {
+			ipAddrs = append(ipAddrs, &net.IPAddr{IP: current})
+		}
+		current = nextIP(current)
+	}
+	return ipAddrs, nil
+}
+
+// expandRange returns the addresses from start to end, both included
+func expandRange(s string, start net.IP, end net.IP) ([]*net.IPAddr, error) {
+	if isIPv4(start) != isIPv4(end) {
+		return nil, fmt.Errorf("IP range %s mixes IPv4 and IPv6", s)
+	}
+	if isIPv4(start) {
+		start, end = start.To4(), end.To4()
+	} else {
+		start, end = start.To16(), end.To16()
+	}
+	if bytes.Compare(start, end) > 0 {
+		return nil, fmt.Errorf("IP range %s should start at the lower address", s)
+	}
+
+	ipAddrs := make([]*net.IPAddr, 0)
+	for current := start; ; current = nextIP(current) {
+		if len(ipAddrs) == maxExpandedIPs {
+			return nil, fmt.Errorf("IP range %s is larger than %d addresses", s, maxExpandedIPs)
+		}
+		ipAddrs = append(ipAddrs, &net.IPAddr{IP: current})
+		if current.Equal(end) {
+			return ipAddrs, nil
+		}
+	}
+}
+
+// nextIP returns the address after ip
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// ReadHostsFile reads the targets of a hosts file: IP addresses, CIDR
+// ranges, IP ranges or URLs, one per line. Everything after a '#' is a
+// comment, blank lines are skipped.
+func ReadHostsFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("error ReadHostsFile(): %s", err)
+	}
+	defer f.Close()
+
+	hosts := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		switch len(fields) {
+		case 0:
+		case 1:
+			hosts = append(hosts, fields[0])
+		default:
+			return nil, fmt.Errorf("error ReadHostsFile(): %s line %d: one host per line, got %q", name, line, strings.TrimSpace(text))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error ReadHostsFile(): %s", err)
+	}
+	return hosts, nil
+}
+
+// appendIPs appends the ipAddrs that are not seen yet to list and adds them
+// to seen, which has the IPs of list
+func appendIPs(list []*net.IPAddr, ipAddrs []*net.IPAddr, seen map[string]bool) []*net.IPAddr {
+	for _, ipAddr := range ipAddrs {
+		ipStr := ipAddr.String()
+		if !seen[ipStr] {
+			seen[ipStr] = true
+			list = append(list, ipAddr)
+		}
+	}
+	return list
+}
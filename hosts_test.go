@@ -0,0 +1,95 @@
+package pingclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandIPs(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"10.0.0.1", "10.0.0.1"},
+		{"10.0.0.0/30", "10.0.0.1 10.0.0.2"},
+		{"10.0.0.5/29", "10.0.0.1 10.0.0.2 10.0.0.3 10.0.0.4 10.0.0.5 10.0.0.6"},
+		{"10.0.0.0/31", "10.0.0.0 10.0.0.1"},
+		{"10.0.0.7/32", "10.0.0.7"},
+		{"10.0.0.254-10.0.1.1", "10.0.0.254 10.0.0.255 10.0.1.0 10.0.1.1"},
+		{"10.0.0.3-10.0.0.3", "10.0.0.3"},
+		{"2001:db8::/126", "2001:db8:: 2001:db8::1 2001:db8::2 2001:db8::3"},
+		{"2001:db8::/127", "2001:db8:: 2001:db8::1"},
+		{"2001:db8::ffff-2001:db8::1:1", "2001:db8::ffff 2001:db8::1:0 2001:db8::1:1"},
+	}
+	for _, tt := range tests {
+		ipAddrs, err := ExpandIPs(tt.s)
+		if err != nil {
+			t.Errorf("ExpandIPs(%q): %s", tt.s, err)
+			continue
+		}
+		if got := ipStrings(ipAddrs); got != tt.want {
+			t.Errorf("ExpandIPs(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+
+	if ipAddrs, err := ExpandIPs("10.0.0.0/16"); err != nil || len(ipAddrs) != 65534 {
+		t.Errorf("ExpandIPs(10.0.0.0/16) = %d addresses, %v; want 65534", len(ipAddrs), err)
+	}
+	if ipAddrs, err := ExpandIPs("fe80::1%eth0"); err != nil || len(ipAddrs) != 1 || ipAddrs[0].Zone != "eth0" {
+		t.Errorf("ExpandIPs(fe80::1%%eth0) = %v, %v; want the address with its zone", ipAddrs, err)
+	}
+}
+
+func TestExpandIPsErrors(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"example.com", "example.com is not an IP address, a CIDR range or an IP range"},
+		{"my-host", "my-host is not an IP address, a CIDR range or an IP range"},
+		{"10.0.0.0/33", "10.0.0.0/33 should be a CIDR range like 10.0.0.0/24"},
+		{"10.0.0.0/15", "CIDR range 10.0.0.0/15 is larger than 65536 addresses"},
+		{"10.0.0.1-10.0.0.x", "10.0.0.1-10.0.0.x should be an IP range like 10.0.0.1-10.0.0.50"},
+		{"10.0.0.9-10.0.0.1", "IP range 10.0.0.9-10.0.0.1 should start at the lower address"},
+		{"10.0.0.1-2001:db8::1", "IP range 10.0.0.1-2001:db8::1 mixes IPv4 and IPv6"},
+		{"10.0.0.0-10.1.0.0", "IP range 10.0.0.0-10.1.0.0 is larger than 65536 addresses"},
+	}
+	for _, tt := range tests {
+		_, err := ExpandIPs(tt.s)
+		if want := "error ExpandIPs(): " + tt.want; err == nil || err.Error() != want {
+			t.Errorf("ExpandIPs(%q) = %v, want %q", tt.s, err, want)
+		}
+	}
+}
+
+func TestReadHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pingclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "hosts.txt")
+	content := "# targets\n\n  example.com  \n10.0.0.0/30 # lab\n\t2001:db8::1\n"
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := ReadHostsFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com", "10.0.0.0/30", "2001:db8::1"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("ReadHostsFile() = %q, want %q", hosts, want)
+	}
+
+	if err := ioutil.WriteFile(name, []byte("10.0.0.1\n10.0.0.2 10.0.0.3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadHostsFile(name); err == nil || !strings.Contains(err.Error(), "line 2: one host per line") {
+		t.Errorf("ReadHostsFile() with two hosts on a line = %v, want an error on line 2", err)
+	}
+}
@@ -0,0 +1,277 @@
+package pingclient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	ipv4HeaderMinLength = 20
+	ipv6HeaderLength    = 40
+	icmpHeaderLength    = 8
+)
+
+// ICMPErrorType is the kind of an ICMP error message.
+type ICMPErrorType int
+
+const (
+	// ICMPUnreachable is a Destination Unreachable (or ICMPv6 Packet Too Big)
+	// message.
+	ICMPUnreachable ICMPErrorType = iota + 1
+	// ICMPTimeExceeded is a Time Exceeded message, e.g. the TTL ran out in
+	// a routing loop.
+	ICMPTimeExceeded
+	// ICMPParameterProblem is a Parameter Problem message.
+	ICMPParameterProblem
+)
+
+func (t ICMPErrorType) String() string {
+	switch t {
+	case ICMPUnreachable:
+		return "Destination Unreachable"
+	case ICMPTimeExceeded:
+		return "Time Exceeded"
+	case ICMPParameterProblem:
+		return "Parameter Problem"
+	default:
+		return fmt.Sprintf("ICMPErrorType(%d)", int(t))
+	}
+}
+
+// UnreachableCode is the reason of a Destination Unreachable message,
+// normalized across ICMP and ICMPv6 codes.
+type UnreachableCode int
+
+const (
+	// UnreachableOther is any code without a more specific UnreachableCode.
+	UnreachableOther UnreachableCode = iota
+	// UnreachableNet means there is no route to the destination network.
+	UnreachableNet
+	// UnreachableHost means the destination host is down or unknown.
+	UnreachableHost
+	// UnreachableProtocol means the destination doesn't speak ICMP.
+	UnreachableProtocol
+	// UnreachablePort means the destination port is closed.
+	UnreachablePort
+	// UnreachableFragmentationNeeded means the packet is larger than the path
+	// MTU (ICMPv6 Packet Too Big).
+	UnreachableFragmentationNeeded
+	// UnreachableAdminProhibited means a firewall or policy blocked the packet.
+	UnreachableAdminProhibited
+)
+
+func (c UnreachableCode) String() string {
+	switch c {
+	case UnreachableNet:
+		return "Net Unreachable"
+	case UnreachableHost:
+		return "Host Unreachable"
+	case UnreachableProtocol:
+		return "Protocol Unreachable"
+	case UnreachablePort:
+		return "Port Unreachable"
+	case UnreachableFragmentationNeeded:
+		return "Fragmentation Needed"
+	case UnreachableAdminProhibited:
+		return "Administratively Prohibited"
+	default:
+		return "Unreachable"
+	}
+}
+
+// ICMPError is an ICMP error message received in response to one of the
+// echo requests sent by PingClient.
+type ICMPError struct {
+	// Type is the kind of the ICMP error message.
+	Type ICMPErrorType
+
+	// Code is the ICMP code of the message as received.
+	Code int
+
+	// Unreachable is the normalized Code of an ICMPUnreachable message.
+	Unreachable UnreachableCode
+
+	// IPAddr is the address of the host being pinged.
+	IPAddr *net.IPAddr
+
+	// IP address in string format e.g "142.250.71.78", with the zone of a
+	// link-local IPv6 address e.g "fe80::1%eth0"
+	IP string
+
+	// Seq is the ICMP sequence number of the echo request.
+	Seq int
+
+	// From is the address of the router or host that sent the message.
+	From string
+}
+
+func (e *ICMPError) Error() string {
+	reason := e.Type.String()
+	if e.Type == ICMPUnreachable {
+		reason = e.Unreachable.String()
+	}
+	return fmt.Sprintf("From %s icmp_seq=%d %s (code %d) for %s", e.From, e.Seq, reason, e.Code, e.IP)
+}
+
+// icmpErrorType maps an ICMP message type to ICMPErrorType, 0 means the
+// message is not an error message PingClient handles
+func icmpErrorType(typ icmp.Type) ICMPErrorType {
+	switch typ {
+	case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable, ipv6.ICMPTypePacketTooBig:
+		return ICMPUnreachable
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		return ICMPTimeExceeded
+	case ipv4.ICMPTypeParameterProblem, ipv6.ICMPTypeParameterProblem:
+		return ICMPParameterProblem
+	}
+	return 0
+}
+
+// unreachableCode normalizes the code of a Destination Unreachable message
+func unreachableCode(typ icmp.Type, code int) UnreachableCode {
+	if typ == ipv6.ICMPTypePacketTooBig {
+		return UnreachableFragmentationNeeded
+	}
+	if typ == ipv6.ICMPTypeDestinationUnreachable {
+		switch code {
+		case 0:
+			return UnreachableNet
+		case 1, 5, 6:
+			return UnreachableAdminProhibited
+		case 3:
+			return UnreachableHost
+		case 4:
+			return UnreachablePort
+		}
+		return UnreachableOther
+	}
+	switch code {
+	case 0, 6, 11:
+		return UnreachableNet
+	case 1, 7, 12:
+		return UnreachableHost
+	case 2:
+		return UnreachableProtocol
+	case 3:
+		return UnreachablePort
+	case 4:
+		return UnreachableFragmentationNeeded
+	case 9, 10, 13:
+		return UnreachableAdminProhibited
+	}
+	return UnreachableOther
+}
+
+// icmpErrorData returns the original datagram quoted in an ICMP error message
+func icmpErrorData(body icmp.MessageBody) []byte {
+	switch body := body.(type) {
+	case *icmp.DstUnreach:
+		return body.Data
+	case *icmp.TimeExceeded:
+		return body.Data
+	case *icmp.ParamProb:
+		return body.Data
+	case *icmp.PacketTooBig:
+		return body.Data
+	}
+	return nil
+}
+
+// parseQuotedEcho extracts destination, ID and sequence number of the echo
+// request quoted in an ICMP error message, ok is false if data doesn't quote
+// an echo request
+func parseQuotedEcho(data []byte) (dst net.IP, id int, seq int, ok bool) {
+	if len(data) < 1 {
+		return nil, 0, 0, false
+	}
+	var echo []byte
+	switch data[0] >> 4 {
+	case ipv4.Version:
+		hdrLen := int(data[0]&0x0f) * 4
+		if hdrLen < ipv4HeaderMinLength || len(data) < hdrLen+icmpHeaderLength || data[9] != protocolICMP {
+			return nil, 0, 0, false
+		}
+		dst = net.IP(data[16:20])
+		echo = data[hdrLen:]
+		if echo[0] != byte(ipv4.ICMPTypeEcho) {
+			return nil, 0, 0, false
+		}
+	case ipv6.Version:
+		if len(data) < ipv6HeaderLength+icmpHeaderLength || data[6] != protocolIPv6ICMP {
+			return nil, 0, 0, false
+		}
+		dst = net.IP(data[24:40])
+		echo = data[ipv6HeaderLength:]
+		if echo[0] != byte(ipv6.ICMPTypeEchoRequest) {
+			return nil, 0, 0, false
+		}
+	default:
+		return nil, 0, 0, false
+	}
+	id = int(binary.BigEndian.Uint16(echo[4:6]))
+	seq = int(binary.BigEndian.Uint16(echo[6:8]))
+	return dst, id, seq, true
+}
+
+// processError matches an ICMP error message to the echo request it quotes,
+// counts it and calls OnError
+func (p *PingClient) processError(m *icmp.Message, from string) error {
+	typ := icmpErrorType(m.Type)
+	dst, id, seq, ok := parseQuotedEcho(icmpErrorData(m.Body))
+	if !ok {
+		// not about an echo request
+		return nil
+	}
+	// the quoted destination has no zone, a link-local one is on the
+	// interface the error came in on
+	dstAddr := &net.IPAddr{IP: dst}
+	if fromAddr := parseIPAddr(from); fromAddr != nil && (dst.IsLinkLocalUnicast() || dst.IsLinkLocalMulticast()) {
+		dstAddr.Zone = fromAddr.Zone
+	}
+	icmpErr := &ICMPError{
+		Type: typ,
+		Code: m.Code,
+		IP:   dstAddr.String(),
+		Seq:  seq,
+		From: from,
+	}
+	if typ == ICMPUnreachable {
+		icmpErr.Unreachable = unreachableCode(m.Type, m.Code)
+	}
+
+	p.mu.Lock()
+	t, ok := p.targets[icmpErr.IP]
+	if ok {
+		_, ok = t.pending[seq]
+	}
+	// If we are priviledged, we can match icmp.ID
+	if ok && p.protocol == "icmp" && id != t.id {
+		ok = false
+	}
+	if !ok {
+		// not one of our outstanding echo requests
+		p.mu.Unlock()
+		return nil
+	}
+	delete(t.pending, seq)
+	icmpErr.IPAddr = p.findIPAddrbyString(icmpErr.IP)
+	if r, ok := p.rttStats[icmpErr.IP]; ok {
+		r.icmpError(icmpErr)
+	}
+	if r, ok := p.deltaStats[icmpErr.IP]; ok {
+		r.icmpError(icmpErr)
+	}
+	p.mu.Unlock()
+
+	handler := p.OnError
+	if handler != nil {
+		handler(icmpErr)
+	}
+	p.sinkLost(icmpErr.IP, icmpErr.Seq, lostStatus(icmpErr))
+	return nil
+}
@@ -0,0 +1,268 @@
+package pingclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// influxBatchSize is the number of lines an InfluxSink over http buffers
+// before writing them
+const influxBatchSize = 1000
+
+// InfluxSink pushes the events of a PingClient to InfluxDB in the line
+// protocol, over http or udp. Every packet is a point of measurement
+// Measurement tagged with client, url, ip and status, with fields seq and,
+// for replies, rtt_ms, ttl and bytes. Statistics are points of measurement
+// Measurement + "_stats". Over http points are written in batches, at the
+// latest with the statistics.
+type InfluxSink struct {
+	// Measurement is the name of the packet measurement, "ping" by default.
+	Measurement string
+
+	// Token authenticates the writes over http ("Authorization: Token").
+	Token string
+
+	// Client sends the writes over http.
+	Client *http.Client
+
+	url *url.URL
+	udp *udpWriter
+
+	mu    sync.Mutex
+	lines bytes.Buffer
+	count int
+	// writes over http are sent one at a time, in the background but for
+	// Flush
+	sending sync.Mutex
+	err     error
+}
+
+// NewInfluxSink returns an InfluxSink writing to address: the http(s) URL
+// of the write endpoint, e.g.
+// "http://localhost:8086/api/v2/write?org=o&bucket=b" or
+// "http://localhost:8086/write?db=ping" with InfluxDB 1.x, or
+// "udp://host:port".
+func NewInfluxSink(address string, token string, measurement string) (*InfluxSink, error) {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("error NewInfluxSink(): address %s should be like http://localhost:8086/api/v2/write?bucket=b or udp://host:port", address)
+	}
+	if measurement == "" {
+		measurement = "ping"
+	}
+	s := &InfluxSink{
+		Measurement: measurement,
+		Token:       token,
+		Client:      &http.Client{Timeout: 5 * time.Second},
+	}
+	switch u.Scheme {
+	case "http", "https":
+		s.url = u
+	case "udp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("error NewInfluxSink(): address %s should have a port", address)
+		}
+		s.udp = &udpWriter{address: u.Host}
+	default:
+		return nil, fmt.Errorf("error NewInfluxSink(): address %s should be http, https or udp", address)
+	}
+	return s, nil
+}
+
+// Received writes the point of a received packet.
+func (s *InfluxSink) Received(e *PacketEvent) error {
+	fields := fmt.Sprintf("seq=%di,rtt_ms=%s,ttl=%di,bytes=%di",
+		e.Seq, formatMs(e.Rtt), e.TTL, e.Bytes)
+	return s.write(s.packetLine(e, fields))
+}
+
+// Lost writes the point of a lost packet.
+func (s *InfluxSink) Lost(e *PacketEvent) error {
+	return s.write(s.packetLine(e, fmt.Sprintf("seq=%di", e.Seq)))
+}
+
+// Stats writes a point per IP and sends the points buffered.
+func (s *InfluxSink) Stats(stats []*Statistics) error {
+	now := time.Now().UnixNano()
+	lines := make([]string, 0, len(stats))
+	for _, stat := range stats {
+		url := stat.URL
+		if len(stat.URLs) > 0 {
+			url = strings.Join(stat.URLs, " ")
+		}
+		var b strings.Builder
+		b.WriteString(influxEscape(s.Measurement+"_stats", ", "))
+		writeInfluxTags(&b, "client", stat.Name, "url", url, "ip", stat.IP)
+		fmt.Fprintf(&b, " packets_sent=%di,packets_recv=%di,packet_loss=%s,duplicates=%di,"+
+			"min_rtt_ms=%s,avg_rtt_ms=%s,max_rtt_ms=%s,stddev_rtt_ms=%s,p50_rtt_ms=%s,p90_rtt_ms=%s,p99_rtt_ms=%s,jitter_ms=%s %d",
+			stat.PacketsSent, stat.PacketsRecv, strconv.FormatFloat(stat.PacketLoss, 'f', -1, 64), stat.Duplicates,
+			formatMs(stat.MinRtt), formatMs(stat.AvgRtt), formatMs(stat.MaxRtt), formatMs(stat.StdDevRtt),
+			formatMs(stat.P50Rtt), formatMs(stat.P90Rtt), formatMs(stat.P99Rtt), formatMs(stat.Jitter), now)
+		lines = append(lines, b.String())
+	}
+	if s.udp != nil {
+		return s.writeUDP(lines)
+	}
+	s.mu.Lock()
+	for _, line := range lines {
+		s.lines.WriteString(line)
+		s.lines.WriteByte('\n')
+	}
+	s.count += len(lines)
+	s.mu.Unlock()
+	go s.sendAsync()
+	return s.takeErr()
+}
+
+// Flush sends the points buffered and waits for them to be written.
+func (s *InfluxSink) Flush() error {
+	if s.udp != nil {
+		return nil
+	}
+	// send waits for the writes in the background, their error comes second
+	err := s.send()
+	if bgErr := s.takeErr(); err == nil {
+		err = bgErr
+	}
+	return err
+}
+
+// Close closes the udp socket or the idle http connections.
+func (s *InfluxSink) Close() error {
+	if s.udp == nil {
+		s.Client.CloseIdleConnections()
+		return nil
+	}
+	if err := s.udp.close(); err != nil {
+		return fmt.Errorf("error InfluxSink: %s", err)
+	}
+	return nil
+}
+
+func (s *InfluxSink) packetLine(e *PacketEvent, fields string) string {
+	var b strings.Builder
+	b.WriteString(influxEscape(s.Measurement, ", "))
+	writeInfluxTags(&b, "client", e.Client, "url", e.URL, "ip", e.IP, "status", e.Status)
+	fmt.Fprintf(&b, " %s %d", fields, e.Time.UnixNano())
+	return b.String()
+}
+
+// write sends line over udp right away, or buffers it for http
+func (s *InfluxSink) write(line string) error {
+	if s.udp != nil {
+		return s.writeUDP([]string{line})
+	}
+	s.mu.Lock()
+	s.lines.WriteString(line)
+	s.lines.WriteByte('\n')
+	s.count++
+	full := s.count >= influxBatchSize
+	s.mu.Unlock()
+	if full {
+		go s.sendAsync()
+	}
+	return s.takeErr()
+}
+
+func (s *InfluxSink) writeUDP(lines []string) error {
+	if err := s.udp.writeLines(lines); err != nil {
+		return fmt.Errorf("error InfluxSink: %s", err)
+	}
+	return nil
+}
+
+// sendAsync writes the points buffered in the background, its error is
+// returned by the next call
+func (s *InfluxSink) sendAsync() {
+	if err := s.send(); err != nil {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+	}
+}
+
+// send writes the points buffered over http
+func (s *InfluxSink) send() error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+
+	s.mu.Lock()
+	if s.count == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	body := append([]byte(nil), s.lines.Bytes()...)
+	s.lines.Reset()
+	s.count = 0
+	s.mu.Unlock()
+
+	return s.post(body)
+}
+
+func (s *InfluxSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error InfluxSink: %s", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.Token)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error InfluxSink: %s", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error InfluxSink: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// takeErr returns the error of a write in the background, once
+func (s *InfluxSink) takeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// writeInfluxTags writes the tags of a point as ",key=value" pairs, tags
+// without value are left out
+func writeInfluxTags(b *strings.Builder, kv ...string) {
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] == "" {
+			continue
+		}
+		b.WriteString(",")
+		b.WriteString(kv[i])
+		b.WriteString("=")
+		b.WriteString(influxEscape(kv[i+1], ", ="))
+	}
+}
+
+// influxEscape escapes the characters of s in special with a backslash
+func influxEscape(s string, special string) string {
+	if !strings.ContainsAny(s, special+`\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
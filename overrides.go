@@ -0,0 +1,121 @@
+package pingclient
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables overriding config keys
+const envPrefix = "PINGCLIENT_"
+
+// Override sets a config key of every ping client on top of the config file,
+// the way an environment variable or a command line flag does. The layers
+// are: the Default overrides, defaults, the ping client in the config file,
+// then the other overrides, the last one of a layer winning.
+type Override struct {
+	// Key is a config key like interval or num. Targets (ips, urls,
+	// hosts_file and targets) can not be overridden.
+	Key string
+
+	// Value is the value as it would be written in the config file, e.g.
+	// "200ms" or "true".
+	Value string
+
+	// Source tells where the override comes from in errors, e.g.
+	// "PINGCLIENT_INTERVAL" or "flag -i".
+	Source string
+
+	// Default applies the override beneath the config file instead, to the
+	// ping clients setting the key neither themselves nor in defaults.
+	Default bool
+}
+
+// EnvOverrides returns the overrides set by the environment variables
+// PINGCLIENT_<KEY> in environ (as returned by os.Environ), e.g.
+// PINGCLIENT_INTERVAL=200ms or PINGCLIENT_RESOLVE_ALL=true.
+func EnvOverrides(environ []string) []*Override {
+	overrides := make([]*Override, 0)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, envPrefix)
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		overrides = append(overrides, &Override{
+			Key:    strings.ToLower(kv[:i]),
+			Value:  kv[i+1:],
+			Source: envPrefix + kv[:i],
+		})
+	}
+	return overrides
+}
+
+// NewPingClientConfigWithOverrides returns the default PingClientConfig with
+// the overrides applied, for ping clients set up without a config file.
+func NewPingClientConfigWithOverrides(overrides ...*Override) (*PingClientConfig, error) {
+	beneath, above, err := parseOverrides(overrides)
+	if err != nil {
+		return nil, err
+	}
+	return parsePingClientConfig([]*yaml.Node{beneath}, nil, above, "")
+}
+
+// parseOverrides turns the overrides into a mapping applied on top of every
+// ping client and one of the Default overrides applied beneath, nil if there
+// are none. Every override is checked on its own so that errors name its
+// source.
+func parseOverrides(overrides []*Override) (beneath *yaml.Node, above *yaml.Node, err error) {
+	for _, o := range overrides {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: o.Key}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: o.Value}
+		if isTargetKey(o.Key) {
+			return nil, nil, &parseError{source: o.Source, msg: "key " + o.Key + " can not be overridden"}
+		}
+		pair := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{key, value}}
+		if _, err := parsePingClientConfig(nil, pair, nil, ""); err != nil {
+			if e, ok := err.(*parseError); ok {
+				e.source = o.Source
+			}
+			return nil, nil, err
+		}
+		layer := &above
+		if o.Default {
+			layer = &beneath
+		}
+		if *layer == nil {
+			*layer = &yaml.Node{Kind: yaml.MappingNode}
+		}
+		// the last override of a key wins
+		replaced := false
+		for i := 0; i+1 < len((*layer).Content); i += 2 {
+			if sameKey((*layer).Content[i].Value, o.Key) {
+				(*layer).Content[i+1] = value
+				replaced = true
+			}
+		}
+		if !replaced {
+			(*layer).Content = append((*layer).Content, key, value)
+		}
+	}
+	return beneath, above, nil
+}
+
+// isTargetKey tells whether key k sets what a ping client pings, these keys
+// belong to a single ping client
+func isTargetKey(k string) bool {
+	switch strings.ToLower(strings.TrimSpace(k)) {
+	case "ips", "urls", "hosts_file", "targets":
+		return true
+	}
+	return false
+}
+
+// sameKey tells whether config keys a and b are the same, keys are matched
+// whatever their case and surrounding spaces
+func sameKey(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
@@ -67,16 +67,29 @@
 //
 // For a full ping example, see "cmd/ping.go".
 //
+// PingClient sends and receives packets through its Transport. Setting it to a
+// SimNetwork runs PingClient against an in-memory network with scripted
+// latency, loss, duplication and reordering, which needs no ICMP sockets:
+//
+//	sim := ping.NewSimNetwork(1)
+//	sim.SetLink("10.0.0.1", &ping.SimLink{Latency: 20 * time.Millisecond, Loss: 0.2})
+//	pingClient := ping.New()
+//	pingClient.Transport = sim
+//	pingClient.Add("10.0.0.1")
+//
 package pingclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"math/rand"
 	"net"
-	"runtime"
+	"os"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -91,6 +104,10 @@ const (
 	trackerLength    = 8
 	protocolICMP     = 1
 	protocolIPv6ICMP = 58
+
+	// sendRetries is how many times a write failing with ENOBUFS is tried
+	// again, after a backoff doubling from a millisecond
+	sendRetries = 8
 )
 
 var (
@@ -102,26 +119,34 @@ var (
 func New() *PingClient {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	return &PingClient{
-		Count:       0,
-		Num:         5,
-		Interval:    time.Second,
-		RecordRtts:  true,
-		Continuous:  false,
-		Size:        timeSliceLength + trackerLength,
-		Timeout:     5 * time.Second,
-		Tracker:     r.Int63n(math.MaxInt64),
-		PacketsSent: make(map[string]int),
-		PacketsRecv: make(map[string]int),
-		PacketsInfo: make(map[string][]*Packet),
-		rtts:        make(map[string][]time.Duration),
-		IPs:         make([]*net.IPAddr, 0),
-		URLs:        make([]string, 0),
-		IPToURL:     make(map[string]string),
-		done:        make(chan bool),
-		id:          rand.Intn(0xffff),
-		sequence:    rand.Intn(0xffff),
-		network:     "ip",
-		protocol:    "udp",
+		Count:        0,
+		Num:          5,
+		Interval:     time.Second,
+		RecordRtts:   true,
+		Continuous:   false,
+		Size:         timeSliceLength + trackerLength,
+		Timeout:      5 * time.Second,
+		Linger:       time.Second,
+		ReplyTimeout: 2 * time.Second,
+		Tracker:      r.Int63n(math.MaxInt64),
+		PacketsSent:  make(map[string]int),
+		sent:         make(map[string]int),
+		targets:      make(map[string]*target),
+		PacketsRecv:  make(map[string]int),
+		PacketsInfo:  make(map[string][]*Packet),
+		rtts:         make(map[string][]time.Duration),
+		rttStats:     make(map[string]*rttStats),
+		retired:      make(map[string][]string),
+		dnsStats:     make(map[string]*dnsStats),
+		deltaStats:   make(map[string]*rttStats),
+		IPs:          make([]*net.IPAddr, 0),
+		URLs:         make([]string, 0),
+		IPToURL:      make(map[string][]string),
+		literal:      make(map[string]bool),
+		network:      "ip",
+		protocol:     "udp",
+		Transport:    DefaultTransport,
+		done:         make(chan bool),
 	}
 }
 
@@ -152,15 +177,31 @@ func InitWithConfig(conf *Config) []*PingClient {
 func NewPingClientWithConfig(conf *PingClientConfig) *PingClient {
 	pingClient := New()
 
+	pingClient.Name = conf.Name
 	pingClient.Interval = conf.Interval
 	pingClient.Timeout = conf.Timeout
-	pingClient.IPs = conf.IPs
-	pingClient.URLs = conf.URLs
+	pingClient.IPs, pingClient.URLs, pingClient.IPToURL, pingClient.literal, pingClient.TargetOptions = conf.copyTargets()
 	pingClient.Num = conf.Num
-	pingClient.IPToURL = conf.IPToURL
+	pingClient.Size = conf.Size
+	pingClient.ReplyTimeout = conf.ReplyTimeout
 	pingClient.Continuous = conf.Continuous
+	pingClient.ResolveAll = conf.ResolveAll
+	pingClient.ResolveInterval = conf.ResolveInterval
+	pingClient.Resolver = conf.Resolver
+	pingClient.StatsInterval = conf.StatsInterval
+	pingClient.sinkConfigs = conf.Sinks
+	for _, c := range conf.Sinks {
+		// the config file was validated, NewSink doesn't fail
+		if s, err := NewSink(c); err == nil {
+			pingClient.AddSink(s)
+		}
+	}
+	for url, d := range conf.dnsStats {
+		pingClient.dnsStats[url] = d
+	}
 
 	pingClient.SetPrivileged(conf.Privileged)
+	pingClient.SetNetwork(conf.Network)
 
 	return pingClient
 }
@@ -175,6 +216,10 @@ func Use(args ...interface{}) {
 
 // PingClient represents a packet sender/receiver.
 type PingClient struct {
+	// Name identifies the PingClient in Statistics, e.g. its key in the
+	// config file.
+	Name string
+
 	// Interval is the wait time between each packet send. Default is 1s.
 	Interval time.Duration
 
@@ -182,6 +227,21 @@ type PingClient struct {
 	// packets have been received.
 	Timeout time.Duration
 
+	// ReplyTimeout is how long to wait for the reply to an echo request
+	// before it is reported to OnTimeout. Default is 2s. If zero, requests
+	// are reported when PingClient finishes, those older than a minute by
+	// then are dropped.
+	ReplyTimeout time.Duration
+
+	// TargetOptions override Size and ReplyTimeout for some IP addresses or
+	// URLs, keyed by IP address (without zone) or URL.
+	TargetOptions map[string]*TargetOptions
+
+	// Linger is how long RunContext keeps receiving replies to packets
+	// already sent after its context is done, it stops earlier once every
+	// packet is answered. Default is 1s.
+	Linger time.Duration
+
 	// Count tells PingClient to stop after sending (and receiving) Count echo
 	// packets. If this option is not specified, PingClient will operate until
 	// interrupted.
@@ -194,17 +254,51 @@ type PingClient struct {
 	Debug bool
 
 	// Number of packets sent
+	// While running, read it through Statistics rather than directly.
 	PacketsSent map[string]int
 
+	// Number of packets sent during the current Run, checked against Num,
+	// including those failing to be written
+	sent map[string]int
+
+	// Per IP state of the echo requests sent during the current Run
+	targets map[string]*target
+
 	// Number of packets received
+	// While running, read it through Statistics rather than directly.
 	PacketsRecv map[string]int
 
 	// Received packets info for Statistics use
+	// While running, read it through Statistics rather than directly.
 	PacketsInfo map[string][]*Packet
 
 	// Round trip time duration of all the packets
 	rtts map[string][]time.Duration
 
+	// Bounded memory aggregates of the round trip times, kept even when
+	// RecordRtts is false or Continuous is true
+	rttStats map[string]*rttStats
+
+	// URLs each IP was resolved from before ResolveInterval removed it, its
+	// statistics still count towards them
+	retired map[string][]string
+
+	// Aggregates since the last OnStats snapshot
+	deltaStats map[string]*rttStats
+
+	// Windows are the lengths of the rolling windows (e.g. 1m, 5m, 15m)
+	// reported in Statistics next to the stats since the start of Run.
+	Windows []time.Duration
+
+	// HistogramBuckets are the sorted upper bounds of the RTT histogram in
+	// Statistics. Default is DefaultHistogramBuckets. It must not change
+	// while PingClient runs.
+	HistogramBuckets []time.Duration
+
+	// If true, counters and recorded packets carry over from one Run to the
+	// next. By default every Run starts from zero.
+	Accumulate bool
+
 	// If true, keep a record of rtts of all received packets.
 	// Set to false to avoid memory bloat for long running pings.
 	RecordRtts bool
@@ -212,9 +306,54 @@ type PingClient struct {
 	// OnRecv is called when PingClient receives and processes a packet
 	OnRecv func(*Packet)
 
+	// OnTimeout is called when no reply to an echo request arrived within
+	// ReplyTimeout, or before OnFinish for the requests still unanswered.
+	// The Packet carries the IP and sequence number of the request.
+	OnTimeout func(*Packet)
+
+	// OnError is called when an ICMP error message (Destination Unreachable,
+	// Time Exceeded or Parameter Problem) arrives in reply to an echo request.
+	// It needs SetPrivileged(true) on Linux: unprivileged (udp) ICMP sockets
+	// don't receive error messages, the requests time out instead.
+	OnError func(*ICMPError)
+
 	// OnFinish is called when PingClient exits
 	OnFinish func([]*Statistics)
 
+	// OnStats is called every StatsInterval while PingClient runs with the
+	// per IP Statistics since the start of Run (cumulative) and since the
+	// previous call (delta). Replies count in the delta they are received
+	// in, so PacketsRecv of a delta may exceed its PacketsSent; its
+	// PacketLoss is 0 then.
+	OnStats func(cumulative []*Statistics, delta []*Statistics)
+
+	// StatsInterval is the interval between OnStats calls, and the
+	// statistics pushed to the sinks. They are not called if it is zero.
+	StatsInterval time.Duration
+
+	// sinks are fed with the packets and statistics, see AddSink
+	sinks []Sink
+
+	// sinkConfigs are the sinks set in the config file
+	sinkConfigs []*SinkConfig
+
+	// OnSinkError is called with the errors of the sinks, which are
+	// dropped otherwise.
+	OnSinkError func(error)
+
+	// OnRunError is called with the errors sending or processing packets,
+	// which don't stop Run. They are written to standard error if it is nil.
+	OnRunError func(error)
+
+	// ResolveInterval is how often URLs are resolved again while PingClient
+	// runs, so that long running (e.g. Continuous) pings follow DNS changes.
+	// URLs are not resolved again if it is zero.
+	ResolveInterval time.Duration
+
+	// OnTargetChange is called when resolving a URL again added or removed
+	// IP addresses.
+	OnTargetChange func(*TargetChange)
+
 	// Size of packet being sent
 	Size int
 
@@ -224,16 +363,51 @@ type PingClient struct {
 	// Source is the source IP address
 	Source string
 
-	// stop chan bool
+	// Transport opens the connections packets are sent and received through.
+	// Default is DefaultTransport; use a SimNetwork to run without sockets.
+	Transport Transport
+
+	// stop chan bool, closed by Stop while a Run is in progress and
+	// recreated once that Run has returned
 	done chan bool
 
+	// whether a Run has returned, a PingClient is not run again by Watcher
+	ran bool
+
+	// reconfigure tells the current Run that update changed the settings
+	reconfigure chan struct{}
+
+	// whether Run is in progress
+	running bool
+
+	// mu guards done, ran, running, the destinations and the per IP counters and
+	// records, so Statistics can be called while running
+	mu sync.RWMutex
+
 	// list of destination ping IPs
 	IPs []*net.IPAddr
 
 	// list of destination ping URLs
 	URLs []string
 
-	IPToURL map[string]string
+	// URLs each IP was resolved from; several URLs may share one IP
+	IPToURL map[string][]string
+
+	// IPs added as such rather than resolved from a URL, they keep being
+	// pinged whatever the URLs resolve to, guarded by mu
+	literal map[string]bool
+
+	// If true, URLs are resolved to all their A and AAAA records (filtered
+	// by network) and every address is pinged. By default only one address
+	// per URL is.
+	ResolveAll bool
+
+	// Resolver is the DNS resolver URLs are looked up with.
+	// Default (nil) is the system resolver.
+	Resolver *DNSResolver
+
+	// DNS lookups of every URL, guarded by mu
+	dnsStats map[string]*dnsStats
 
 	// whether run Continuously(forever)
 	Continuous bool
@@ -243,8 +417,11 @@ type PingClient struct {
 	// has Ipv6 in IPs
 	hasIPv6 bool
 
-	id       int
-	sequence int
+	// whether the current Run has an IPv4 and an IPv6 connection, guarded
+	// by mu
+	hasConn  bool
+	hasConn6 bool
+
 	// network is one of "ip", "ip4", or "ip6".
 	network string
 	// protocol is "icmp" or "udp".
@@ -266,7 +443,8 @@ type Packet struct {
 	// IPAddr is the address of the host being pinged.
 	IPAddr *net.IPAddr
 
-	// IP address in string format e.g "142.250.71.78"
+	// IP address in string format e.g "142.250.71.78", with the zone of a
+	// link-local IPv6 address e.g "fe80::1%eth0"
 	IP string
 
 	// NBytes is the number of bytes in the message.
@@ -276,7 +454,24 @@ type Packet struct {
 	Seq int
 
 	// TTL is the Time To Live on the packet.
+	// For IPv6 it is the hop limit, same as HopLimit.
 	Ttl int
+
+	// HopLimit is the hop limit of an IPv6 reply, 0 for IPv4.
+	HopLimit int
+
+	// Duplicate is true if a reply with the same sequence number was already
+	// received ("DUP!"). Duplicates don't count towards PacketsRecv.
+	Duplicate bool
+
+	// Reordered is true if a reply to a later echo request arrived first.
+	Reordered bool
+
+	// Late is true if the reply is to an echo request too old to tell
+	// whether it was already replied to: out of the last 256 sequence
+	// numbers and sent more than a minute ago, or replied to before. Late
+	// replies don't count towards PacketsRecv.
+	Late bool
 }
 
 // StatisticsList is a wrapper for list of Statistics
@@ -303,16 +498,44 @@ type Statistics struct {
 	// Received packets info for Statistics use
 	PacketsInfo []*Packet
 
+	// Name is the name of the PingClient.
+	Name string
+
 	// URL is the URL address of the host being pinged.
 	URL string
 
-	// IP address in string format e.g "142.250.71.78"
+	// URLs are all the URLs that resolved to IP, URL being the first one.
+	URLs []string
+
+	// IP address in string format e.g "142.250.71.78", with the zone of a
+	// link-local IPv6 address e.g "fe80::1%eth0"
+	// It is empty in the statistics of StatisticsPerURL.
 	IP string
 
+	// IPs are the IP addresses aggregated in the statistics of
+	// StatisticsPerURL.
+	IPs []string
+
+	// DNSLookups is the number of times URL was resolved, DNSFailures the
+	// number of those lookups that failed.
+	DNSLookups  int
+	DNSFailures int
+
+	// DNSLookupTime is the duration of the latest lookup of URL,
+	// AvgDNSLookupTime the average duration of all its lookups.
+	DNSLookupTime    time.Duration
+	AvgDNSLookupTime time.Duration
+
+	// DNSError is the error of the latest lookup of URL, empty if it
+	// succeeded.
+	DNSError string
+
 	// Rtts is all of the round-trip times sent via this PingClient.
 	Rtts []time.Duration
 
 	// MinRtt is the minimum round-trip time sent via this PingClient.
+	// MinRtt, MaxRtt, AvgRtt and StdDevRtt are kept online, so unlike Rtts
+	// they don't depend on RecordRtts and Continuous.
 	MinRtt time.Duration
 
 	// MaxRtt is the maximum round-trip time sent via this PingClient.
@@ -324,23 +547,76 @@ type Statistics struct {
 	// StdDevRtt is the standard deviation of the round-trip times sent via
 	// this PingClient.
 	StdDevRtt time.Duration
+
+	// P50Rtt, P90Rtt, P95Rtt, P99Rtt and P999Rtt are percentiles of the
+	// round-trip times, accurate to within 1%.
+	P50Rtt  time.Duration
+	P90Rtt  time.Duration
+	P95Rtt  time.Duration
+	P99Rtt  time.Duration
+	P999Rtt time.Duration
+
+	// Jitter is the RFC 3550 interarrival jitter, the smoothed mean
+	// absolute difference between consecutive round-trip times.
+	Jitter time.Duration
+
+	// Histogram counts the round-trip times per bucket of
+	// PingClient.HistogramBuckets, plus a final unbounded bucket.
+	Histogram []HistogramBucket
+
+	// Windows are the stats of the rolling windows in PingClient.Windows.
+	Windows []*WindowStatistics
+
+	// Duplicates is the number of duplicated replies received, which are
+	// not included in PacketsRecv.
+	Duplicates int
+
+	// Reordered is the number of replies that arrived after the reply to a
+	// later echo request.
+	Reordered int
+
+	// Late is the number of replies to echo requests too old to tell
+	// whether they are duplicates, which are not included in PacketsRecv.
+	Late int
+
+	// Unreachable counts the Destination Unreachable messages received in
+	// reply to echo requests, by code. Like TimeExceeded and
+	// ParameterProblem, it stays empty on Linux unless the PingClient is
+	// privileged, see OnError.
+	Unreachable map[UnreachableCode]int
+
+	// TimeExceeded counts the Time Exceeded messages received in reply to
+	// echo requests.
+	TimeExceeded int
+
+	// ParameterProblem counts the Parameter Problem messages received in
+	// reply to echo requests.
+	ParameterProblem int
 }
 
 // SetNetwork allows configuration of DNS resolution.
 // * "ip" will automatically select IPv4 or IPv6.
 // * "ip4" will select IPv4.
 // * "ip6" will select IPv6.
+// * "dual" will select both, pinging an IPv4 and an IPv6 address of each URL.
 func (p *PingClient) SetNetwork(n string) {
 	switch n {
 	case "ip4":
 		p.network = "ip4"
 	case "ip6":
 		p.network = "ip6"
+	case "dual":
+		p.network = "dual"
 	default:
 		p.network = "ip"
 	}
 }
 
+// Network returns the network URLs are resolved for, see SetNetwork
+func (p *PingClient) Network() string {
+	return p.network
+}
+
 // SetRecordRtts sets whether record Statistics
 func (p *PingClient) SetRecordRtts(r bool) {
 	p.RecordRtts = r
@@ -366,163 +642,321 @@ func (p *PingClient) Privileged() bool {
 // Run runs the PingClient. This is a blocking function that will exit when it's
 // done.
 func (p *PingClient) Run() error {
-	var conn, conn6 *icmp.PacketConn
+	return p.RunContext(context.Background())
+}
+
+// RunContext runs the PingClient like Run, but also stops when ctx is done.
+// Once ctx is done no more packets are sent, replies still in flight are
+// received for up to Linger or until none is left, OnFinish is called and
+// ctx.Err() is returned. A connection failing to read, other than timing
+// out, stops it with that error.
+func (p *PingClient) RunContext(ctx context.Context) error {
+	var conn, conn6 PacketConn
 	var err error
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	if p.running {
+		p.mu.Unlock()
+		return fmt.Errorf("error RunContext(): PingClient is already running")
+	}
+	if p.Interval <= 0 {
+		p.mu.Unlock()
+		return fmt.Errorf("error RunContext(): Interval should be more than 0, got %s", p.Interval)
+	}
+	p.running = true
+	p.reconfigure = make(chan struct{}, 1)
+	reconfigure := p.reconfigure
+	done := p.done
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.running = false
+		p.ran = true
+		p.done = make(chan bool)
+		p.mu.Unlock()
+	}()
+
 	p.ipVersionCheck()
 	p.initPacketsConfig()
 
+	// a connection is closed even if the other one fails to open
+	defer func() {
+		p.mu.Lock()
+		p.hasConn, p.hasConn6 = false, false
+		p.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+		if conn6 != nil {
+			conn6.Close()
+		}
+	}()
+
 	if p.hasIPv4 {
 		if conn, err = p.listen(ipv4Proto[p.protocol]); err != nil {
 			return err
 		}
-		if err = conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true); runtime.GOOS != "windows" && err != nil {
-			return err
-		}
-		defer conn.Close()
 	}
 
 	if p.hasIPv6 {
 		if conn6, err = p.listen(ipv6Proto[p.protocol]); err != nil {
 			return err
 		}
-		if err = conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true); runtime.GOOS != "windows" && err != nil {
-			return err
-		}
-		defer conn6.Close()
 	}
+	p.mu.Lock()
+	p.hasConn, p.hasConn6 = conn != nil, conn6 != nil
+	p.mu.Unlock()
 
 	defer p.finish()
 
 	var wg sync.WaitGroup
+	p.mu.RLock()
 	recv := make(chan *packet, 5*len(p.IPs))
+	p.mu.RUnlock()
 	defer close(recv)
+	// a receiver failing to read stops the Run with its error
+	readErr := make(chan error, 2)
 	if conn != nil {
 		wg.Add(1)
-		//nolint:errcheck
-		go p.recvICMP(conn, recv, &wg)
+		go p.recvICMP(conn, recv, readErr, &wg)
 	}
 
 	if conn6 != nil {
 		wg.Add(1)
-		//nolint:errcheck
-		go p.recvICMP(conn6, recv, &wg)
+		go p.recvICMP(conn6, recv, readErr, &wg)
 	}
+	// receivers must be gone before recv is closed
+	defer func() {
+		p.Stop()
+		wg.Wait()
+	}()
 
 	err = p.sendICMP(conn, conn6)
 	if err != nil {
 		return err
 	}
 
-	timeout := time.NewTicker(p.Timeout)
-	if p.Continuous {
-		timeout.Stop()
-	} else {
-		defer timeout.Stop()
-	}
-	interval := time.NewTicker(p.Interval)
+	// tickers are set up (and set up again when reconfigured) by setTickers
+	timeout := time.NewTicker(time.Hour)
+	defer timeout.Stop()
+	interval := time.NewTicker(time.Hour)
 	defer interval.Stop()
+	replyTimeout := time.NewTicker(time.Hour)
+	defer replyTimeout.Stop()
+	resolveTicker := time.NewTicker(time.Hour)
+	defer resolveTicker.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+	setTickers := func() {
+		p.mu.RLock()
+		intervalD, timeoutD, resolveD := p.Interval, p.Timeout, p.ResolveInterval
+		if p.Continuous {
+			timeoutD = 0
+		}
+		p.mu.RUnlock()
+		setTicker(interval, intervalD)
+		setTicker(timeout, timeoutD)
+		setTicker(replyTimeout, replyTimeoutCheck(p.minReplyTimeout()))
+		setTicker(resolveTicker, resolveD)
+	}
+	setTickers()
+
+	var statsC <-chan time.Time
+	if (p.OnStats != nil || len(p.sinks) > 0) && p.StatsInterval > 0 {
+		statsTicker := time.NewTicker(p.StatsInterval)
+		defer statsTicker.Stop()
+		statsC = statsTicker.C
+	}
+
+	resolved := make(chan map[string][]*net.IPAddr, 1)
+	resolving := false
+
+	// ctxErr is set once ctx is done, from then on PingClient only lingers
+	// for in-flight replies
+	var ctxErr error
+	var linger <-chan time.Time
+	ctxDone := ctx.Done()
 
 	for {
 		select {
-		case <-p.done:
-			wg.Wait()
-			return nil
+		case <-done:
+			return ctxErr
+		case err := <-readErr:
+			return fmt.Errorf("error RunContext(): %s", err)
+		case <-ctxDone:
+			ctxDone = nil
+			ctxErr = ctx.Err()
+			interval.Stop()
+			timeout.Stop()
+			if !p.hasPending() {
+				return ctxErr
+			}
+			lingerTimer := time.NewTimer(p.Linger)
+			defer lingerTimer.Stop()
+			linger = lingerTimer.C
+		case <-linger:
+			return ctxErr
 		case <-interval.C:
-			if !p.Continuous && p.Num > 0 && All(p.PacketsSent, packetsSentFinished, p.Num) {
-				close(p.done)
-				wg.Wait()
+			if ctxErr != nil {
+				continue
+			}
+			if p.finished() {
 				return nil
 			}
-			err = p.sendICMP(conn, conn6)
-			if err != nil {
-				// FIXME: this logs as FATAL but continues
-				fmt.Println("FATAL: ", err.Error())
+			if err := p.sendICMP(conn, conn6); err != nil {
+				p.runError(err)
+			}
+		case now := <-replyTimeout.C:
+			p.expirePending(now, false)
+			if ctxErr != nil && !p.hasPending() {
+				return ctxErr
+			}
+		case now := <-prune.C:
+			p.prune(now)
+		case <-statsC:
+			cumulative, delta := p.snapshot()
+			if handler := p.OnStats; handler != nil {
+				handler(cumulative, delta)
+			}
+			p.sinkStats(cumulative, false)
+		case <-resolveTicker.C:
+			// DNS lookups may be slow, they must not hold up receiving
+			if resolving || ctxErr != nil {
+				continue
+			}
+			resolving = true
+			go func() { resolved <- p.resolveURLs() }()
+		case urls := <-resolved:
+			resolving = false
+			for _, change := range p.updateTargets(urls, conn != nil, conn6 != nil) {
+				if handler := p.OnTargetChange; handler != nil {
+					handler(change)
+				}
+			}
+		case <-reconfigure:
+			// the settings or IPs were updated (see Watcher), IPs of a
+			// version without connection are not, see update
+			if ctxErr == nil {
+				setTickers()
 			}
 		case <-timeout.C:
-			if All(p.PacketsSent, packetsSentFinished, p.Num) {
-				close(p.done)
-				wg.Wait()
+			if ctxErr == nil && p.allSent() {
 				return nil
 			}
 		case r := <-recv:
-			err := p.processPacket(r)
-			if err != nil {
-				// FIXME: this logs as FATAL but continues
-				fmt.Println("FATAL: ", err.Error())
+			if err := p.processPacket(r); err != nil {
+				p.runError(err)
+			}
+			if ctxErr != nil && !p.hasPending() {
+				return ctxErr
 			}
 		}
 	}
 }
 
-// Stop the ping client
+// runError reports an error that doesn't stop Run, see OnRunError
+func (p *PingClient) runError(err error) {
+	if handler := p.OnRunError; handler != nil {
+		handler(err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, err)
+}
+
+// Stop stops a running PingClient, it does nothing if no Run has started,
+// so that a stopped PingClient can be run again. It is safe to call Stop
+// more than once and concurrently.
 func (p *PingClient) Stop() {
-	close(p.done)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running {
+		return
+	}
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
 }
 
 func (p *PingClient) finish() {
+	// the requests still unanswered are lost
+	p.expirePending(time.Now(), true)
 
 	handler := p.OnFinish
+	if handler == nil && len(p.sinks) == 0 {
+		return
+	}
+	s := p.Statistics()
 	if handler != nil {
-		s := p.Statistics()
 		handler(s)
 	}
+	p.sinkStats(s, true)
 }
 
+// recvICMP reads the packets of conn into recv until the Run is stopped, or
+// sends its error to readErr if reading fails
 func (p *PingClient) recvICMP(
-	conn *icmp.PacketConn,
+	conn PacketConn,
 	recv chan<- *packet,
+	readErr chan<- error,
 	wg *sync.WaitGroup,
-) error {
+) {
 	defer wg.Done()
+	bufferSize := p.readBufferSize()
 	for {
 		select {
 		case <-p.done:
-			return nil
+			return
 		default:
-			bytes := make([]byte, 512)
+			bytes := make([]byte, bufferSize)
 			if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500)); err != nil {
-				return err
+				readErr <- err
+				return
 			}
-			var n, ttl int
-			var src net.Addr
-			var err error
-			if conn.IPv4PacketConn() != nil {
-				var cm *ipv4.ControlMessage
-				n, cm, src, err = conn.IPv4PacketConn().ReadFrom(bytes)
-				if cm != nil {
-					ttl = cm.TTL
-				}
-			} else if conn.IPv6PacketConn() != nil {
-				var cm *ipv6.ControlMessage
-				n, cm, src, err = conn.IPv6PacketConn().ReadFrom(bytes)
-				if cm != nil {
-					ttl = cm.HopLimit
-				}
-			} else {
-				return nil
-			}
-
+			n, ttl, src, err := conn.ReadFrom(bytes)
 			if err != nil {
-				if neterr, ok := err.(*net.OpError); ok {
-					if neterr.Timeout() {
-						// Read timeout
-						continue
-					} else {
-						close(p.done)
-						return err
-					}
+				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+					// Read timeout
+					continue
 				}
+				readErr <- err
+				return
+			}
+			if src == nil {
+				continue
 			}
 
 			select {
 			case <-p.done:
-				return nil
+				return
 			case recv <- &packet{bytes: bytes, nbytes: n, src: src, ttl: ttl}:
 			}
 		}
 	}
 }
 
+// readBufferSize returns a buffer size large enough for replies to the
+// largest echo request
+func (p *PingClient) readBufferSize() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	size := p.Size
+	for _, o := range p.TargetOptions {
+		if o.Size > size {
+			size = o.Size
+		}
+	}
+	// ICMP header, and IPv4 header with options on raw sockets
+	if size += icmpHeaderLength + 60; size < 512 {
+		return 512
+	}
+	return size
+}
+
 func (p *PingClient) processPacket(recv *packet) error {
 	receivedAt := time.Now()
 	var ipStr string
@@ -532,20 +966,28 @@ func (p *PingClient) processPacket(recv *packet) error {
 		return err
 	}
 
+	var ip net.IP
+	if ipAddr := parseIPAddr(ipStr); ipAddr != nil {
+		ip = ipAddr.IP
+	}
 	var proto int
-	if isIPv4(parseIP(ipStr)) {
+	if isIPv4(ip) {
 		proto = protocolICMP
-	} else if isIPv6(parseIP(ipStr)) {
+	} else if isIPv6(ip) {
 		proto = protocolIPv6ICMP
 	} else {
 		return fmt.Errorf("error processPacket() checking icmp packet IP address: %s", ipStr)
 	}
 
 	var m *icmp.Message
-	if m, err = icmp.ParseMessage(proto, recv.bytes); err != nil {
+	if m, err = icmp.ParseMessage(proto, recv.bytes[:recv.nbytes]); err != nil {
 		return fmt.Errorf("error parsing icmp message: %s", err.Error())
 	}
 
+	if icmpErrorType(m.Type) != 0 {
+		return p.processError(m, ipStr)
+	}
+
 	if m.Type != ipv4.ICMPTypeEchoReply && m.Type != ipv6.ICMPTypeEchoReply {
 		// Not an echo reply, ignore it
 		return nil
@@ -553,21 +995,15 @@ func (p *PingClient) processPacket(recv *packet) error {
 
 	outPkt := &Packet{
 		Nbytes: recv.nbytes,
-		IPAddr: p.findIPAddrbyString(ipStr),
 		IP:     ipStr,
 		Ttl:    recv.ttl,
 	}
+	if proto == protocolIPv6ICMP {
+		outPkt.HopLimit = recv.ttl
+	}
 
 	switch pkt := m.Body.(type) {
 	case *icmp.Echo:
-		// If we are priviledged, we can match icmp.ID
-		if p.protocol == "icmp" {
-			// Check if reply from same ID
-			if pkt.ID != p.id {
-				return nil
-			}
-		}
-
 		if len(pkt.Data) < timeSliceLength+trackerLength {
 			return fmt.Errorf("insufficient data received; got: %d %v",
 				len(pkt.Data), pkt.Data)
@@ -581,31 +1017,89 @@ func (p *PingClient) processPacket(recv *packet) error {
 		}
 		outPkt.Rtt = receivedAt.Sub(timestamp)
 		outPkt.Seq = pkt.Seq
-		p.PacketsRecv[ipStr]++
 	default:
 		// Very bad, not sure how this can happen
 		return fmt.Errorf("invalid ICMP echo reply; type: '%T', '%v'", pkt, pkt)
 	}
 
-	if p.RecordRtts && !p.Continuous {
-		p.PacketsInfo[ipStr] = append(p.PacketsInfo[ipStr], outPkt)
-		p.rtts[ipStr] = append(p.rtts[ipStr], outPkt.Rtt)
+	p.mu.Lock()
+	if t, ok := p.targets[ipStr]; ok {
+		// If we are priviledged, we can match icmp.ID
+		if p.protocol == "icmp" && m.Body.(*icmp.Echo).ID != t.id {
+			p.mu.Unlock()
+			return nil
+		}
+		var sentAt time.Time
+		sentAt, outPkt.Duplicate, outPkt.Reordered, outPkt.Late = t.reply(outPkt.Seq)
+		if !sentAt.IsZero() {
+			// our own send record is more precise than the timestamp echoed
+			// back, which the peer may have mangled
+			outPkt.Rtt = receivedAt.Sub(sentAt)
+		}
+	}
+	outPkt.IPAddr = p.findIPAddrbyString(ipStr)
+	for _, r := range []*rttStats{p.rttStats[ipStr], p.deltaStats[ipStr]} {
+		if r == nil {
+			continue
+		}
+		if outPkt.Duplicate {
+			r.duplicates++
+			continue
+		}
+		if outPkt.Late {
+			r.late++
+			continue
+		}
+		if outPkt.Reordered {
+			r.reordered++
+		}
+		r.add(outPkt.Rtt, receivedAt)
 	}
+	// duplicates don't count as received, or they would hide lost packets,
+	// nor do late replies, which may be duplicates too
+	if !outPkt.Duplicate && !outPkt.Late {
+		p.PacketsRecv[ipStr]++
+		if p.RecordRtts && !p.Continuous {
+			p.PacketsInfo[ipStr] = append(p.PacketsInfo[ipStr], outPkt)
+			p.rtts[ipStr] = append(p.rtts[ipStr], outPkt.Rtt)
+		}
+	}
+	p.mu.Unlock()
+
 	handler := p.OnRecv
 	if handler != nil {
 		handler(outPkt)
 	}
+	p.sinkReceived(outPkt)
 
 	return nil
 }
 
-func (p *PingClient) sendICMP(conn, conn6 *icmp.PacketConn) error {
-	wg := new(sync.WaitGroup)
+func (p *PingClient) sendICMP(conn, conn6 PacketConn) error {
+	// every IP has its own ICMP ID and sequence numbers
+	type echoTo struct {
+		addr *net.IPAddr
+		id   int
+		seq  int
+		size int
+	}
+	p.mu.Lock()
+	echoes := make([]echoTo, 0, len(p.IPs))
 	for _, addr := range p.IPs {
-		if !p.Continuous && p.PacketsSent[addr.IP.String()] >= p.Num {
-			continue
+		t, ok := p.targets[addr.String()]
+		if ok && (p.Continuous || p.sent[addr.String()] < p.Num) {
+			echoes = append(echoes, echoTo{addr: addr, id: t.id, seq: t.nextSeq(), size: p.sizeOf(addr.String())})
 		}
-		var cn *icmp.PacketConn
+	}
+	p.mu.Unlock()
+
+	wg := new(sync.WaitGroup)
+	// write errors are reported once every request is written, from the
+	// goroutine of the Run; writeErrs is guarded by p.mu
+	var writeErrs []error
+	for _, echo := range echoes {
+		addr := echo.addr
+		var cn PacketConn
 		var typ icmp.Type
 		if isIPv4(addr.IP) {
 			cn = conn
@@ -616,6 +1110,10 @@ func (p *PingClient) sendICMP(conn, conn6 *icmp.PacketConn) error {
 		} else {
 			continue
 		}
+		if cn == nil {
+			// no connection of the IP version of addr in this Run
+			continue
+		}
 
 		var dst net.Addr = addr
 		if p.protocol == "udp" {
@@ -623,13 +1121,13 @@ func (p *PingClient) sendICMP(conn, conn6 *icmp.PacketConn) error {
 		}
 
 		t := append(timeToBytes(time.Now()), intToBytes(p.Tracker)...)
-		if remainSize := p.Size - timeSliceLength - trackerLength; remainSize > 0 {
+		if remainSize := echo.size - timeSliceLength - trackerLength; remainSize > 0 {
 			t = append(t, bytes.Repeat([]byte{1}, remainSize)...)
 		}
 
 		body := &icmp.Echo{
-			ID:   p.id,
-			Seq:  p.sequence,
+			ID:   echo.id,
+			Seq:  echo.seq,
 			Data: t,
 		}
 
@@ -639,7 +1137,14 @@ func (p *PingClient) sendICMP(conn, conn6 *icmp.PacketConn) error {
 			Body: body,
 		}
 
-		msgBytes, err := msg.Marshal(nil)
+		// The kernel fills in the checksum of ICMPv6 messages, which cover a
+		// pseudo header with both addresses. When Source is known it is
+		// computed here too, for sockets that leave it to the sender.
+		var psh []byte
+		if src := parseIP(p.Source); src != nil && !isIPv4(src) && typ == ipv6.ICMPTypeEchoRequest {
+			psh = icmp.IPv6PseudoHeader(src, addr.IP)
+		}
+		msgBytes, err := msg.Marshal(psh)
 		if err != nil {
 			return err
 		}
@@ -650,45 +1155,116 @@ func (p *PingClient) sendICMP(conn, conn6 *icmp.PacketConn) error {
 		}
 
 		wg.Add(1)
-		go func(conn *icmp.PacketConn, dst net.Addr, ipStr string, b []byte) {
-			for {
-				if _, err := conn.WriteTo(b, dst); err != nil {
-					if neterr, ok := err.(*net.OpError); ok {
-						if neterr.Err == syscall.ENOBUFS {
-							continue
-						}
-					}
-				}
-				break
+		go func(conn PacketConn, dst net.Addr, ipStr string, seq int, b []byte) {
+			defer wg.Done()
+			sentAt, err := writeWithRetry(conn, b, dst)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			// the IP may have been removed meanwhile by ResolveInterval
+			t, ok := p.targets[ipStr]
+			if ok {
+				p.sent[ipStr]++
+			}
+			if err != nil {
+				// not sent, it is neither lost nor waited for
+				writeErrs = append(writeErrs, err)
+				return
+			}
+			if ok {
+				t.send(seq, sentAt)
 			}
 			p.PacketsSent[ipStr]++
-			wg.Done()
-		}(cn, dst, ipStr, msgBytes)
+			if r, ok := p.rttStats[ipStr]; ok {
+				r.sent(sentAt)
+			}
+			if r, ok := p.deltaStats[ipStr]; ok {
+				r.sent(sentAt)
+			}
+		}(cn, dst, ipStr, echo.seq, msgBytes)
 	}
 	wg.Wait()
-	p.sequence++
 
+	for _, err := range writeErrs {
+		p.runError(err)
+	}
 	return nil
 }
 
-func (p *PingClient) listen(netProto string) (*icmp.PacketConn, error) {
-	conn, err := icmp.ListenPacket(netProto, p.Source)
+// writeWithRetry writes b to dst, trying again with a backoff while the
+// buffers of the interface are full, and returns when it was written
+func writeWithRetry(conn PacketConn, b []byte, dst net.Addr) (time.Time, error) {
+	backoff := time.Millisecond
+	for i := 0; ; i++ {
+		sentAt := time.Now()
+		_, err := conn.WriteTo(b, dst)
+		if err == nil {
+			return sentAt, nil
+		}
+		if neterr, ok := err.(*net.OpError); !ok || neterr.Err != syscall.ENOBUFS || i == sendRetries {
+			return sentAt, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (p *PingClient) listen(netProto string) (PacketConn, error) {
+	transport := p.Transport
+	if transport == nil {
+		transport = DefaultTransport
+	}
+	conn, err := transport.Listen(netProto, p.Source)
 	if err != nil {
-		close(p.done)
 		return nil, err
 	}
 	return conn, nil
 }
 
 func (p *PingClient) initPacketsConfig() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = make(map[string]int)
+	p.deltaStats = make(map[string]*rttStats)
+	p.targets = make(map[string]*target)
+	if !p.Accumulate {
+		p.PacketsSent = make(map[string]int)
+		p.PacketsRecv = make(map[string]int)
+		p.PacketsInfo = make(map[string][]*Packet)
+		p.rtts = make(map[string][]time.Duration)
+		p.rttStats = make(map[string]*rttStats)
+		p.retired = make(map[string][]string)
+	}
 	for _, addr := range p.IPs {
-		p.PacketsSent[addr.IP.String()] = 0
-		p.PacketsRecv[addr.IP.String()] = 0
-		p.PacketsInfo[addr.IP.String()] = make([]*Packet, 0)
-		p.rtts[addr.IP.String()] = make([]time.Duration, 0)
+		ipStr := addr.String()
+		p.sent[ipStr] = 0
+		p.deltaStats[ipStr] = newRTTStats(p.histogramBuckets(), nil)
+		p.targets[ipStr] = newTarget()
+		if _, ok := p.PacketsSent[ipStr]; ok {
+			continue
+		}
+		p.PacketsSent[ipStr] = 0
+		p.PacketsRecv[ipStr] = 0
+		p.PacketsInfo[ipStr] = make([]*Packet, 0)
+		p.rtts[ipStr] = make([]time.Duration, 0)
+		p.rttStats[ipStr] = newRTTStats(p.histogramBuckets(), p.Windows)
 	}
 }
 
+// finished checks whether a Run that is not Continuous has sent Num packets
+// to every IP
+func (p *PingClient) finished() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !p.Continuous && p.Num > 0 && All(p.sent, packetsSentFinished, p.Num)
+}
+
+// allSent checks whether Num packets have been sent to every IP during this Run
+func (p *PingClient) allSent() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return All(p.sent, packetsSentFinished, p.Num)
+}
+
 // All checks whether all the map entry satisfies the function f
 func All(m map[string]int, f func(int, int) bool, num int) bool {
 	for _, val := range m {
@@ -703,6 +1279,27 @@ func packetsSentFinished(sent int, num int) bool {
 	return sent >= num
 }
 
+// replyTimeoutCheck returns how often to look for expired echo requests, 0
+// if no reply timeout is set
+func replyTimeoutCheck(replyTimeout time.Duration) time.Duration {
+	if replyTimeout <= 0 {
+		return 0
+	}
+	if check := replyTimeout / 4; check > time.Millisecond {
+		return check
+	}
+	return time.Millisecond
+}
+
+// setTicker restarts t with period d, or stops it if d is not positive
+func setTicker(t *time.Ticker, d time.Duration) {
+	if d > 0 {
+		t.Reset(d)
+	} else {
+		t.Stop()
+	}
+}
+
 /* * * * * * * * * * * * * * * * * * * * * * *
    _____ _        _   _     _   _
   / ____| |      | | (_)   | | (_)
@@ -717,9 +1314,11 @@ func packetsSentFinished(sent int, num int) bool {
 // This can be run while the PingClient is running or after it is finished.
 // OnFinish calls this function to get it's finished statistics.
 func (p *PingClient) Statistics() []*Statistics {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	stats := make([]*Statistics, 0)
 	for _, ipAddr := range p.IPs {
-		s := p.StatisticsPerIP(ipAddr)
+		s := p.statisticsPerIP(ipAddr)
 		stats = append(stats, s)
 	}
 
@@ -727,46 +1326,153 @@ func (p *PingClient) Statistics() []*Statistics {
 }
 
 // StatisticsPerIP returns the statistics of the Ping info to the given IP address.
+// It is safe to call while the PingClient is running.
 func (p *PingClient) StatisticsPerIP(ipAddr *net.IPAddr) *Statistics {
-	var ipStr string = ipAddr.IP.String()
-	loss := float64(p.PacketsSent[ipStr]-p.PacketsRecv[ipStr]) / float64(p.PacketsSent[ipStr]) * 100
-	var min, max, total time.Duration
-	if len(p.rtts[ipStr]) > 0 {
-		min = p.rtts[ipStr][0]
-		max = p.rtts[ipStr][0]
-	}
-	for _, rt := range p.rtts[ipStr] {
-		if rt < min {
-			min = rt
-		}
-		if rt > max {
-			max = rt
-		}
-		total += rt
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.statisticsPerIP(ipAddr)
+}
+
+// statisticsPerIP must be called with p.mu held
+func (p *PingClient) statisticsPerIP(ipAddr *net.IPAddr) *Statistics {
+	var ipStr string = ipAddr.String()
+	var loss float64
+	if p.PacketsSent[ipStr] > 0 {
+		loss = float64(p.PacketsSent[ipStr]-p.PacketsRecv[ipStr]) / float64(p.PacketsSent[ipStr]) * 100
 	}
 	s := Statistics{
 		PacketsSent: p.PacketsSent[ipStr],
 		PacketsRecv: p.PacketsRecv[ipStr],
-		PacketsInfo: p.PacketsInfo[ipStr],
+		PacketsInfo: append([]*Packet(nil), p.PacketsInfo[ipStr]...),
 		PacketLoss:  loss,
-		Rtts:        p.rtts[ipStr],
-		URL:         p.IPToURL[ipStr],
+		Rtts:        append([]time.Duration(nil), p.rtts[ipStr]...),
+		Name:        p.Name,
+		URL:         firstURL(p.IPToURL[ipStr]),
+		URLs:        append([]string(nil), p.IPToURL[ipStr]...),
 		IP:          ipStr,
-		MaxRtt:      max,
-		MinRtt:      min,
 	}
-	if len(p.rtts[ipStr]) > 0 {
-		s.AvgRtt = total / time.Duration(len(p.rtts[ipStr]))
-		var sumsquares time.Duration
-		for _, rt := range p.rtts[ipStr] {
-			sumsquares += (rt - s.AvgRtt) * (rt - s.AvgRtt)
+	r, ok := p.rttStats[ipStr]
+	if !ok {
+		r = newRTTStats(p.histogramBuckets(), p.Windows)
+	}
+	r.fill(&s, time.Now())
+	if d, ok := p.dnsStats[s.URL]; ok {
+		d.fill(&s)
+	}
+	return &s
+}
+
+// StatisticsPerURL returns the statistics of every URL in URLs, aggregated
+// over all the IP addresses it resolved to.
+// It is safe to call while the PingClient is running.
+func (p *PingClient) StatisticsPerURL() []*Statistics {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	stats := make([]*Statistics, 0, len(p.URLs))
+	for _, url := range p.URLs {
+		stats = append(stats, p.statisticsPerURL(url))
+	}
+	return stats
+}
+
+// statisticsPerURL must be called with p.mu held
+func (p *PingClient) statisticsPerURL(url string) *Statistics {
+	s := Statistics{
+		Name: p.Name,
+		URL:  url,
+		URLs: []string{url},
+	}
+	r := newRTTStats(p.histogramBuckets(), p.Windows)
+	for _, ipAddr := range p.IPs {
+		ipStr := ipAddr.String()
+		if !containsString(p.IPToURL[ipStr], url) {
+			continue
+		}
+		s.IPs = append(s.IPs, ipStr)
+		s.PacketsSent += p.PacketsSent[ipStr]
+		s.PacketsRecv += p.PacketsRecv[ipStr]
+		s.PacketsInfo = append(s.PacketsInfo, p.PacketsInfo[ipStr]...)
+		s.Rtts = append(s.Rtts, p.rtts[ipStr]...)
+		if o, ok := p.rttStats[ipStr]; ok {
+			r.merge(o)
 		}
-		s.StdDevRtt = time.Duration(math.Sqrt(
-			float64(sumsquares / time.Duration(len(p.rtts[ipStr])))))
 	}
+	// IPs the URL no longer resolves to keep their history
+	retired := make([]string, 0)
+	for ipStr, urls := range p.retired {
+		if containsString(urls, url) && !containsString(s.IPs, ipStr) {
+			retired = append(retired, ipStr)
+		}
+	}
+	sort.Strings(retired)
+	for _, ipStr := range retired {
+		s.IPs = append(s.IPs, ipStr)
+		s.PacketsSent += p.PacketsSent[ipStr]
+		s.PacketsRecv += p.PacketsRecv[ipStr]
+		s.PacketsInfo = append(s.PacketsInfo, p.PacketsInfo[ipStr]...)
+		s.Rtts = append(s.Rtts, p.rtts[ipStr]...)
+		if o, ok := p.rttStats[ipStr]; ok {
+			r.merge(o)
+		}
+	}
+	if s.PacketsSent > 0 {
+		s.PacketLoss = float64(s.PacketsSent-s.PacketsRecv) / float64(s.PacketsSent) * 100
+	}
+	r.fill(&s, time.Now())
+	if d, ok := p.dnsStats[url]; ok {
+		d.fill(&s)
+	}
+	return &s
+}
+
+// deltaStatisticsPerIP returns the statistics since the last OnStats
+// snapshot, it must be called with p.mu held
+func (p *PingClient) deltaStatisticsPerIP(ipAddr *net.IPAddr) *Statistics {
+	ipStr := ipAddr.String()
+	r, ok := p.deltaStats[ipStr]
+	if !ok {
+		r = newRTTStats(p.histogramBuckets(), nil)
+	}
+	s := Statistics{
+		PacketsSent: r.nsent,
+		PacketsRecv: r.rtts.n,
+		Name:        p.Name,
+		URL:         firstURL(p.IPToURL[ipStr]),
+		URLs:        append([]string(nil), p.IPToURL[ipStr]...),
+		IP:          ipStr,
+	}
+	if s.PacketsSent > 0 {
+		// replies to the requests of the previous interval count in this
+		// one, they may outnumber the requests sent
+		loss := float64(s.PacketsSent-s.PacketsRecv) / float64(s.PacketsSent) * 100
+		s.PacketLoss = math.Max(loss, 0)
+	}
+	r.fill(&s, time.Now())
 	return &s
 }
 
+// snapshot returns the cumulative and delta statistics for OnStats and
+// starts a new delta interval
+func (p *PingClient) snapshot() ([]*Statistics, []*Statistics) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cumulative := make([]*Statistics, 0, len(p.IPs))
+	delta := make([]*Statistics, 0, len(p.IPs))
+	for _, ipAddr := range p.IPs {
+		cumulative = append(cumulative, p.statisticsPerIP(ipAddr))
+		delta = append(delta, p.deltaStatisticsPerIP(ipAddr))
+		p.deltaStats[ipAddr.String()] = newRTTStats(p.histogramBuckets(), nil)
+	}
+	return cumulative, delta
+}
+
+func (p *PingClient) histogramBuckets() []time.Duration {
+	if p.HistogramBuckets == nil {
+		return DefaultHistogramBuckets
+	}
+	return p.HistogramBuckets
+}
+
 /* * * * * * * * * * * * * * * * * * * * * * *
   _____ _____    _    _ _   _ _
  |_   _|  __ \  | |  | | | (_) |
@@ -778,40 +1484,97 @@ func (p *PingClient) StatisticsPerIP(ipAddr *net.IPAddr) *Statistics {
 * * * * * * * * * * * * * * * * * * * * * * */
 // Add parses addr(ip format or url format) to net.IP and
 // adds net.IP to pingClient
+// addr may also be a CIDR range like 10.0.0.0/24 or an IP range like
+// 10.0.0.1-10.0.0.50, see ExpandIPs.
 func (p *PingClient) Add(addr string) error {
-	if parseIP(addr) != nil {
+	if parseIPAddr(addr) != nil {
 		return p.AddIPAddr(addr)
 	}
-	return p.AddURLAddr(addr)
+	ipAddrs, ok, err := expandIPs(addr)
+	if !ok {
+		return p.AddURLAddr(addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error Add(): %s", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seen := make(map[string]bool, len(p.IPs)+len(ipAddrs))
+	for _, ipAddr := range p.IPs {
+		seen[ipAddr.String()] = true
+	}
+	p.IPs = appendIPs(p.IPs, ipAddrs, seen)
+	for _, ipAddr := range ipAddrs {
+		p.literal[ipAddr.String()] = true
+	}
+	return nil
+}
+
+// AddHostsFile adds every target of the hosts file name, see ReadHostsFile.
+func (p *PingClient) AddHostsFile(name string) error {
+	hosts, err := ReadHostsFile(name)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if err := p.Add(host); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // AddIPAddr adds IP address to ping client
+// IPv6 link-local addresses take the zone to ping them on, e.g. "fe80::1%eth0".
 func (p *PingClient) AddIPAddr(addr string) error {
-	ip := parseIP(addr)
-	if isIPv4(ip) {
-		p.IPs = append(p.IPs, &net.IPAddr{IP: ip})
-	} else if isIPv6(ip) {
-		p.IPs = append(p.IPs, &net.IPAddr{IP: ip})
-	} else {
+	ipAddr := parseIPAddr(addr)
+	if ipAddr == nil {
 		return fmt.Errorf("error AddIPAddr() addr %s should be a valid IP address", addr)
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ipAddr = p.addIP(ipAddr)
+	p.literal[ipAddr.String()] = true
 	return nil
 }
 
 // AddURLAddr resolves URL addr to IP address and adds IP address to ping client
+// If ResolveAll is true, every A and AAAA record of addr is added.
 func (p *PingClient) AddURLAddr(addr string) error {
-	ipAddr, err := parseURL(p.network, addr)
+	ipAddrs, err := p.lookupURL(addr, p.ResolveAll)
 	if err != nil {
 		return err
 	}
-	p.IPs = append(p.IPs, ipAddr)
-	p.URLs = append(p.URLs, addr)
-	p.IPToURL[ipAddr.IP.String()] = addr
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ipAddr := range ipAddrs {
+		ipAddr = p.addIP(ipAddr)
+		ipStr := ipAddr.String()
+		if !containsString(p.IPToURL[ipStr], addr) {
+			p.IPToURL[ipStr] = append(p.IPToURL[ipStr], addr)
+		}
+	}
+	if !containsString(p.URLs, addr) {
+		p.URLs = append(p.URLs, addr)
+	}
 
 	return nil
 }
 
+// addIP adds ipAddr unless it is already pinged and returns the address in
+// IPs, it must be called with p.mu held
+func (p *PingClient) addIP(ipAddr *net.IPAddr) *net.IPAddr {
+	if existing := p.findIPAddrbyString(ipAddr.String()); existing != nil {
+		return existing
+	}
+	p.IPs = append(p.IPs, ipAddr)
+	return ipAddr
+}
+
 func (p *PingClient) ipVersionCheck() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hasIPv4, p.hasIPv6 = false, false
 	for _, ipAddr := range p.IPs {
 		if isIPv4(ipAddr.IP) {
 			p.hasIPv4 = true
@@ -821,22 +1584,32 @@ func (p *PingClient) ipVersionCheck() {
 	}
 }
 
+// urlsOf returns the URLs resolving to ipStr
+func (p *PingClient) urlsOf(ipStr string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string(nil), p.IPToURL[ipStr]...)
+}
+
+// findIPAddrbyString must be called with p.mu held
 func (p *PingClient) findIPAddrbyString(s string) *net.IPAddr {
 	for _, ipAddr := range p.IPs {
-		if ipAddr.IP.String() == s {
+		if ipAddr.String() == s {
 			return ipAddr
 		}
 	}
 	return nil
 }
 
+// resolveIPFromAddr returns the IP of addr in string format with its zone,
+// e.g. "fe80::1%eth0", so that a link-local IP is a target per interface
 func resolveIPFromAddr(addr net.Addr) (string, error) {
 	var ipStr string
 	switch addr := addr.(type) {
 	case *net.IPAddr:
-		ipStr = addr.IP.String()
+		ipStr = addr.String()
 	case *net.UDPAddr:
-		ipStr = addr.IP.String()
+		ipStr = (&net.IPAddr{IP: addr.IP, Zone: addr.Zone}).String()
 	default:
 		return "", fmt.Errorf("error processPacket() parsing icmp packet IP address: %s", addr)
 	}
@@ -850,6 +1623,23 @@ func parseIP(s string) net.IP {
 	return net.ParseIP(s)
 }
 
+// parseIPAddr parses s to net.IPAddr, with the zone of an IPv6 address such
+// as "fe80::1%eth0", returns nil if s is not a valid ip(v4 or v6) address
+func parseIPAddr(s string) *net.IPAddr {
+	host, zone := s, ""
+	if i := strings.LastIndexByte(s, '%'); i >= 0 {
+		host, zone = s[:i], s[i+1:]
+		if zone == "" {
+			return nil
+		}
+	}
+	ip := parseIP(host)
+	if ip == nil || (zone != "" && isIPv4(ip)) {
+		return nil
+	}
+	return &net.IPAddr{IP: ip, Zone: zone}
+}
+
 // get IP addr of given string address using DNS lookup
 // e.g. getIP("github.com")
 // return	[]IP(4-byte Ipv4 and 16-byte Ipv6, Ipv4 could also be 16-byte)
@@ -861,6 +1651,22 @@ func parseURL(network string, url string) (*net.IPAddr, error) {
 	return IPs, nil
 }
 
+func firstURL(urls []string) string {
+	if len(urls) == 0 {
+		return ""
+	}
+	return urls[0]
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func isIPv4(ip net.IP) bool {
 	return len(ip.To4()) == net.IPv4len
 }
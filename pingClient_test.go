@@ -0,0 +1,987 @@
+package pingclient
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newSimClient returns a PingClient pinging ips over sim, quick enough for
+// tests
+func newSimClient(t *testing.T, sim *SimNetwork, ips ...string) *PingClient {
+	t.Helper()
+	p := New()
+	p.Transport = sim
+	p.Interval = 5 * time.Millisecond
+	p.ReplyTimeout = 50 * time.Millisecond
+	p.Linger = 100 * time.Millisecond
+	for _, ip := range ips {
+		if err := p.Add(ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// runFor runs p continuously for d, replies in flight are received within
+// Linger. A Run that is not Continuous may return before the last replies.
+func runFor(t *testing.T, p *PingClient, d time.Duration) {
+	t.Helper()
+	p.Continuous = true
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	if err := p.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("RunContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// statsOf returns the Statistics of ip
+func statsOf(t *testing.T, p *PingClient, ip string) *Statistics {
+	t.Helper()
+	for _, s := range p.Statistics() {
+		if s.IP == ip {
+			return s
+		}
+	}
+	t.Fatalf("no statistics for %s", ip)
+	return nil
+}
+
+func TestRunReceivesReplies(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond, TTL: 57})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Num = 5
+	// Run returns an interval after the last request, without waiting
+	// for its reply
+	p.Interval = 20 * time.Millisecond
+
+	var mu sync.Mutex
+	var received []*Packet
+	p.OnRecv = func(pkt *Packet) {
+		mu.Lock()
+		received = append(received, pkt)
+		mu.Unlock()
+	}
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := statsOf(t, p, "10.0.0.1")
+	if s.PacketsSent != 5 || s.PacketsRecv != 5 || s.PacketLoss != 0 {
+		t.Errorf("sent %d, received %d, loss %v; want 5, 5, 0", s.PacketsSent, s.PacketsRecv, s.PacketLoss)
+	}
+	if s.MinRtt < time.Millisecond || s.MaxRtt < s.MinRtt {
+		t.Errorf("MinRtt %s, MaxRtt %s; want at least the 1ms latency", s.MinRtt, s.MaxRtt)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != s.PacketsRecv {
+		t.Fatalf("OnRecv called %d times, want %d", len(received), s.PacketsRecv)
+	}
+	for _, pkt := range received {
+		if pkt.IP != "10.0.0.1" || pkt.Ttl != 57 || pkt.Duplicate {
+			t.Errorf("OnRecv(%+v), want a reply of 10.0.0.1 with TTL 57", pkt)
+		}
+	}
+}
+
+func TestRunLoss(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	sim.SetLink("10.0.0.2", &SimLink{Latency: time.Millisecond, Loss: 1})
+	sim.SetLink("10.0.0.3", &SimLink{Latency: time.Millisecond, Loss: 0.5})
+	p := newSimClient(t, sim, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	p.Num = 20
+	p.Interval = 20 * time.Millisecond
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := statsOf(t, p, "10.0.0.1"); s.PacketsSent != 20 || s.PacketsRecv != 20 || s.PacketLoss != 0 {
+		t.Errorf("10.0.0.1: sent %d, received %d, loss %v; want every request answered", s.PacketsSent, s.PacketsRecv, s.PacketLoss)
+	}
+	if s := statsOf(t, p, "10.0.0.2"); s.PacketsSent != 20 || s.PacketsRecv != 0 || s.PacketLoss != 100 {
+		t.Errorf("10.0.0.2: sent %d, received %d, loss %v; want every request lost", s.PacketsSent, s.PacketsRecv, s.PacketLoss)
+	}
+	s := statsOf(t, p, "10.0.0.3")
+	if s.PacketsRecv == 0 || s.PacketsRecv == s.PacketsSent {
+		t.Errorf("10.0.0.3: received %d of %d, want some lost with a loss of 0.5", s.PacketsRecv, s.PacketsSent)
+	}
+	if want := float64(s.PacketsSent-s.PacketsRecv) / float64(s.PacketsSent) * 100; s.PacketLoss != want {
+		t.Errorf("10.0.0.3: loss %v, want %v", s.PacketLoss, want)
+	}
+}
+
+func TestRunICMPError(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond, Error: ICMPUnreachable, ErrorCode: 13, ErrorFrom: "192.0.2.1"})
+	sim.SetLink("10.0.0.2", &SimLink{Latency: time.Millisecond, Error: ICMPTimeExceeded})
+	p := newSimClient(t, sim, "10.0.0.1", "10.0.0.2")
+	p.SetPrivileged(true)
+
+	var mu sync.Mutex
+	var icmpErrs []*ICMPError
+	timeouts := 0
+	p.OnError = func(e *ICMPError) {
+		mu.Lock()
+		icmpErrs = append(icmpErrs, e)
+		mu.Unlock()
+	}
+	p.OnTimeout = func(*Packet) {
+		mu.Lock()
+		timeouts++
+		mu.Unlock()
+	}
+	runFor(t, p, 50*time.Millisecond)
+
+	s := statsOf(t, p, "10.0.0.1")
+	if s.PacketsSent == 0 || s.PacketsRecv != 0 || s.PacketLoss != 100 {
+		t.Errorf("10.0.0.1: sent %d, received %d, loss %v; want every request lost", s.PacketsSent, s.PacketsRecv, s.PacketLoss)
+	}
+	if got := s.Unreachable[UnreachableAdminProhibited]; got != s.PacketsSent || len(s.Unreachable) != 1 {
+		t.Errorf("10.0.0.1: Unreachable = %v, want %d administratively prohibited", s.Unreachable, s.PacketsSent)
+	}
+	s2 := statsOf(t, p, "10.0.0.2")
+	if s2.TimeExceeded != s2.PacketsSent {
+		t.Errorf("10.0.0.2: TimeExceeded = %d, want %d", s2.TimeExceeded, s2.PacketsSent)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(icmpErrs) != s.PacketsSent+s2.PacketsSent {
+		t.Fatalf("OnError called %d times, want %d", len(icmpErrs), s.PacketsSent+s2.PacketsSent)
+	}
+	for _, e := range icmpErrs {
+		switch e.IP {
+		case "10.0.0.1":
+			if e.Type != ICMPUnreachable || e.Code != 13 || e.Unreachable != UnreachableAdminProhibited || e.From != "192.0.2.1" {
+				t.Errorf("OnError(%+v), want Unreachable code 13 from 192.0.2.1", e)
+			}
+		case "10.0.0.2":
+			if e.Type != ICMPTimeExceeded {
+				t.Errorf("OnError(%+v), want TimeExceeded", e)
+			}
+		default:
+			t.Errorf("OnError(%+v) for an unknown IP", e)
+		}
+	}
+	if timeouts != 0 {
+		t.Errorf("OnTimeout called %d times for requests answered with an error", timeouts)
+	}
+}
+
+func TestRunNum(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	sim.SetLink("10.0.0.2", &SimLink{Loss: 1})
+	p := newSimClient(t, sim, "10.0.0.1", "10.0.0.2")
+	p.Num = 4
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if s := statsOf(t, p, ip); s.PacketsSent != 4 || sim.Sent(ip) != 4 {
+			t.Errorf("%s: sent %d, sim.Sent() = %d; want 4", ip, s.PacketsSent, sim.Sent(ip))
+		}
+	}
+}
+
+func TestRunDuplicates(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond, Duplicate: 1})
+	p := newSimClient(t, sim, "10.0.0.1")
+
+	var mu sync.Mutex
+	duplicates := 0
+	p.OnRecv = func(pkt *Packet) {
+		if pkt.Duplicate {
+			mu.Lock()
+			duplicates++
+			mu.Unlock()
+		}
+	}
+	runFor(t, p, 50*time.Millisecond)
+
+	s := statsOf(t, p, "10.0.0.1")
+	// the duplicate of the last reply may come after the linger ended
+	if s.PacketsRecv != s.PacketsSent || s.Duplicates < s.PacketsSent-1 || s.Duplicates > s.PacketsSent || s.PacketLoss != 0 {
+		t.Errorf("sent %d, received %d, duplicates %d, loss %v; want every reply received twice, counted once", s.PacketsSent, s.PacketsRecv, s.Duplicates, s.PacketLoss)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if duplicates != s.Duplicates {
+		t.Errorf("OnRecv called with %d duplicates, Statistics counts %d", duplicates, s.Duplicates)
+	}
+}
+
+func TestRunReordered(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: 2 * time.Millisecond, Reorder: 0.3, ReorderDelay: 20 * time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+
+	var mu sync.Mutex
+	reordered := 0
+	p.OnRecv = func(pkt *Packet) {
+		if pkt.Reordered {
+			mu.Lock()
+			reordered++
+			mu.Unlock()
+		}
+	}
+	runFor(t, p, 150*time.Millisecond)
+
+	s := statsOf(t, p, "10.0.0.1")
+	if s.Reordered == 0 {
+		t.Errorf("no reordered replies with a reorder of 0.3")
+	}
+	if s.Duplicates != 0 || s.PacketsRecv != s.PacketsSent {
+		t.Errorf("sent %d, received %d, duplicates %d; want every late reply received once", s.PacketsSent, s.PacketsRecv, s.Duplicates)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if reordered != s.Reordered {
+		t.Errorf("OnRecv called with %d reordered replies, Statistics counts %d", reordered, s.Reordered)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	sim.SetLink("10.0.0.2", &SimLink{Loss: 1})
+	p := newSimClient(t, sim, "10.0.0.1", "10.0.0.2")
+	p.ReplyTimeout = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	timeouts := make(map[string][]int)
+	p.OnTimeout = func(pkt *Packet) {
+		mu.Lock()
+		timeouts[pkt.IP] = append(timeouts[pkt.IP], pkt.Seq)
+		mu.Unlock()
+	}
+	runFor(t, p, 100*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(timeouts["10.0.0.1"]) != 0 {
+		t.Errorf("OnTimeout called for the replies of 10.0.0.1: %v", timeouts["10.0.0.1"])
+	}
+	seqs := timeouts["10.0.0.2"]
+	// the requests sent within ReplyTimeout of the end expire when p
+	// finishes
+	if sent := statsOf(t, p, "10.0.0.2").PacketsSent; len(seqs) != sent {
+		t.Fatalf("OnTimeout called %d times for 10.0.0.2, want %d", len(seqs), sent)
+	}
+	for i, seq := range seqs {
+		if seq != (seqs[0]+i)%65536 {
+			t.Fatalf("OnTimeout called with sequence numbers %v, want each request once in order", seqs)
+		}
+	}
+}
+
+func TestRunTimeoutAtFinish(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Loss: 1})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.ReplyTimeout = 0
+	p.Linger = 0
+	timeouts := 0
+	p.OnTimeout = func(pkt *Packet) { timeouts++ }
+	p.OnFinish = func(stats []*Statistics) {
+		if timeouts == 0 {
+			t.Errorf("OnFinish called before OnTimeout")
+		}
+	}
+	runFor(t, p, 30*time.Millisecond)
+
+	// without ReplyTimeout every request is left unanswered until the end
+	if sent := statsOf(t, p, "10.0.0.1").PacketsSent; sent == 0 || timeouts != sent {
+		t.Errorf("OnTimeout called %d times, want once for each of the %d requests", timeouts, sent)
+	}
+	if p.hasPending() {
+		t.Errorf("requests still pending after Run")
+	}
+}
+
+func TestRunTargetOptions(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.Default = &SimLink{Latency: 20 * time.Millisecond}
+	rec := &recordingTransport{Transport: sim}
+	p := newSimClient(t, sim, "10.0.0.1", "10.0.0.2")
+	p.Transport = rec
+	p.TargetOptions = map[string]*TargetOptions{"10.0.0.2": {Size: 64, ReplyTimeout: 5 * time.Millisecond}}
+
+	var mu sync.Mutex
+	timeouts := make(map[string]int)
+	p.OnTimeout = func(pkt *Packet) {
+		mu.Lock()
+		timeouts[pkt.IP]++
+		mu.Unlock()
+	}
+	runFor(t, p, 50*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if timeouts["10.0.0.1"] != 0 || timeouts["10.0.0.2"] == 0 {
+		t.Errorf("timeouts %v, want only those of 10.0.0.2 with a reply timeout below the latency", timeouts)
+	}
+	sizes := make(map[int]int)
+	for _, msg := range rec.messages() {
+		sizes[len(msg)]++
+	}
+	if sizes[icmpHeaderLength+64] != sim.Sent("10.0.0.2") || sizes[icmpHeaderLength+p.Size] != sim.Sent("10.0.0.1") {
+		t.Errorf("echo requests by length %v, want %d of %d bytes and %d of %d bytes", sizes,
+			sim.Sent("10.0.0.2"), icmpHeaderLength+64, sim.Sent("10.0.0.1"), icmpHeaderLength+p.Size)
+	}
+}
+
+func TestRunAgain(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Num = 3
+	p.Interval = 20 * time.Millisecond
+
+	// every Run starts from zero
+	for i := 0; i < 2; i++ {
+		if err := p.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := statsOf(t, p, "10.0.0.1")
+	if s.PacketsSent != 3 || s.PacketsRecv != 3 || len(s.Rtts) != 3 {
+		t.Errorf("second Run: sent %d, received %d, %d rtts; want 3", s.PacketsSent, s.PacketsRecv, len(s.Rtts))
+	}
+
+	p.Accumulate = true
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	s = statsOf(t, p, "10.0.0.1")
+	if s.PacketsSent != 6 || s.PacketsRecv != 6 || len(s.Rtts) != 6 || sim.Sent("10.0.0.1") != 9 {
+		t.Errorf("Accumulate: sent %d, received %d, %d rtts; want 6", s.PacketsSent, s.PacketsRecv, len(s.Rtts))
+	}
+}
+
+func TestRunWhileRunning(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Continuous = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.RunContext(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	if err := p.Run(); err == nil {
+		t.Errorf("Run() while running succeeded")
+	}
+	// Statistics may be read while running
+	for i := 0; i < 5; i++ {
+		statsOf(t, p, "10.0.0.1")
+		time.Sleep(2 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("RunContext() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRunErrorCallback(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Transport = &garbageTransport{Transport: sim}
+	p.Num = 1
+	var errs []error
+	p.OnRunError = func(err error) {
+		errs = append(errs, err)
+	}
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// a packet that can't be parsed is reported, the run goes on
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "parsing icmp message") {
+		t.Errorf("OnRunError() called with %v, want the error parsing the packet", errs)
+	}
+	if s := statsOf(t, p, "10.0.0.1"); s.PacketsRecv != 1 {
+		t.Errorf("PacketsRecv = %d, want 1", s.PacketsRecv)
+	}
+}
+
+func TestRunWriteError(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.Default = &SimLink{Latency: time.Millisecond}
+	p := newSimClient(t, sim, "10.0.0.1", "10.0.0.2")
+	p.Transport = &writeFailingTransport{Transport: sim, fail: "10.0.0.2", enobufs: 2}
+	p.Num = 2
+	var errs []error
+	p.OnRunError = func(err error) {
+		errs = append(errs, err)
+	}
+	timeouts := 0
+	p.OnTimeout = func(*Packet) { timeouts++ }
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// requests that could not be written are reported, not counted as lost
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "network is down") {
+		t.Errorf("OnRunError() called with %v, want the 2 write errors", errs)
+	}
+	if s := statsOf(t, p, "10.0.0.2"); s.PacketsSent != 0 || timeouts != 0 {
+		t.Errorf("10.0.0.2: %d sent, %d timeouts; want none", s.PacketsSent, timeouts)
+	}
+	// writes out of buffers are tried again
+	if s := statsOf(t, p, "10.0.0.1"); s.PacketsSent != 2 || s.PacketsRecv != 2 {
+		t.Errorf("10.0.0.1: %d sent, %d received; want 2 and 2", s.PacketsSent, s.PacketsRecv)
+	}
+}
+
+func TestRunReadError(t *testing.T) {
+	sim := NewSimNetwork(1)
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Transport = &failingTransport{Transport: sim}
+	p.Continuous = true
+	p.OnRecv = func(pkt *Packet) {
+		t.Errorf("OnRecv(%+v) after a failed read", pkt)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// a read error other than a timeout stops p with that error
+	if err := p.RunContext(ctx); err == nil || !strings.Contains(err.Error(), "read failed") {
+		t.Errorf("RunContext() = %v, want the read error", err)
+	}
+}
+
+func TestRunRejectsBadSettings(t *testing.T) {
+	p := newSimClient(t, NewSimNetwork(1), "10.0.0.1")
+	p.Interval = 0
+	if err := p.Run(); err == nil {
+		t.Errorf("Run() with a zero Interval succeeded")
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Continuous = true
+
+	finished := make(chan []*Statistics, 1)
+	p.OnFinish = func(stats []*Statistics) { finished <- stats }
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+	}()
+	if err := p.RunContext(ctx); err != context.Canceled {
+		t.Fatalf("RunContext() = %v, want %v", err, context.Canceled)
+	}
+	select {
+	case stats := <-finished:
+		if len(stats) != 1 || stats[0].PacketsRecv == 0 || stats[0].PacketsRecv != stats[0].PacketsSent {
+			t.Errorf("OnFinish(%+v), want the replies to every request sent", stats[0])
+		}
+	default:
+		t.Errorf("OnFinish not called")
+	}
+}
+
+func TestRunContextLinger(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	sim.SetLink("10.0.0.2", &SimLink{Loss: 1})
+	for _, tt := range []struct {
+		ip       string
+		min, max time.Duration
+	}{
+		// the linger ends with the last reply
+		{"10.0.0.1", 0, 2 * time.Second},
+		// unanswered requests without ReplyTimeout are waited for
+		{"10.0.0.2", 200 * time.Millisecond, 5 * time.Second},
+	} {
+		p := newSimClient(t, sim, tt.ip)
+		p.Continuous = true
+		p.ReplyTimeout = 0
+		p.Linger = 200 * time.Millisecond
+		if tt.min == 0 {
+			p.Linger = 5 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		start := time.Now()
+		err := p.RunContext(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("RunContext() = %v, want %v", err, context.DeadlineExceeded)
+		}
+		if d := time.Since(start) - 30*time.Millisecond; d < tt.min || d > tt.max {
+			t.Errorf("%s: lingered %s, want between %s and %s", tt.ip, d, tt.min, tt.max)
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Num = 2
+
+	// Stop without a Run in progress does nothing
+	p.Stop()
+	p.Stop()
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if s := statsOf(t, p, "10.0.0.1"); s.PacketsSent != 2 {
+		t.Errorf("Run() after Stop() sent %d packets, want 2", s.PacketsSent)
+	}
+
+	p.Continuous = true
+	done := make(chan error, 1)
+	go func() { done <- p.Run() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for sim.Sent("10.0.0.1") <= 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Stop()
+		}()
+	}
+	wg.Wait()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run() still running after Stop()")
+	}
+	if s := statsOf(t, p, "10.0.0.1"); s.PacketsSent == 0 {
+		t.Errorf("Run() sent no packets before Stop()")
+	}
+}
+
+func TestRunAfterStop(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Num = 2
+	finished := 0
+	p.OnFinish = func([]*Statistics) { finished++ }
+
+	// Stop after Run returned doesn't break the next Run
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	sent := sim.Sent("10.0.0.1")
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sim.Sent("10.0.0.1") - sent; n != 2 {
+		t.Errorf("second Run() sent %d packets, want 2", n)
+	}
+	if finished != 2 {
+		t.Errorf("OnFinish called %d times, want 2", finished)
+	}
+}
+
+func TestRunOnStats(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.StatsInterval = 20 * time.Millisecond
+
+	var cumulative, delta []*Statistics
+	p.OnStats = func(c []*Statistics, d []*Statistics) {
+		if len(c) != 1 || len(d) != 1 || c[0].IP != "10.0.0.1" || d[0].IP != "10.0.0.1" {
+			t.Errorf("OnStats(%v, %v), want the statistics of 10.0.0.1", c, d)
+			return
+		}
+		cumulative = append(cumulative, c[0])
+		delta = append(delta, d[0])
+	}
+	runFor(t, p, 110*time.Millisecond)
+
+	if len(cumulative) < 3 {
+		t.Fatalf("OnStats called %d times, want about 5", len(cumulative))
+	}
+	// the deltas add up to the cumulative statistics
+	sent, recv := 0, 0
+	for i := range delta {
+		sent += delta[i].PacketsSent
+		recv += delta[i].PacketsRecv
+		if c := cumulative[i]; c.PacketsSent != sent || c.PacketsRecv != recv {
+			t.Errorf("OnStats call %d: cumulative sent %d, received %d; want the sum of the deltas %d, %d", i, c.PacketsSent, c.PacketsRecv, sent, recv)
+		}
+	}
+	if delta[0].PacketsSent == 0 || delta[0].PacketsRecv == 0 {
+		t.Errorf("first delta: sent %d, received %d; want the packets of 4 intervals", delta[0].PacketsSent, delta[0].PacketsRecv)
+	}
+}
+
+func TestDeltaAcrossIntervals(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: 200 * time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Continuous = true
+	p.ReplyTimeout = 0
+	p.Linger = time.Second
+
+	// a delta starts as the third request is written, once the first two are
+	// counted since a request is sent after the previous ones, and the client
+	// is cancelled at the fourth, long before any reply; the delta receives
+	// the replies to every request and sends all but the first two
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var first []*Statistics
+	p.Transport = &writeHookTransport{Transport: sim, onWrite: func(n int) {
+		switch n {
+		case 3:
+			_, first = p.snapshot()
+		case 4:
+			cancel()
+		}
+	}}
+	if err := p.RunContext(ctx); err != context.Canceled {
+		t.Fatalf("RunContext() = %v, want %v", err, context.Canceled)
+	}
+	if d := first[0]; d.PacketsSent != 2 || d.PacketsRecv != 0 {
+		t.Fatalf("first delta: sent %d, received %d; want 2 and 0", d.PacketsSent, d.PacketsRecv)
+	}
+	cumulative, delta := p.snapshot()
+	sent := cumulative[0].PacketsSent
+	if d := delta[0]; d.PacketsSent != sent-2 || d.PacketsRecv != sent || d.PacketLoss != 0 {
+		t.Errorf("delta: sent %d, received %d, loss %v; want %d, %d and no loss", d.PacketsSent, d.PacketsRecv, d.PacketLoss, sent-2, sent)
+	}
+}
+
+func TestStatisticsPerURL(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("127.0.0.1", &SimLink{Latency: time.Millisecond})
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	p := newSimClient(t, sim, "localhost", "10.0.0.1")
+	p.Num = 3
+	p.Interval = 20 * time.Millisecond
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := p.StatisticsPerURL()
+	if len(stats) != 1 {
+		t.Fatalf("StatisticsPerURL() = %d statistics, want those of localhost", len(stats))
+	}
+	s := stats[0]
+	if s.URL != "localhost" || len(s.IPs) != 1 || s.IPs[0] != "127.0.0.1" {
+		t.Errorf("URL %q with IPs %v, want localhost with 127.0.0.1", s.URL, s.IPs)
+	}
+	if s.PacketsSent != 3 || s.PacketsRecv != 3 || s.MinRtt < time.Millisecond {
+		t.Errorf("sent %d, received %d, MinRtt %s; want 3, 3, at least 1ms", s.PacketsSent, s.PacketsRecv, s.MinRtt)
+	}
+}
+
+// recordingTransport is a Transport recording the messages written to its
+// connections
+type recordingTransport struct {
+	Transport
+
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func (r *recordingTransport) Listen(netProto string, source string) (PacketConn, error) {
+	conn, err := r.Transport.Listen(netProto, source)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{PacketConn: conn, transport: r}, nil
+}
+
+func (r *recordingTransport) messages() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.written...)
+}
+
+type recordingConn struct {
+	PacketConn
+	transport *recordingTransport
+}
+
+func (c *recordingConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	c.transport.mu.Lock()
+	c.transport.written = append(c.transport.written, append([]byte(nil), b...))
+	c.transport.mu.Unlock()
+	return c.PacketConn.WriteTo(b, dst)
+}
+
+// writeHookTransport is a Transport calling onWrite before the nth write of
+// its connections
+type writeHookTransport struct {
+	Transport
+	onWrite func(n int)
+
+	mu     sync.Mutex
+	writes int
+}
+
+func (w *writeHookTransport) Listen(netProto string, source string) (PacketConn, error) {
+	conn, err := w.Transport.Listen(netProto, source)
+	if err != nil {
+		return nil, err
+	}
+	return &writeHookConn{PacketConn: conn, transport: w}, nil
+}
+
+type writeHookConn struct {
+	PacketConn
+	transport *writeHookTransport
+}
+
+func (c *writeHookConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	w := c.transport
+	w.mu.Lock()
+	w.writes++
+	n := w.writes
+	w.mu.Unlock()
+	w.onWrite(n)
+	return c.PacketConn.WriteTo(b, dst)
+}
+
+// writeFailingTransport is a Transport whose connections fail to write to
+// the IP fail, and run out of buffers for the first enobufs writes to the
+// other IPs
+type writeFailingTransport struct {
+	Transport
+	fail    string
+	enobufs int
+}
+
+func (w *writeFailingTransport) Listen(netProto string, source string) (PacketConn, error) {
+	conn, err := w.Transport.Listen(netProto, source)
+	if err != nil {
+		return nil, err
+	}
+	return &writeFailingConn{PacketConn: conn, fail: w.fail, enobufs: w.enobufs}, nil
+}
+
+type writeFailingConn struct {
+	PacketConn
+	fail string
+
+	mu      sync.Mutex
+	enobufs int
+}
+
+func (c *writeFailingConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	if ipStr, _ := resolveIPFromAddr(dst); ipStr == c.fail {
+		return 0, &net.OpError{Op: "write", Net: "sim", Err: errors.New("network is down")}
+	}
+	c.mu.Lock()
+	full := c.enobufs > 0
+	c.enobufs--
+	c.mu.Unlock()
+	if full {
+		return 0, &net.OpError{Op: "write", Net: "sim", Err: syscall.ENOBUFS}
+	}
+	return c.PacketConn.WriteTo(b, dst)
+}
+
+// garbageTransport is a Transport whose connections first read a packet too
+// short to be an ICMP message
+type garbageTransport struct {
+	Transport
+}
+
+func (g *garbageTransport) Listen(netProto string, source string) (PacketConn, error) {
+	conn, err := g.Transport.Listen(netProto, source)
+	if err != nil {
+		return nil, err
+	}
+	return &garbageConn{PacketConn: conn}, nil
+}
+
+type garbageConn struct {
+	PacketConn
+	read bool
+}
+
+func (c *garbageConn) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	if !c.read {
+		c.read = true
+		b[0] = 0
+		return 1, 64, &net.IPAddr{IP: net.ParseIP("10.0.0.1")}, nil
+	}
+	return c.PacketConn.ReadFrom(b)
+}
+
+// failingTransport is a Transport whose connections fail to read
+type failingTransport struct {
+	Transport
+}
+
+func (f *failingTransport) Listen(netProto string, source string) (PacketConn, error) {
+	conn, err := f.Transport.Listen(netProto, source)
+	if err != nil {
+		return nil, err
+	}
+	return &failingConn{PacketConn: conn}, nil
+}
+
+type failingConn struct {
+	PacketConn
+}
+
+func (c *failingConn) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	return 0, 0, nil, errors.New("read failed")
+}
+
+// icmpv6Checksum returns the ones' complement sum of msg and the IPv6 pseudo
+// header of src and dst, 0xffff if the checksum in msg is right
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	b := make([]byte, 40, 40+len(msg)+1)
+	copy(b, src.To16())
+	copy(b[16:], dst.To16())
+	binary.BigEndian.PutUint32(b[32:], uint32(len(msg)))
+	b[39] = 58
+	b = append(b, msg...)
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	var sum uint32
+	for i := 0; i < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+func TestRunIPv6HopLimit(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("2001:db8::1", &SimLink{Latency: time.Millisecond, TTL: 42})
+	sim.SetLink("192.0.2.1", &SimLink{Latency: time.Millisecond, TTL: 42})
+	p := newSimClient(t, sim, "2001:db8::1", "192.0.2.1")
+	p.Num = 3
+	p.Interval = 20 * time.Millisecond
+
+	var mu sync.Mutex
+	var received []*Packet
+	p.OnRecv = func(pkt *Packet) {
+		mu.Lock()
+		received = append(received, pkt)
+		mu.Unlock()
+	}
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 6 {
+		t.Fatalf("OnRecv called %d times, want 6", len(received))
+	}
+	for _, pkt := range received {
+		want := 42
+		if pkt.IP == "192.0.2.1" {
+			want = 0
+		}
+		if pkt.Ttl != 42 || pkt.HopLimit != want {
+			t.Errorf("%s: Ttl %d, HopLimit %d; want 42, %d", pkt.IP, pkt.Ttl, pkt.HopLimit, want)
+		}
+	}
+}
+
+func TestRunIPv6Checksum(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("2001:db8::1", &SimLink{Latency: time.Millisecond})
+	rec := &recordingTransport{Transport: sim}
+	p := newSimClient(t, sim, "2001:db8::1")
+	p.Transport = rec
+	p.Source = "2001:db8::100"
+	p.Num = 2
+	p.Interval = 20 * time.Millisecond
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if s := statsOf(t, p, "2001:db8::1"); s.PacketsRecv != 2 {
+		t.Errorf("received %d replies, want 2", s.PacketsRecv)
+	}
+
+	msgs := rec.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("%d echo requests written, want 2", len(msgs))
+	}
+	for _, msg := range msgs {
+		if binary.BigEndian.Uint16(msg[2:]) == 0 {
+			t.Errorf("echo request without checksum")
+		}
+		if sum := icmpv6Checksum(net.ParseIP("2001:db8::100"), net.ParseIP("2001:db8::1"), msg); sum != 0xffff {
+			t.Errorf("checksum %#04x over the pseudo header, want 0xffff", sum)
+		}
+	}
+}
+
+func TestParseIPAddr(t *testing.T) {
+	tests := []struct {
+		s    string
+		ip   string
+		zone string
+	}{
+		{"192.0.2.1", "192.0.2.1", ""},
+		{"2001:db8::1", "2001:db8::1", ""},
+		{"fe80::1%eth0", "fe80::1", "eth0"},
+		{"fe80::1%", "", ""},
+		{"192.0.2.1%eth0", "", ""},
+		{"example.com", "", ""},
+	}
+	for _, tt := range tests {
+		ipAddr := parseIPAddr(tt.s)
+		if tt.ip == "" {
+			if ipAddr != nil {
+				t.Errorf("parseIPAddr(%q) = %v, want nil", tt.s, ipAddr)
+			}
+			continue
+		}
+		if ipAddr == nil || ipAddr.IP.String() != tt.ip || ipAddr.Zone != tt.zone {
+			t.Errorf("parseIPAddr(%q) = %v, want %s zone %q", tt.s, ipAddr, tt.ip, tt.zone)
+		}
+	}
+}
+
+func TestRunZones(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("fe80::1%eth0", &SimLink{Latency: time.Millisecond})
+	sim.SetLink("fe80::1%eth1", &SimLink{Loss: 1})
+	p := newSimClient(t, sim, "fe80::1%eth0", "fe80::1%eth1")
+	p.Num = 2
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a link-local IP is a target per interface
+	if len(p.IPs) != 2 {
+		t.Fatalf("IPs = %v, want fe80::1 on eth0 and eth1", p.IPs)
+	}
+	if n := sim.Sent("fe80::1%eth1"); n != 2 {
+		t.Errorf("%d requests sent on eth1, want 2", n)
+	}
+	if s := statsOf(t, p, "fe80::1%eth0"); s.PacketsSent != 2 || s.PacketsRecv != 2 {
+		t.Errorf("eth0: sent %d, received %d; want 2, 2", s.PacketsSent, s.PacketsRecv)
+	}
+	if s := statsOf(t, p, "fe80::1%eth1"); s.PacketsSent != 2 || s.PacketsRecv != 0 {
+		t.Errorf("eth1: sent %d, received %d; want 2, 0", s.PacketsSent, s.PacketsRecv)
+	}
+}
@@ -0,0 +1,255 @@
+// Package prometheus exposes the statistics of PingClients as Prometheus
+// metrics in the text exposition format, without any dependency.
+//
+//	exporter := prometheus.NewExporter()
+//	exporter.Register(pingClient)
+//	http.Handle("/metrics", exporter)
+//	go http.ListenAndServe(":9427", nil)
+//	pingClient.Run()
+//
+// Every metric is labeled with the name of the PingClient (client), the URL
+// the IP was resolved from (url, empty for IPs) and the IP (ip):
+//
+//	pingclient_packets_sent_total       counter   echo requests sent
+//	pingclient_packets_received_total   counter   echo replies received
+//	pingclient_packet_loss_ratio        gauge     lost packets, 0 to 1
+//	pingclient_rtt_seconds              histogram round-trip times
+//	pingclient_last_rtt_seconds         gauge     round-trip time of the last reply
+//	pingclient_up                       gauge     1 if the last echo request was answered
+//
+// The counters, loss ratio and histogram come from PingClient.Statistics, so
+// they start over with every Run unless PingClient.Accumulate is set.
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ping "github.com/scientiacoder/PingClient"
+)
+
+// contentType is the media type of the text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Exporter collects the metrics of the PingClients registered with it. It
+// is an http.Handler serving them.
+type Exporter struct {
+	mu      sync.Mutex
+	clients []*ping.PingClient
+	// last replies and timeouts per PingClient and IP
+	targets map[*ping.PingClient]map[string]*target
+}
+
+// target is what the statistics don't tell about an IP
+type target struct {
+	lastRtt time.Duration
+	up      bool
+}
+
+// NewExporter returns an Exporter without PingClients.
+func NewExporter() *Exporter {
+	return &Exporter{
+		targets: make(map[*ping.PingClient]map[string]*target),
+	}
+}
+
+// Register adds the metrics of p, chaining OnRecv, OnTimeout and OnError:
+// the callbacks set before are still called. It must be called before p
+// runs.
+func (e *Exporter) Register(p *ping.PingClient) {
+	e.mu.Lock()
+	e.clients = append(e.clients, p)
+	e.targets[p] = make(map[string]*target)
+	e.mu.Unlock()
+
+	onRecv, onTimeout, onError := p.OnRecv, p.OnTimeout, p.OnError
+	p.OnRecv = func(pkt *ping.Packet) {
+		if onRecv != nil {
+			onRecv(pkt)
+		}
+		if !pkt.Duplicate {
+			e.update(p, pkt.IP, func(t *target) {
+				t.lastRtt = pkt.Rtt
+				t.up = true
+			})
+		}
+	}
+	p.OnTimeout = func(pkt *ping.Packet) {
+		if onTimeout != nil {
+			onTimeout(pkt)
+		}
+		e.update(p, pkt.IP, func(t *target) { t.up = false })
+	}
+	p.OnError = func(icmpErr *ping.ICMPError) {
+		if onError != nil {
+			onError(icmpErr)
+		}
+		e.update(p, icmpErr.IP, func(t *target) { t.up = false })
+	}
+}
+
+// Unregister removes the metrics of p, e.g. once it is stopped for good.
+func (e *Exporter) Unregister(p *ping.PingClient) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, client := range e.clients {
+		if client == p {
+			e.clients = append(e.clients[:i:i], e.clients[i+1:]...)
+			break
+		}
+	}
+	delete(e.targets, p)
+}
+
+func (e *Exporter) update(p *ping.PingClient, ip string, f func(*target)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	targets, ok := e.targets[p]
+	if !ok {
+		// unregistered meanwhile
+		return
+	}
+	t, ok := targets[ip]
+	if !ok {
+		t = &target{}
+		targets[ip] = t
+	}
+	f(t)
+}
+
+// ServeHTTP writes the metrics in the text exposition format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	//nolint:errcheck
+	e.WriteTo(w)
+}
+
+// sample is a metric value of an IP
+type sample struct {
+	labels string
+	stat   *ping.Statistics
+	target target
+}
+
+// WriteTo writes the metrics of every registered PingClient in the text
+// exposition format to w.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	e.mu.Lock()
+	clients := append([]*ping.PingClient(nil), e.clients...)
+	e.mu.Unlock()
+
+	// statistics are taken outside e.mu, the callbacks of a PingClient
+	// holding its own lock may wait for e.mu
+	samples := make([]*sample, 0)
+	for _, p := range clients {
+		stats := p.Statistics()
+		e.mu.Lock()
+		targets := e.targets[p]
+		for _, stat := range stats {
+			s := &sample{labels: labels(stat), stat: stat}
+			if t, ok := targets[stat.IP]; ok {
+				s.target = *t
+			}
+			samples = append(samples, s)
+		}
+		e.mu.Unlock()
+	}
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	writeFamily(cw, "pingclient_packets_sent_total", "counter", "Number of echo requests sent.", samples,
+		func(s *sample) float64 { return float64(s.stat.PacketsSent) })
+	writeFamily(cw, "pingclient_packets_received_total", "counter", "Number of echo replies received, without duplicates.", samples,
+		func(s *sample) float64 { return float64(s.stat.PacketsRecv) })
+	writeFamily(cw, "pingclient_packet_loss_ratio", "gauge", "Ratio of echo requests without reply, from 0 to 1.", samples,
+		func(s *sample) float64 { return s.stat.PacketLoss / 100 })
+	writeHistogram(cw, samples)
+	writeFamily(cw, "pingclient_last_rtt_seconds", "gauge", "Round-trip time of the last echo reply.", samples,
+		func(s *sample) float64 { return s.target.lastRtt.Seconds() })
+	writeFamily(cw, "pingclient_up", "gauge", "1 if the last echo request was answered, 0 otherwise.", samples,
+		func(s *sample) float64 {
+			if s.target.up {
+				return 1
+			}
+			return 0
+		})
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// writeFamily writes a metric with one value per sample
+func writeFamily(w *countingWriter, name string, typ string, help string, samples []*sample, value func(*sample) float64) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range samples {
+		w.printf("%s{%s} %s\n", name, s.labels, formatFloat(value(s)))
+	}
+}
+
+// writeHistogram writes the RTT histogram, its buckets are
+// PingClient.HistogramBuckets
+func writeHistogram(w *countingWriter, samples []*sample) {
+	const name = "pingclient_rtt_seconds"
+	w.printf("# HELP %s Round-trip times of the echo replies.\n# TYPE %s histogram\n", name, name)
+	for _, s := range samples {
+		cumulative := 0
+		for _, bucket := range s.stat.Histogram {
+			cumulative += bucket.Count
+			le := "+Inf"
+			if bucket.UpperBound != math.MaxInt64 {
+				le = formatFloat(bucket.UpperBound.Seconds())
+			}
+			w.printf("%s_bucket{%s,le=\"%s\"} %d\n", name, s.labels, le, cumulative)
+		}
+		if len(s.stat.Histogram) == 0 {
+			w.printf("%s_bucket{%s,le=\"+Inf\"} %d\n", name, s.labels, s.stat.PacketsRecv)
+		}
+		sum := s.stat.AvgRtt.Seconds() * float64(s.stat.PacketsRecv)
+		w.printf("%s_sum{%s} %s\n", name, s.labels, formatFloat(sum))
+		w.printf("%s_count{%s} %d\n", name, s.labels, s.stat.PacketsRecv)
+	}
+}
+
+// labels formats the labels of the metrics of stat
+func labels(stat *ping.Statistics) string {
+	urls := append([]string(nil), stat.URLs...)
+	if len(urls) == 0 && stat.URL != "" {
+		urls = append(urls, stat.URL)
+	}
+	sort.Strings(urls)
+	return fmt.Sprintf("client=\"%s\",url=\"%s\",ip=\"%s\"",
+		escape(stat.Name), escape(strings.Join(urls, ",")), escape(stat.IP))
+}
+
+// escape escapes a label value
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// countingWriter keeps the first error and the number of bytes written
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(w.w, format, args...)
+	w.n += int64(n)
+	w.err = err
+}
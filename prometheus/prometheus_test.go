@@ -0,0 +1,197 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ping "github.com/scientiacoder/PingClient"
+)
+
+// newSimClient returns a PingClient named name pinging 10.0.0.1, which
+// answers in 10ms, and 10.0.0.2, which never does
+func newSimClient(t *testing.T, name string) *ping.PingClient {
+	t.Helper()
+	sim := ping.NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &ping.SimLink{Latency: 10 * time.Millisecond})
+	sim.SetLink("10.0.0.2", &ping.SimLink{Loss: 1})
+	p := ping.New()
+	p.Name = name
+	p.Transport = sim
+	p.Interval = 5 * time.Millisecond
+	p.ReplyTimeout = 20 * time.Millisecond
+	p.Linger = 100 * time.Millisecond
+	p.Continuous = true
+	p.HistogramBuckets = []time.Duration{5 * time.Millisecond, time.Second}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := p.Add(ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// runFor runs p for d
+func runFor(t *testing.T, p *ping.PingClient, d time.Duration) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	if err := p.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("RunContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// scrape returns the metrics served by e
+func scrape(t *testing.T, e *Exporter) string {
+	t.Helper()
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != contentType {
+		t.Errorf("Content-Type %q, want %q", got, contentType)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestExporter(t *testing.T) {
+	p := newSimClient(t, `lab "1"`)
+	var mu sync.Mutex
+	recv := 0
+	p.OnRecv = func(*ping.Packet) {
+		mu.Lock()
+		recv++
+		mu.Unlock()
+	}
+	e := NewExporter()
+	e.Register(p)
+	runFor(t, p, 100*time.Millisecond)
+
+	stats := p.Statistics()
+	up, down := stats[0], stats[1]
+	mu.Lock()
+	if recv != up.PacketsRecv {
+		t.Errorf("OnRecv set before Register called %d times, want %d", recv, up.PacketsRecv)
+	}
+	mu.Unlock()
+	if up.PacketsRecv == 0 || down.PacketsSent == 0 {
+		t.Fatalf("received %d from 10.0.0.1, sent %d to 10.0.0.2; want some", up.PacketsRecv, down.PacketsSent)
+	}
+
+	upLabels := `client="lab \"1\"",url="",ip="10.0.0.1"`
+	downLabels := `client="lab \"1\"",url="",ip="10.0.0.2"`
+	sum := up.AvgRtt.Seconds() * float64(up.PacketsRecv)
+	want := []string{
+		"# HELP pingclient_packets_sent_total Number of echo requests sent.",
+		"# TYPE pingclient_packets_sent_total counter",
+		fmt.Sprintf("pingclient_packets_sent_total{%s} %d", upLabels, up.PacketsSent),
+		fmt.Sprintf("pingclient_packets_sent_total{%s} %d", downLabels, down.PacketsSent),
+		"# HELP pingclient_packets_received_total Number of echo replies received, without duplicates.",
+		"# TYPE pingclient_packets_received_total counter",
+		fmt.Sprintf("pingclient_packets_received_total{%s} %d", upLabels, up.PacketsRecv),
+		fmt.Sprintf("pingclient_packets_received_total{%s} 0", downLabels),
+		"# HELP pingclient_packet_loss_ratio Ratio of echo requests without reply, from 0 to 1.",
+		"# TYPE pingclient_packet_loss_ratio gauge",
+		fmt.Sprintf("pingclient_packet_loss_ratio{%s} 0", upLabels),
+		fmt.Sprintf("pingclient_packet_loss_ratio{%s} 1", downLabels),
+		"# HELP pingclient_rtt_seconds Round-trip times of the echo replies.",
+		"# TYPE pingclient_rtt_seconds histogram",
+		fmt.Sprintf(`pingclient_rtt_seconds_bucket{%s,le="0.005"} 0`, upLabels),
+		fmt.Sprintf(`pingclient_rtt_seconds_bucket{%s,le="1"} %d`, upLabels, up.PacketsRecv),
+		fmt.Sprintf(`pingclient_rtt_seconds_bucket{%s,le="+Inf"} %d`, upLabels, up.PacketsRecv),
+		fmt.Sprintf("pingclient_rtt_seconds_sum{%s} %s", upLabels, formatFloat(sum)),
+		fmt.Sprintf("pingclient_rtt_seconds_count{%s} %d", upLabels, up.PacketsRecv),
+		fmt.Sprintf(`pingclient_rtt_seconds_bucket{%s,le="0.005"} 0`, downLabels),
+		fmt.Sprintf(`pingclient_rtt_seconds_bucket{%s,le="1"} 0`, downLabels),
+		fmt.Sprintf(`pingclient_rtt_seconds_bucket{%s,le="+Inf"} 0`, downLabels),
+		fmt.Sprintf("pingclient_rtt_seconds_sum{%s} 0", downLabels),
+		fmt.Sprintf("pingclient_rtt_seconds_count{%s} 0", downLabels),
+		"# HELP pingclient_last_rtt_seconds Round-trip time of the last echo reply.",
+		"# TYPE pingclient_last_rtt_seconds gauge",
+	}
+	got := strings.Split(strings.TrimSuffix(scrape(t, e), "\n"), "\n")
+	if len(got) != len(want)+6 {
+		t.Fatalf("scraped %d lines, want %d:\n%s", len(got), len(want)+6, strings.Join(got, "\n"))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d: %s\nwant: %s", i+1, got[i], want[i])
+		}
+	}
+
+	// the last rtt is that of the last reply, pinged in 10ms
+	rest := got[len(want):]
+	var lastRtt float64
+	if _, err := fmt.Sscanf(strings.TrimPrefix(rest[0], "pingclient_last_rtt_seconds{"+upLabels+"} "), "%g", &lastRtt); err != nil ||
+		lastRtt < 0.01 || lastRtt > 1 {
+		t.Errorf("line %s, want the round-trip time of the last reply of 10.0.0.1", rest[0])
+	}
+	wantRest := []string{
+		fmt.Sprintf("pingclient_last_rtt_seconds{%s} 0", downLabels),
+		"# HELP pingclient_up 1 if the last echo request was answered, 0 otherwise.",
+		"# TYPE pingclient_up gauge",
+		fmt.Sprintf("pingclient_up{%s} 1", upLabels),
+		fmt.Sprintf("pingclient_up{%s} 0", downLabels),
+	}
+	for i, line := range wantRest {
+		if rest[i+1] != line {
+			t.Errorf("line %d: %s\nwant: %s", len(want)+i+2, rest[i+1], line)
+		}
+	}
+}
+
+func TestExporterLabels(t *testing.T) {
+	stat := &ping.Statistics{
+		Name: "lab",
+		URL:  "b.example.com",
+		URLs: []string{"b.example.com", `a\example.com`},
+		IP:   "10.0.0.1",
+	}
+	if got, want := labels(stat), `client="lab",url="a\\example.com,b.example.com",ip="10.0.0.1"`; got != want {
+		t.Errorf("labels() = %s, want %s", got, want)
+	}
+}
+
+func TestExporterUnregister(t *testing.T) {
+	e := NewExporter()
+	p := newSimClient(t, "lab")
+	q := newSimClient(t, "other")
+	e.Register(p)
+	e.Register(q)
+	e.Unregister(p)
+
+	var b strings.Builder
+	n, err := e.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo() = %d, wrote %d bytes", n, b.Len())
+	}
+	if strings.Contains(b.String(), `client="lab"`) || !strings.Contains(b.String(), `client="other"`) {
+		t.Errorf("metrics after Unregister:\n%s\nwant only those of client other", b.String())
+	}
+
+	// the callbacks of an unregistered PingClient don't bring it back
+	runFor(t, p, 30*time.Millisecond)
+	b.Reset()
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), `client="lab"`) {
+		t.Errorf("metrics of an unregistered PingClient after it ran:\n%s", b.String())
+	}
+}
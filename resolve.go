@@ -0,0 +1,341 @@
+package pingclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DNSResolver is a DNS server URLs are looked up with instead of the system
+// resolver.
+type DNSResolver struct {
+	// Server is the address of the DNS server, e.g. "8.8.8.8" or
+	// "127.0.0.1:5353". Default port is 53. If empty, the system resolver
+	// is used with Timeout.
+	Server string
+
+	// Protocol is "udp" or "tcp". Default is "udp".
+	Protocol string
+
+	// Timeout bounds every lookup. No timeout if zero.
+	Timeout time.Duration
+}
+
+// resolver returns the net.Resolver querying r.Server
+func (r *DNSResolver) resolver() *net.Resolver {
+	if r == nil || r.Server == "" {
+		return net.DefaultResolver
+	}
+	server := r.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	protocol := r.Protocol
+	if protocol == "" {
+		protocol = "udp"
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, protocol, server)
+		},
+	}
+}
+
+// lookup resolves url to its IP address, or to all the addresses of the
+// given network ("ip", "ip4", "ip6" or "dual") if all is true, and reports
+// how long it took. With network "ip" an IPv4 address is preferred, like
+// net.ResolveIPAddr does, with "dual" an IPv4 and an IPv6 address are
+// returned if url has both.
+func (r *DNSResolver) lookup(network string, url string, all bool) ([]*net.IPAddr, time.Duration, error) {
+	ctx := context.Background()
+	if r != nil && r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	addrs, err := r.resolver().LookupIPAddr(ctx, url)
+	elapsed := time.Since(start)
+	if err != nil {
+		return nil, elapsed, err
+	}
+	ipAddrs := make([]*net.IPAddr, 0, len(addrs))
+	for i := range addrs {
+		if (network == "ip4" && !isIPv4(addrs[i].IP)) || (network == "ip6" && isIPv4(addrs[i].IP)) {
+			continue
+		}
+		ipAddrs = append(ipAddrs, &addrs[i])
+	}
+	if len(ipAddrs) == 0 {
+		return nil, elapsed, fmt.Errorf("error lookup(): no %s address found for %s", network, url)
+	}
+	if all {
+		return ipAddrs, elapsed, nil
+	}
+	return pickAddrs(network, ipAddrs, nil), elapsed, nil
+}
+
+// pickAddrs picks the addresses to ping among ipAddrs when not all of them
+// are: one per URL, or one per IP version with network "dual". Addresses in
+// current are kept if possible, so that a URL keeps being pinged at the same
+// address as long as it resolves to it.
+func pickAddrs(network string, ipAddrs []*net.IPAddr, current []*net.IPAddr) []*net.IPAddr {
+	pick := func(match func(*net.IPAddr) bool) *net.IPAddr {
+		for _, ipAddr := range current {
+			if match(ipAddr) && containsIP(ipAddrs, ipAddr) {
+				return ipAddr
+			}
+		}
+		for _, ipAddr := range ipAddrs {
+			if match(ipAddr) {
+				return ipAddr
+			}
+		}
+		return nil
+	}
+	v4 := pick(func(ipAddr *net.IPAddr) bool { return isIPv4(ipAddr.IP) })
+	v6 := pick(func(ipAddr *net.IPAddr) bool { return !isIPv4(ipAddr.IP) })
+
+	picked := make([]*net.IPAddr, 0, 2)
+	switch {
+	case network == "dual":
+		for _, ipAddr := range []*net.IPAddr{v4, v6} {
+			if ipAddr != nil {
+				picked = append(picked, ipAddr)
+			}
+		}
+	case v4 != nil && v6 != nil:
+		// with network "ip" the IP version pinged so far is kept, IPv4 is
+		// preferred for new URLs
+		for _, ipAddr := range current {
+			if ipAddr == v6 {
+				return append(picked, v6)
+			}
+		}
+		picked = append(picked, v4)
+	case v4 != nil:
+		picked = append(picked, v4)
+	case v6 != nil:
+		picked = append(picked, v6)
+	}
+	return picked
+}
+
+// dnsStats are the DNS lookups of a URL
+type dnsStats struct {
+	lookups  int
+	failures int
+	last     time.Duration
+	total    time.Duration
+	err      error
+}
+
+func (d *dnsStats) add(elapsed time.Duration, err error) {
+	d.lookups++
+	d.last = elapsed
+	d.total += elapsed
+	d.err = err
+	if err != nil {
+		d.failures++
+	}
+}
+
+// fill sets the DNS fields of s
+func (d *dnsStats) fill(s *Statistics) {
+	s.DNSLookups = d.lookups
+	s.DNSFailures = d.failures
+	s.DNSLookupTime = d.last
+	if d.lookups > 0 {
+		s.AvgDNSLookupTime = d.total / time.Duration(d.lookups)
+	}
+	if d.err != nil {
+		s.DNSError = d.err.Error()
+	}
+}
+
+// lookupURL resolves url with Resolver and records the lookup in the
+// statistics of url
+func (p *PingClient) lookupURL(url string, all bool) ([]*net.IPAddr, error) {
+	p.mu.RLock()
+	resolver, network := p.Resolver, p.network
+	p.mu.RUnlock()
+	ipAddrs, elapsed, err := resolver.lookup(network, url, all)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.dnsStats[url]
+	if !ok {
+		d = &dnsStats{}
+		p.dnsStats[url] = d
+	}
+	d.add(elapsed, err)
+	return ipAddrs, err
+}
+
+// TargetChange reports that re-resolving a URL changed the IP addresses
+// PingClient pings for it.
+type TargetChange struct {
+	// URL is the URL that was resolved again.
+	URL string
+
+	// Added are the IP addresses the URL resolves to now and that are
+	// pinged from now on.
+	Added []*net.IPAddr
+
+	// Removed are the IP addresses the URL no longer resolves to. They stop
+	// being pinged unless another URL still resolves to them; their
+	// statistics are kept.
+	Removed []*net.IPAddr
+}
+
+// resolveURLs looks up every URL again, URLs failing to resolve are left out
+// so that a DNS hiccup doesn't drop their IP addresses
+func (p *PingClient) resolveURLs() map[string][]*net.IPAddr {
+	p.mu.RLock()
+	urls := append([]string(nil), p.URLs...)
+	p.mu.RUnlock()
+
+	resolved := make(map[string][]*net.IPAddr, len(urls))
+	for _, url := range urls {
+		// all the records are needed to tell whether the IP pinged so far
+		// is still one of them
+		ipAddrs, err := p.lookupURL(url, true)
+		if err != nil {
+			continue
+		}
+		resolved[url] = ipAddrs
+	}
+	return resolved
+}
+
+// updateTargets adds and removes IP addresses according to the resolved
+// URLs and returns the changes. Addresses of an IP version without a
+// connection open in the current Run are skipped.
+func (p *PingClient) updateTargets(resolved map[string][]*net.IPAddr, hasIPv4 bool, hasIPv6 bool) []*TargetChange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changes := make([]*TargetChange, 0)
+	for _, url := range p.URLs {
+		ipAddrs, ok := resolved[url]
+		if !ok {
+			continue
+		}
+		usable := make([]*net.IPAddr, 0, len(ipAddrs))
+		for _, ipAddr := range ipAddrs {
+			if (isIPv4(ipAddr.IP) && hasIPv4) || (!isIPv4(ipAddr.IP) && hasIPv6) {
+				usable = append(usable, ipAddr)
+			}
+		}
+		if len(usable) == 0 {
+			continue
+		}
+
+		current := make([]*net.IPAddr, 0)
+		for _, ipAddr := range p.IPs {
+			if containsString(p.IPToURL[ipAddr.String()], url) {
+				current = append(current, ipAddr)
+			}
+		}
+		wanted := usable
+		if !p.ResolveAll {
+			wanted = pickAddrs(p.network, usable, current)
+		}
+
+		change := &TargetChange{URL: url}
+		for _, ipAddr := range wanted {
+			if !containsIP(current, ipAddr) {
+				change.Added = append(change.Added, p.addTarget(ipAddr, url))
+			}
+		}
+		for _, ipAddr := range current {
+			if !containsIP(wanted, ipAddr) {
+				p.removeTarget(ipAddr, url)
+				change.Removed = append(change.Removed, ipAddr)
+			}
+		}
+		if len(change.Added) > 0 || len(change.Removed) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// addTarget starts pinging ipAddr for url in the current Run, picking up
+// the statistics of ipAddr if it was pinged before. It must be called with
+// p.mu held.
+func (p *PingClient) addTarget(ipAddr *net.IPAddr, url string) *net.IPAddr {
+	ipAddr = p.addIP(ipAddr)
+	ipStr := ipAddr.String()
+	p.IPToURL[ipStr] = append(p.IPToURL[ipStr], url)
+	p.retired[ipStr] = removeString(p.retired[ipStr], url)
+	if len(p.retired[ipStr]) == 0 {
+		delete(p.retired, ipStr)
+	}
+	p.startTarget(ipStr)
+	return ipAddr
+}
+
+// startTarget sets up the counters of ipStr, keeping its statistics if it
+// was pinged before. It must be called with p.mu held.
+func (p *PingClient) startTarget(ipStr string) {
+	if _, ok := p.targets[ipStr]; !ok {
+		p.targets[ipStr] = newTarget()
+		p.sent[ipStr] = 0
+		p.deltaStats[ipStr] = newRTTStats(p.histogramBuckets(), nil)
+	}
+	if _, ok := p.PacketsSent[ipStr]; !ok {
+		p.PacketsSent[ipStr] = 0
+		p.PacketsRecv[ipStr] = 0
+		p.PacketsInfo[ipStr] = make([]*Packet, 0)
+		p.rtts[ipStr] = make([]time.Duration, 0)
+		p.rttStats[ipStr] = newRTTStats(p.histogramBuckets(), p.Windows)
+	}
+}
+
+// removeTarget stops pinging ipAddr for url, and altogether once no URL
+// resolves to it any more unless it was added as an IP. The statistics of ipAddr are kept and still
+// count towards url in StatisticsPerURL. It must be called with p.mu held.
+func (p *PingClient) removeTarget(ipAddr *net.IPAddr, url string) {
+	ipStr := ipAddr.String()
+	p.IPToURL[ipStr] = removeString(p.IPToURL[ipStr], url)
+	if !containsString(p.retired[ipStr], url) {
+		p.retired[ipStr] = append(p.retired[ipStr], url)
+	}
+	if len(p.IPToURL[ipStr]) > 0 {
+		return
+	}
+	delete(p.IPToURL, ipStr)
+	if !p.literal[ipStr] {
+		p.stopTarget(ipAddr)
+	}
+}
+
+// stopTarget stops pinging ipAddr, its statistics are kept. It must be
+// called with p.mu held.
+func (p *PingClient) stopTarget(ipAddr *net.IPAddr) {
+	ipStr := ipAddr.String()
+	for i := range p.IPs {
+		if p.IPs[i].String() == ipStr {
+			p.IPs = append(p.IPs[:i:i], p.IPs[i+1:]...)
+			break
+		}
+	}
+	// unanswered requests are dropped rather than reported to OnTimeout,
+	// and allSent no longer waits for the IP
+	delete(p.targets, ipStr)
+	delete(p.sent, ipStr)
+	delete(p.deltaStats, ipStr)
+}
+
+func removeString(list []string, s string) []string {
+	for i, v := range list {
+		if v == s {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
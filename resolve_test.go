@@ -0,0 +1,341 @@
+package pingclient
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer is a DNS server on a local udp socket answering A and AAAA
+// queries from a table of records, NXDOMAIN for names without any
+type dnsServer struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	records map[string][]string
+	queries map[string]int
+}
+
+// newDNSServer starts a dnsServer, records maps names like "example.test"
+// to their IP addresses
+func newDNSServer(t *testing.T, records map[string][]string) *dnsServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsServer{conn: conn, records: records, queries: make(map[string]int)}
+	go s.serve()
+	return s
+}
+
+func (s *dnsServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *dnsServer) close() {
+	s.conn.Close()
+}
+
+// set replaces the records of name
+func (s *dnsServer) set(name string, ips ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[name] = ips
+}
+
+// queried returns the number of queries for name
+func (s *dnsServer) queried(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[name]
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp, err := s.answer(buf[:n]); err == nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// answer returns the response to the query in req
+func (s *dnsServer) answer(req []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(q.Name.String(), ".")
+
+	s.mu.Lock()
+	s.queries[name]++
+	ips, ok := s.records[name]
+	s.mu.Unlock()
+
+	rcode := dnsmessage.RCodeSuccess
+	if !ok {
+		rcode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RCode: rcode})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		switch {
+		case q.Type == dnsmessage.TypeA && ip.To4() != nil:
+			var a dnsmessage.AResource
+			copy(a.A[:], ip.To4())
+			err = b.AResource(rh, a)
+		case q.Type == dnsmessage.TypeAAAA && ip.To4() == nil:
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			err = b.AAAAResource(rh, aaaa)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// ipStrings joins ipAddrs with spaces
+func ipStrings(ipAddrs []*net.IPAddr) string {
+	s := make([]string, len(ipAddrs))
+	for i, ipAddr := range ipAddrs {
+		s[i] = ipAddr.IP.String()
+	}
+	return strings.Join(s, " ")
+}
+
+func TestDNSResolverLookup(t *testing.T) {
+	dns := newDNSServer(t, map[string][]string{
+		"both.example.test": {"192.0.2.1", "192.0.2.2", "2001:db8::1"},
+		"v6.example.test":   {"2001:db8::2"},
+	})
+	defer dns.close()
+	r := &DNSResolver{Server: dns.addr(), Timeout: 2 * time.Second}
+
+	tests := []struct {
+		network string
+		url     string
+		all     bool
+		want    string
+	}{
+		{"ip", "both.example.test", false, "192.0.2.1"},
+		{"ip", "both.example.test", true, "192.0.2.1 192.0.2.2 2001:db8::1"},
+		{"ip4", "both.example.test", true, "192.0.2.1 192.0.2.2"},
+		{"ip6", "both.example.test", false, "2001:db8::1"},
+		{"dual", "both.example.test", false, "192.0.2.1 2001:db8::1"},
+		{"ip", "v6.example.test", false, "2001:db8::2"},
+	}
+	for _, tt := range tests {
+		ipAddrs, _, err := r.lookup(tt.network, tt.url, tt.all)
+		if err != nil {
+			t.Errorf("lookup(%s, %s, %v): %s", tt.network, tt.url, tt.all, err)
+			continue
+		}
+		if got := ipStrings(ipAddrs); got != tt.want {
+			t.Errorf("lookup(%s, %s, %v) = %s, want %s", tt.network, tt.url, tt.all, got, tt.want)
+		}
+	}
+
+	if _, _, err := r.lookup("ip4", "v6.example.test", false); err == nil ||
+		err.Error() != "error lookup(): no ip4 address found for v6.example.test" {
+		t.Errorf("lookup(ip4) of a name without A record = %v", err)
+	}
+	if _, _, err := r.lookup("ip", "missing.example.test", false); err == nil {
+		t.Errorf("lookup() of a name without records succeeded")
+	}
+}
+
+func TestParseConfigDNSServer(t *testing.T) {
+	dns := newDNSServer(t, map[string][]string{
+		"a.example.test": {"192.0.2.1"},
+		"b.example.test": {"192.0.2.1", "192.0.2.2"},
+	})
+	defer dns.close()
+
+	conf, err := ParseConfigBytes([]byte("app:\n  p:\n    dns_server: " + dns.addr() + "\n    dns_timeout: 2s\n" +
+		"    ips: 192.0.2.9\n    urls: a.example.test b.example.test\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conf.PingClientsConf[0]
+	if c.Resolver == nil || c.Resolver.Server != dns.addr() || c.Resolver.Timeout != 2*time.Second {
+		t.Fatalf("Resolver = %+v, want the dns_server of the config", c.Resolver)
+	}
+	// both urls resolve to 192.0.2.1 first, which is pinged once for them
+	if got := ipStrings(c.IPs); got != "192.0.2.9 192.0.2.1" {
+		t.Errorf("IPs %s, want 192.0.2.9 192.0.2.1", got)
+	}
+	if got := strings.Join(c.IPToURL["192.0.2.1"], " "); got != "a.example.test b.example.test" {
+		t.Errorf("IPToURL[192.0.2.1] = %s, want both urls", got)
+	}
+
+	p := NewPingClientWithConfig(c)
+	for _, s := range p.StatisticsPerURL() {
+		if s.DNSLookups != 1 || s.DNSFailures != 0 || s.DNSError != "" {
+			t.Errorf("%s: %d lookups, %d failures, error %q; want the lookup of the config", s.URL, s.DNSLookups, s.DNSFailures, s.DNSError)
+		}
+	}
+
+	_, err = ParseConfigBytes([]byte("app:\n  p:\n    dns_server: " + dns.addr() + "\n    urls:\n      - a.example.test\n      - missing.example.test\n"))
+	if want := "error ParseConfig(): line 6, column 9: can not resolve the IP address of url missing.example.test"; err == nil || err.Error() != want {
+		t.Errorf("ParseConfigBytes() with an unknown url = %v, want %q", err, want)
+	}
+}
+
+func TestParseConfigNetwork(t *testing.T) {
+	dns := newDNSServer(t, map[string][]string{"both.example.test": {"192.0.2.1", "2001:db8::1"}})
+	defer dns.close()
+
+	for network, want := range map[string]string{
+		"ip":   "192.0.2.1",
+		"IP6":  "2001:db8::1",
+		"dual": "192.0.2.1 2001:db8::1",
+	} {
+		conf, err := ParseConfigBytes([]byte("app:\n  p:\n    dns_server: " + dns.addr() + "\n    network: " + network + "\n    urls: both.example.test\n"))
+		if err != nil {
+			t.Errorf("network %s: %s", network, err)
+			continue
+		}
+		c := conf.PingClientsConf[0]
+		if got := ipStrings(c.IPs); got != want {
+			t.Errorf("network %s: IPs %s, want %s", network, got, want)
+		}
+		if p := NewPingClientWithConfig(c); p.Network() != strings.ToLower(network) {
+			t.Errorf("network %s: PingClient network %s", network, p.Network())
+		}
+	}
+}
+
+func TestResolveInterval(t *testing.T) {
+	dns := newDNSServer(t, map[string][]string{"moving.example.test": {"192.0.2.1"}})
+	defer dns.close()
+
+	sim := NewSimNetwork(1)
+	sim.Default = &SimLink{Latency: time.Millisecond}
+	p := newSimClient(t, sim)
+	p.Resolver = &DNSResolver{Server: dns.addr(), Timeout: 2 * time.Second}
+	p.ResolveInterval = 10 * time.Millisecond
+	if err := p.Add("moving.example.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan *TargetChange, 10)
+	p.OnTargetChange = func(c *TargetChange) { changes <- c }
+	p.OnRecv = func(pkt *Packet) {
+		// move the url once its first address answered
+		if pkt.IP == "192.0.2.1" {
+			dns.set("moving.example.test", "192.0.2.2")
+		}
+	}
+	runFor(t, p, 150*time.Millisecond)
+
+	select {
+	case c := <-changes:
+		if c.URL != "moving.example.test" || ipStrings(c.Added) != "192.0.2.2" || ipStrings(c.Removed) != "192.0.2.1" {
+			t.Errorf("OnTargetChange(%s, added %s, removed %s), want 192.0.2.1 replaced by 192.0.2.2",
+				c.URL, ipStrings(c.Added), ipStrings(c.Removed))
+		}
+	default:
+		t.Fatalf("OnTargetChange not called")
+	}
+	if sim.Sent("192.0.2.2") == 0 {
+		t.Errorf("the new address of the url was not pinged")
+	}
+
+	// the statistics of the old address still count towards the url
+	stats := p.StatisticsPerURL()
+	if len(stats) != 1 {
+		t.Fatalf("StatisticsPerURL() returned %d statistics, want 1", len(stats))
+	}
+	if got := strings.Join(stats[0].IPs, " "); got != "192.0.2.2 192.0.2.1" {
+		t.Errorf("url IPs %s, want the current address, then the old one", got)
+	}
+	if sent := sim.Sent("192.0.2.1") + sim.Sent("192.0.2.2"); stats[0].PacketsSent != sent {
+		t.Errorf("url sent %d packets, want %d", stats[0].PacketsSent, sent)
+	}
+	if stats[0].DNSLookups < 2 || dns.queried("moving.example.test") < 2 {
+		t.Errorf("%d lookups, %d queries; want the url resolved again", stats[0].DNSLookups, dns.queried("moving.example.test"))
+	}
+}
+
+func TestUpdateTargets(t *testing.T) {
+	p := newSimClient(t, NewSimNetwork(1), "localhost")
+	p.initPacketsConfig()
+	sentTo127 := p.PacketsSent["127.0.0.1"]
+
+	// a failed lookup leaves the url alone
+	if changes := p.updateTargets(map[string][]*net.IPAddr{}, true, true); len(changes) != 0 {
+		t.Errorf("updateTargets() without lookups = %v, want no changes", changes)
+	}
+	// the address pinged so far is kept while the url still resolves to it
+	resolved := map[string][]*net.IPAddr{"localhost": {{IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}}}
+	if changes := p.updateTargets(resolved, true, true); len(changes) != 0 {
+		t.Errorf("updateTargets() with the current address = %v, want no changes", changes)
+	}
+
+	resolved = map[string][]*net.IPAddr{"localhost": {{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.2")}}}
+	changes := p.updateTargets(resolved, true, false)
+	if len(changes) != 1 {
+		t.Fatalf("updateTargets() = %d changes, want 1", len(changes))
+	}
+	if c := changes[0]; c.URL != "localhost" || ipStrings(c.Added) != "127.0.0.2" || ipStrings(c.Removed) != "127.0.0.1" {
+		t.Errorf("change of %s: added %s, removed %s; want 127.0.0.1 replaced by 127.0.0.2, without IPv6", c.URL, ipStrings(c.Added), ipStrings(c.Removed))
+	}
+	if ipStrings(p.IPs) != "127.0.0.2" {
+		t.Errorf("IPs = %s, want 127.0.0.2", ipStrings(p.IPs))
+	}
+	// the statistics of the old address still count towards the url
+	if _, ok := p.PacketsSent["127.0.0.1"]; !ok || p.PacketsSent["127.0.0.1"] != sentTo127 {
+		t.Errorf("the statistics of 127.0.0.1 were dropped")
+	}
+	if s := p.StatisticsPerURL(); len(s) != 1 || strings.Join(s[0].IPs, " ") != "127.0.0.2 127.0.0.1" {
+		t.Errorf("StatisticsPerURL() = %v, want localhost with the current address, then the old one", s)
+	}
+}
+
+func TestUpdateTargetsLiteralIP(t *testing.T) {
+	p := newSimClient(t, NewSimNetwork(1), "127.0.0.1", "localhost")
+	p.initPacketsConfig()
+	if urls := p.IPToURL["127.0.0.1"]; len(urls) != 1 || urls[0] != "localhost" {
+		t.Fatalf("IPToURL[127.0.0.1] = %v, want localhost", urls)
+	}
+
+	// the ip given as such is still pinged once the url moves away from it
+	resolved := map[string][]*net.IPAddr{"localhost": {{IP: net.ParseIP("127.0.0.2")}}}
+	changes := p.updateTargets(resolved, true, true)
+	if len(changes) != 1 || ipStrings(changes[0].Removed) != "127.0.0.1" {
+		t.Fatalf("updateTargets() = %v, want 127.0.0.1 removed from localhost", changes)
+	}
+	if ipStrings(p.IPs) != "127.0.0.1 127.0.0.2" {
+		t.Errorf("IPs = %s, want 127.0.0.1 127.0.0.2", ipStrings(p.IPs))
+	}
+	if _, ok := p.targets["127.0.0.1"]; !ok {
+		t.Errorf("127.0.0.1 is no longer pinged")
+	}
+}
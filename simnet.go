@@ -0,0 +1,339 @@
+package pingclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const simInboxLength = 1024
+
+var errSimClosed = errors.New("use of closed simulated connection")
+
+// SimNetwork is an in-memory Transport that answers echo requests according
+// to scripted per-destination links. All random decisions (jitter, loss,
+// duplication, reordering) come from a seeded source, so a PingClient run
+// against a SimNetwork is reproducible.
+//
+//	sim := ping.NewSimNetwork(1)
+//	sim.SetLink("10.0.0.1", &ping.SimLink{Latency: 20 * time.Millisecond, Loss: 0.1})
+//	pingClient := ping.New()
+//	pingClient.Transport = sim
+//	pingClient.Add("10.0.0.1")
+type SimNetwork struct {
+	// Default is used for destinations without a link of their own.
+	// If nil, such destinations never reply.
+	Default *SimLink
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	links map[string]*SimLink
+	sent  map[string]int
+}
+
+// SimLink describes how a simulated destination answers echo requests.
+type SimLink struct {
+	// Latency is the round-trip time of a reply.
+	Latency time.Duration
+
+	// Jitter adds a uniformly distributed delay in [0, Jitter) to Latency.
+	Jitter time.Duration
+
+	// Loss is the probability (0 to 1) that a request is never answered.
+	Loss float64
+
+	// Duplicate is the probability (0 to 1) that a reply is delivered twice.
+	Duplicate float64
+
+	// Reorder is the probability (0 to 1) that a reply is held back by
+	// ReorderDelay, so that later replies overtake it.
+	Reorder float64
+
+	// ReorderDelay is the extra delay of a reordered reply.
+	// Default is two times Latency.
+	ReorderDelay time.Duration
+
+	// TTL is the TTL (or hop limit) reported for replies. Default is 64.
+	TTL int
+
+	// Error, if set, makes the link answer requests with an ICMP error
+	// message of this type instead of an echo reply.
+	Error ICMPErrorType
+
+	// ErrorCode is the ICMP code of the error messages, e.g. 13
+	// (administratively prohibited) for an ICMPUnreachable Error over IPv4.
+	ErrorCode int
+
+	// ErrorFrom is the address the error messages come from.
+	// Default is the destination itself.
+	ErrorFrom string
+}
+
+// NewSimNetwork returns an empty SimNetwork whose random decisions are drawn
+// from seed.
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		rand:  rand.New(rand.NewSource(seed)),
+		links: make(map[string]*SimLink),
+		sent:  make(map[string]int),
+	}
+}
+
+// SetLink scripts how destination ip answers echo requests.
+// A nil link makes the destination fall back to Default.
+func (s *SimNetwork) SetLink(ip string, link *SimLink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := simKey(ip)
+	if link == nil {
+		delete(s.links, key)
+		return
+	}
+	s.links[key] = link
+}
+
+// Sent returns the number of echo requests written to destination ip.
+func (s *SimNetwork) Sent(ip string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent[simKey(ip)]
+}
+
+// simKey returns the key of destination ip, with its zone like the IPs of
+// PingClient
+func simKey(ip string) string {
+	if ipAddr := parseIPAddr(ip); ipAddr != nil {
+		return ipAddr.String()
+	}
+	return ip
+}
+
+// Listen implements Transport.
+func (s *SimNetwork) Listen(netProto string, source string) (PacketConn, error) {
+	c := &simConn{
+		network: s,
+		inbox:   make(chan *packet, simInboxLength),
+		closed:  make(chan struct{}),
+	}
+	switch netProto {
+	case ipv4Proto["icmp"], ipv4Proto["udp"]:
+		c.proto = protocolICMP
+	case ipv6Proto["icmp"], ipv6Proto["udp"]:
+		c.proto = protocolIPv6ICMP
+	default:
+		return nil, &net.OpError{Op: "listen", Net: netProto, Err: net.UnknownNetworkError(netProto)}
+	}
+	c.udp = netProto == ipv4Proto["udp"] || netProto == ipv6Proto["udp"]
+	return c, nil
+}
+
+// schedule decides the fate of an echo request sent to ip and returns the
+// link it takes and the delays after which its reply should be delivered
+// (none if it is lost).
+func (s *SimNetwork) schedule(ip string) (*SimLink, []time.Duration, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[ip]++
+
+	link, ok := s.links[ip]
+	if !ok {
+		link = s.Default
+	}
+	if link == nil || s.rand.Float64() < link.Loss {
+		return link, nil, 0
+	}
+
+	delay := link.Latency
+	if link.Jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(link.Jitter)))
+	}
+	if s.rand.Float64() < link.Reorder {
+		if link.ReorderDelay > 0 {
+			delay += link.ReorderDelay
+		} else {
+			delay += 2 * link.Latency
+		}
+	}
+	delays := []time.Duration{delay}
+	if s.rand.Float64() < link.Duplicate {
+		delays = append(delays, delay)
+	}
+
+	ttl := link.TTL
+	if ttl == 0 {
+		ttl = 64
+	}
+	return link, delays, ttl
+}
+
+// simConn is a PacketConn opened on a SimNetwork
+type simConn struct {
+	network *SimNetwork
+	proto   int
+	udp     bool
+	inbox   chan *packet
+
+	mu       sync.Mutex
+	deadline time.Time
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (c *simConn) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-c.closed:
+		return 0, 0, nil, &net.OpError{Op: "read", Net: "sim", Err: errSimClosed}
+	case <-timeout:
+		return 0, 0, nil, &net.OpError{Op: "read", Net: "sim", Err: simTimeoutError{}}
+	case pkt := <-c.inbox:
+		n := copy(b, pkt.bytes)
+		return n, pkt.ttl, pkt.src, nil
+	}
+}
+
+func (c *simConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, &net.OpError{Op: "write", Net: "sim", Err: errSimClosed}
+	default:
+	}
+
+	ipStr, err := resolveIPFromAddr(dst)
+	if err != nil {
+		return 0, err
+	}
+	m, err := icmp.ParseMessage(c.proto, b)
+	if err != nil {
+		return 0, err
+	}
+	echo, ok := m.Body.(*icmp.Echo)
+	if !ok || (m.Type != ipv4.ICMPTypeEcho && m.Type != ipv6.ICMPTypeEchoRequest) {
+		// only echo requests are answered
+		return len(b), nil
+	}
+
+	link, delays, ttl := c.network.schedule(ipStr)
+	if len(delays) == 0 {
+		return len(b), nil
+	}
+
+	srcAddr := parseIPAddr(ipStr)
+	msg := c.echoReply(echo)
+	if link.Error != 0 {
+		msg = c.errorMessage(link, srcAddr.IP, b)
+		if link.ErrorFrom != "" {
+			srcAddr = parseIPAddr(link.ErrorFrom)
+		}
+	}
+	reply, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var src net.Addr = srcAddr
+	if c.udp {
+		src = &net.UDPAddr{IP: srcAddr.IP, Zone: srcAddr.Zone}
+	}
+
+	for _, delay := range delays {
+		pkt := &packet{bytes: reply, nbytes: len(reply), src: src, ttl: ttl}
+		time.AfterFunc(delay, func() { c.deliver(pkt) })
+	}
+	return len(b), nil
+}
+
+func (c *simConn) echoReply(echo *icmp.Echo) *icmp.Message {
+	var typ icmp.Type = ipv4.ICMPTypeEchoReply
+	if c.proto == protocolIPv6ICMP {
+		typ = ipv6.ICMPTypeEchoReply
+	}
+	return &icmp.Message{Type: typ, Body: echo}
+}
+
+// errorMessage returns the ICMP error message link answers the echo request
+// req to dst with, quoting the request behind a minimal IP header
+func (c *simConn) errorMessage(link *SimLink, dst net.IP, req []byte) *icmp.Message {
+	var quoted []byte
+	if c.proto == protocolICMP {
+		quoted = make([]byte, ipv4HeaderMinLength)
+		quoted[0] = ipv4.Version<<4 | ipv4HeaderMinLength/4
+		binary.BigEndian.PutUint16(quoted[2:4], uint16(ipv4HeaderMinLength+len(req)))
+		quoted[8] = 64
+		quoted[9] = protocolICMP
+		copy(quoted[16:20], dst.To4())
+	} else {
+		quoted = make([]byte, ipv6HeaderLength)
+		quoted[0] = ipv6.Version << 4
+		binary.BigEndian.PutUint16(quoted[4:6], uint16(len(req)))
+		quoted[6] = protocolIPv6ICMP
+		quoted[7] = 64
+		copy(quoted[24:40], dst.To16())
+	}
+	quoted = append(quoted, req...)
+
+	msg := &icmp.Message{Code: link.ErrorCode}
+	switch link.Error {
+	case ICMPTimeExceeded:
+		msg.Type, msg.Body = ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quoted}
+		if c.proto == protocolIPv6ICMP {
+			msg.Type = ipv6.ICMPTypeTimeExceeded
+		}
+	case ICMPParameterProblem:
+		msg.Type, msg.Body = ipv4.ICMPTypeParameterProblem, &icmp.ParamProb{Data: quoted}
+		if c.proto == protocolIPv6ICMP {
+			msg.Type = ipv6.ICMPTypeParameterProblem
+		}
+	default:
+		msg.Type, msg.Body = ipv4.ICMPTypeDestinationUnreachable, &icmp.DstUnreach{Data: quoted}
+		if c.proto == protocolIPv6ICMP {
+			msg.Type = ipv6.ICMPTypeDestinationUnreachable
+		}
+	}
+	return msg
+}
+
+func (c *simConn) deliver(pkt *packet) {
+	select {
+	case <-c.closed:
+	case c.inbox <- pkt:
+	default:
+		// inbox is full, the reply is dropped like on a congested socket
+	}
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *simConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// simTimeoutError reports a read deadline expiry on a simConn
+type simTimeoutError struct{}
+
+func (simTimeoutError) Error() string   { return "i/o timeout" }
+func (simTimeoutError) Timeout() bool   { return true }
+func (simTimeoutError) Temporary() bool { return true }
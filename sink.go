@@ -0,0 +1,319 @@
+package pingclient
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSinkStatsInterval is how often a ping client of the config file
+// with sinks pushes statistics, unless stats_interval is set
+const defaultSinkStatsInterval = 10 * time.Second
+
+// Sink receives the events of a PingClient, e.g. to push them to a metrics
+// backend. Built-in sinks are InfluxSink and StatsDSink, see AddSink.
+//
+// The methods are called from the goroutine running the PingClient, they
+// should not block for long. The errors they return are passed to
+// PingClient.OnSinkError.
+type Sink interface {
+	// Received is called with every echo reply, duplicates included.
+	Received(e *PacketEvent) error
+
+	// Lost is called with every echo request without reply: it timed out
+	// or an ICMP error message came back.
+	Lost(e *PacketEvent) error
+
+	// Stats is called every StatsInterval while PingClient runs, and when it
+	// finishes, with the cumulative statistics per IP.
+	Stats(stats []*Statistics) error
+
+	// Flush sends the events buffered. It is called when PingClient
+	// finishes.
+	Flush() error
+
+	// Close releases the connections of the sink. It is called after
+	// Flush when PingClient finishes; if it runs again, the sink is fed
+	// again and should reconnect.
+	Close() error
+}
+
+// PacketEvent is a packet received or lost by a PingClient.
+type PacketEvent struct {
+	// Time is when the reply was received or the request was found lost.
+	Time time.Time
+
+	// Client is the name of the PingClient.
+	Client string
+
+	// URL are the URLs resolving to IP, separated by spaces, empty for IPs
+	// added as such.
+	URL string
+
+	// IP address in string format e.g "142.250.71.78"
+	IP string
+
+	// Seq is the ICMP sequence number.
+	Seq int
+
+	// Rtt, Bytes and TTL are those of the reply, zero for lost packets.
+	Rtt   time.Duration
+	Bytes int
+	TTL   int
+
+	// Status is ok, duplicate or late for received packets, timeout, unreachable,
+	// time_exceeded or parameter_problem for lost ones.
+	Status string
+}
+
+// AddSink feeds s with the events of the PingClient. It must be called
+// before Run. Sinks set in the config file are added by
+// NewPingClientWithConfig. The sinks are closed when PingClient finishes.
+func (p *PingClient) AddSink(s Sink) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sinks = append(p.sinks, s)
+}
+
+// packetEvent returns the event of a packet to ip
+func (p *PingClient) packetEvent(ip string, seq int, status string) *PacketEvent {
+	return &PacketEvent{
+		Time:   time.Now(),
+		Client: p.Name,
+		URL:    strings.Join(p.urlsOf(ip), " "),
+		IP:     ip,
+		Seq:    seq,
+		Status: status,
+	}
+}
+
+// sinkReceived feeds the sinks with a received packet
+func (p *PingClient) sinkReceived(pkt *Packet) {
+	if len(p.sinks) == 0 {
+		return
+	}
+	status := packetStatus(pkt)
+	e := p.packetEvent(pkt.IP, pkt.Seq, status)
+	e.Rtt, e.Bytes, e.TTL = pkt.Rtt, pkt.Nbytes, pkt.Ttl
+	for _, s := range p.sinks {
+		p.sinkError(s.Received(e))
+	}
+}
+
+// packetStatus is the status of a received packet, see PacketEvent
+func packetStatus(pkt *Packet) string {
+	switch {
+	case pkt.Duplicate:
+		return "duplicate"
+	case pkt.Late:
+		return "late"
+	}
+	return "ok"
+}
+
+// sinkLost feeds the sinks with a lost packet
+func (p *PingClient) sinkLost(ip string, seq int, status string) {
+	if len(p.sinks) == 0 {
+		return
+	}
+	e := p.packetEvent(ip, seq, status)
+	for _, s := range p.sinks {
+		p.sinkError(s.Lost(e))
+	}
+}
+
+// sinkStats feeds the sinks with statistics, and flushes and closes them
+// once PingClient finishes
+func (p *PingClient) sinkStats(stats []*Statistics, finished bool) {
+	for _, s := range p.sinks {
+		p.sinkError(s.Stats(stats))
+		if finished {
+			p.sinkError(s.Flush())
+			p.sinkError(s.Close())
+		}
+	}
+}
+
+func (p *PingClient) sinkError(err error) {
+	if handler := p.OnSinkError; err != nil && handler != nil {
+		handler(err)
+	}
+}
+
+// lostStatus is the status of a packet an ICMP error message came back for
+func lostStatus(icmpErr *ICMPError) string {
+	switch icmpErr.Type {
+	case ICMPTimeExceeded:
+		return "time_exceeded"
+	case ICMPParameterProblem:
+		return "parameter_problem"
+	}
+	return "unreachable"
+}
+
+// SinkConfig configures a built-in Sink of a PingClient in the config file.
+type SinkConfig struct {
+	// Type is influxdb or statsd.
+	Type string
+
+	// Address is where metrics are pushed. For influxdb, the URL of the
+	// write endpoint, e.g.
+	// "http://localhost:8086/api/v2/write?org=o&bucket=b", or
+	// "udp://host:8089". For statsd, "host:port".
+	Address string
+
+	// Token authenticates the writes of an influxdb sink over http.
+	Token string
+
+	// Measurement is the name of the influxdb measurements, "ping" by
+	// default.
+	Measurement string
+
+	// Prefix of the statsd metrics, "pingclient." by default.
+	Prefix string
+
+	// DogStatsD tags the statsd metrics with client, url and ip the
+	// DogStatsD way, instead of putting them in the metric names.
+	DogStatsD bool
+}
+
+// NewSink returns the built-in Sink c configures.
+func NewSink(c *SinkConfig) (Sink, error) {
+	switch c.Type {
+	case "influxdb":
+		return NewInfluxSink(c.Address, c.Token, c.Measurement)
+	case "statsd":
+		return NewStatsDSink(c.Address, c.Prefix, c.DogStatsD)
+	}
+	return nil, fmt.Errorf("error NewSink(): sink type %s should be influxdb or statsd", c.Type)
+}
+
+// maxDatagram keeps the datagrams of the sinks within a common MTU
+const maxDatagram = 1432
+
+// udpWriter writes datagrams to an address from a goroutine of its own,
+// dialed on the first datagram so that a DNS hiccup doesn't prevent setting
+// up a sink, nor a slow lookup block the PingClient writing
+type udpWriter struct {
+	address string
+
+	mu sync.Mutex
+	// queue of the datagrams to write, nil until the first write and after
+	// close; done is closed once the goroutine draining queue returned
+	queue chan []byte
+	done  chan struct{}
+	// err of the goroutine, returned by the next call
+	err error
+}
+
+const (
+	// udpQueueSize is how many datagrams wait to be written before the
+	// next ones are dropped
+	udpQueueSize = 64
+	// udpRedialInterval is how long the datagrams are dropped after a
+	// failed dial before dialing again
+	udpRedialInterval = 5 * time.Second
+)
+
+// close writes the datagrams queued and closes the connection, a later
+// write dials again
+func (u *udpWriter) close() error {
+	u.mu.Lock()
+	queue, done := u.queue, u.done
+	u.queue = nil
+	u.mu.Unlock()
+	if queue != nil {
+		close(queue)
+		<-done
+	}
+	return u.takeErr()
+}
+
+// writeLines queues lines separated by newlines, in as few datagrams of at
+// most maxDatagram bytes as possible. It doesn't wait for them to be
+// written, the error of an earlier write is returned.
+func (u *udpWriter) writeLines(lines []string) error {
+	datagrams := make([][]byte, 0, 1)
+	var datagram strings.Builder
+	for _, line := range lines {
+		if datagram.Len() > 0 && datagram.Len()+1+len(line) > maxDatagram {
+			datagrams = append(datagrams, []byte(datagram.String()))
+			datagram.Reset()
+		}
+		if datagram.Len() > 0 {
+			datagram.WriteByte('\n')
+		}
+		datagram.WriteString(line)
+	}
+	if datagram.Len() > 0 {
+		datagrams = append(datagrams, []byte(datagram.String()))
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.queue == nil {
+		u.queue = make(chan []byte, udpQueueSize)
+		u.done = make(chan struct{})
+		go u.run(u.queue, u.done)
+	}
+	err := u.err
+	u.err = nil
+	for i, d := range datagrams {
+		select {
+		case u.queue <- d:
+		default:
+			if err == nil {
+				err = fmt.Errorf("%d datagrams to %s dropped, too many waiting", len(datagrams)-i, u.address)
+			}
+			return err
+		}
+	}
+	return err
+}
+
+// run writes the datagrams of queue until it is closed, dialing the address
+// first, and again at most every udpRedialInterval while it fails
+func (u *udpWriter) run(queue chan []byte, done chan struct{}) {
+	defer close(done)
+	var conn net.Conn
+	var lastDial time.Time
+	for d := range queue {
+		if conn == nil {
+			if !lastDial.IsZero() && time.Since(lastDial) < udpRedialInterval {
+				continue
+			}
+			lastDial = time.Now()
+			c, err := net.Dial("udp", u.address)
+			if err != nil {
+				u.setErr(err)
+				continue
+			}
+			conn = c
+		}
+		if _, err := conn.Write(d); err != nil {
+			u.setErr(err)
+		}
+	}
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			u.setErr(err)
+		}
+	}
+}
+
+func (u *udpWriter) setErr(err error) {
+	u.mu.Lock()
+	u.err = err
+	u.mu.Unlock()
+}
+
+// takeErr returns the error of the goroutine, once
+func (u *udpWriter) takeErr() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	err := u.err
+	u.err = nil
+	return err
+}
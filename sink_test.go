@@ -0,0 +1,401 @@
+package pingclient
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenUDP returns a local udp socket sinks can write to
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readDatagrams reads n datagrams from conn and returns their lines
+func readDatagrams(t *testing.T, conn net.PacketConn, n int) []string {
+	t.Helper()
+	lines := make([]string, 0)
+	buf := make([]byte, 64*1024)
+	for i := 0; i < n; i++ {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		size, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("datagram %d of %d: %s", i+1, n, err)
+		}
+		lines = append(lines, strings.Split(string(buf[:size]), "\n")...)
+	}
+	return lines
+}
+
+// testEvent returns a PacketEvent of a reply with fixed values
+func testEvent(status string) *PacketEvent {
+	return &PacketEvent{
+		Time:   time.Unix(1600000000, 5),
+		Client: "lab",
+		URL:    "example.com",
+		IP:     "10.0.0.1",
+		Seq:    7,
+		Rtt:    5210 * time.Microsecond,
+		Bytes:  24,
+		TTL:    64,
+		Status: status,
+	}
+}
+
+// testStats returns Statistics with fixed values
+func testStats() []*Statistics {
+	return []*Statistics{{
+		Name:        "lab",
+		URL:         "example.com",
+		URLs:        []string{"example.com", "www.example.com"},
+		IP:          "10.0.0.1",
+		PacketsSent: 4,
+		PacketsRecv: 3,
+		PacketLoss:  25,
+		Duplicates:  1,
+		MinRtt:      time.Millisecond,
+		AvgRtt:      2 * time.Millisecond,
+		MaxRtt:      3 * time.Millisecond,
+		StdDevRtt:   500 * time.Microsecond,
+		P50Rtt:      2 * time.Millisecond,
+		P90Rtt:      3 * time.Millisecond,
+		P99Rtt:      3 * time.Millisecond,
+		Jitter:      250 * time.Microsecond,
+	}}
+}
+
+func TestStatsDSink(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+	s, err := NewStatsDSink(conn.LocalAddr().String(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Received(testEvent("ok")); err != nil {
+		t.Fatal(err)
+	}
+	// duplicates are not counted as received
+	if err := s.Received(testEvent("duplicate")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Lost(testEvent("timeout")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stats(testStats()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"pingclient.lab.10_0_0_1.packets.received:1|c",
+		"pingclient.lab.10_0_0_1.rtt:5.210|ms",
+		"pingclient.lab.10_0_0_1.packets.lost:1|c",
+		"pingclient.lab.10_0_0_1.packets_sent:4|g",
+		"pingclient.lab.10_0_0_1.packets_recv:3|g",
+		"pingclient.lab.10_0_0_1.packet_loss:25|g",
+		"pingclient.lab.10_0_0_1.avg_rtt:2.000|g",
+		"pingclient.lab.10_0_0_1.min_rtt:1.000|g",
+		"pingclient.lab.10_0_0_1.max_rtt:3.000|g",
+		"pingclient.lab.10_0_0_1.stddev_rtt:0.500|g",
+		"pingclient.lab.10_0_0_1.jitter:0.250|g",
+	}
+	if got := readDatagrams(t, conn, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("statsd lines:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStatsDSinkDogStatsD(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+	s, err := NewStatsDSink(conn.LocalAddr().String(), "ping.", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	e := testEvent("ok")
+	e.URL = "example.com www.example.com"
+	if err := s.Received(e); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ping.packets.received:1|c|#client:lab,url:example.com_www.example.com,ip:10.0.0.1",
+		"ping.rtt:5.210|ms|#client:lab,url:example.com_www.example.com,ip:10.0.0.1",
+	}
+	if got := readDatagrams(t, conn, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("dogstatsd lines:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStatsDSinkCloseRedials(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+	s, err := NewStatsDSink(conn.LocalAddr().String(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Lost(testEvent("timeout")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close(): %s", err)
+	}
+	// a sink fed again after Close, by a PingClient run again, reconnects
+	if err := s.Lost(testEvent("timeout")); err != nil {
+		t.Fatalf("Lost() after Close(): %s", err)
+	}
+	defer s.Close()
+	readDatagrams(t, conn, 2)
+}
+
+func TestUDPWriterSplitsDatagrams(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+	u := &udpWriter{address: conn.LocalAddr().String()}
+	defer u.close()
+
+	line := strings.Repeat("x", 600)
+	if err := u.writeLines([]string{line, line, line}); err != nil {
+		t.Fatal(err)
+	}
+	// two lines and their newline fit in maxDatagram, three don't
+	buf := make([]byte, 64*1024)
+	for _, want := range []int{2*len(line) + 1, len(line)} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want || n > maxDatagram {
+			t.Errorf("datagram of %d bytes, want %d", n, want)
+		}
+	}
+}
+
+func TestUDPWriterDialError(t *testing.T) {
+	u := &udpWriter{address: "127.0.0.1:-1"}
+	defer u.close()
+
+	// the dial fails in the background, its error comes with a later write
+	if err := u.writeLines([]string{"a"}); err != nil {
+		t.Fatalf("first writeLines(): %s, want the dial left to the background", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if err := u.writeLines([]string{"b"}); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no dial error reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInfluxSinkUDP(t *testing.T) {
+	conn := listenUDP(t)
+	defer conn.Close()
+	s, err := NewInfluxSink("udp://"+conn.LocalAddr().String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	e := testEvent("ok")
+	e.Client = "lab 1"
+	if err := s.Received(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Lost(testEvent("timeout")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`ping,client=lab\ 1,url=example.com,ip=10.0.0.1,status=ok seq=7i,rtt_ms=5.210,ttl=64i,bytes=24i 1600000000000000005`,
+		`ping,client=lab,url=example.com,ip=10.0.0.1,status=timeout seq=7i 1600000000000000005`,
+	}
+	if got := readDatagrams(t, conn, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("influx lines:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if err := s.Stats(testStats()); err != nil {
+		t.Fatal(err)
+	}
+	got := readDatagrams(t, conn, 1)
+	prefix := "ping_stats,client=lab,url=example.com\\ www.example.com,ip=10.0.0.1 packets_sent=4i,packets_recv=3i,packet_loss=25,duplicates=1i," +
+		"min_rtt_ms=1.000,avg_rtt_ms=2.000,max_rtt_ms=3.000,stddev_rtt_ms=0.500,p50_rtt_ms=2.000,p90_rtt_ms=3.000,p99_rtt_ms=3.000,jitter_ms=0.250 "
+	if len(got) != 1 || !strings.HasPrefix(got[0], prefix) {
+		t.Errorf("influx statistics lines:\n%s\nwant:\n%s<timestamp>", strings.Join(got, "\n"), prefix)
+	}
+}
+
+// influxServer records the writes to an InfluxDB write endpoint
+type influxServer struct {
+	mu     sync.Mutex
+	bodies []string
+	auth   []string
+	status int
+}
+
+func (s *influxServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies = append(s.bodies, string(body))
+	s.auth = append(s.auth, r.Header.Get("Authorization"))
+	if s.status != 0 {
+		http.Error(w, "bucket not found", s.status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestInfluxSinkHTTP(t *testing.T) {
+	influx := &influxServer{}
+	srv := httptest.NewServer(influx)
+	defer srv.Close()
+
+	s, err := NewInfluxSink(srv.URL+"/api/v2/write?org=o&bucket=b", "secret", "rtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// packets are buffered until Flush
+	if err := s.Received(testEvent("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Received(testEvent("duplicate")); err != nil {
+		t.Fatal(err)
+	}
+	influx.mu.Lock()
+	writes := len(influx.bodies)
+	influx.mu.Unlock()
+	if writes != 0 {
+		t.Fatalf("%d writes before Flush, want none", writes)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	influx.mu.Lock()
+	defer influx.mu.Unlock()
+	want := "rtt,client=lab,url=example.com,ip=10.0.0.1,status=ok seq=7i,rtt_ms=5.210,ttl=64i,bytes=24i 1600000000000000005\n" +
+		"rtt,client=lab,url=example.com,ip=10.0.0.1,status=duplicate seq=7i,rtt_ms=5.210,ttl=64i,bytes=24i 1600000000000000005\n"
+	if len(influx.bodies) != 1 || influx.bodies[0] != want {
+		t.Errorf("writes %q, want %q", influx.bodies, want)
+	}
+	if len(influx.auth) != 1 || influx.auth[0] != "Token secret" {
+		t.Errorf("Authorization %q, want Token secret", influx.auth)
+	}
+}
+
+func TestInfluxSinkHTTPError(t *testing.T) {
+	influx := &influxServer{status: http.StatusNotFound}
+	srv := httptest.NewServer(influx)
+	defer srv.Close()
+
+	s, err := NewInfluxSink(srv.URL+"/api/v2/write?bucket=missing", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Lost(testEvent("timeout")); err != nil {
+		t.Fatal(err)
+	}
+	err = s.Flush()
+	if want := "error InfluxSink: 404 Not Found: bucket not found"; err == nil || err.Error() != want {
+		t.Errorf("Flush() = %v, want %q", err, want)
+	}
+}
+
+func TestNewSinkErrors(t *testing.T) {
+	tests := []struct {
+		conf *SinkConfig
+		want string
+	}{
+		{&SinkConfig{Type: "graphite", Address: "localhost:2003"}, "error NewSink(): sink type graphite should be influxdb or statsd"},
+		{&SinkConfig{Type: "statsd", Address: "localhost"}, "error NewStatsDSink(): address localhost should be host:port"},
+		{&SinkConfig{Type: "influxdb", Address: "localhost:8086"}, "error NewInfluxSink(): address localhost:8086 should be like"},
+		{&SinkConfig{Type: "influxdb", Address: "tcp://localhost:8086"}, "error NewInfluxSink(): address tcp://localhost:8086 should be http, https or udp"},
+		{&SinkConfig{Type: "influxdb", Address: "udp://localhost"}, "error NewInfluxSink(): address udp://localhost should have a port"},
+	}
+	for _, tt := range tests {
+		if _, err := NewSink(tt.conf); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("NewSink(%+v) = %v, want %q", tt.conf, err, tt.want)
+		}
+	}
+}
+
+// recordingSink records the calls of a PingClient
+type recordingSink struct {
+	mu    sync.Mutex
+	calls []string
+	recv  int
+	lost  int
+}
+
+func (s *recordingSink) record(call string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.calls); n == 0 || s.calls[n-1] != call {
+		s.calls = append(s.calls, call)
+	}
+	return nil
+}
+
+func (s *recordingSink) Received(e *PacketEvent) error {
+	s.mu.Lock()
+	s.recv++
+	s.mu.Unlock()
+	return s.record("received")
+}
+
+func (s *recordingSink) Lost(e *PacketEvent) error {
+	s.mu.Lock()
+	s.lost++
+	s.mu.Unlock()
+	return s.record("lost")
+}
+
+func (s *recordingSink) Stats(stats []*Statistics) error { return s.record("stats") }
+func (s *recordingSink) Flush() error                    { return s.record("flush") }
+func (s *recordingSink) Close() error                    { return s.record("close") }
+
+func TestPingClientSinks(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: time.Millisecond})
+	sim.SetLink("10.0.0.2", &SimLink{Loss: 1})
+	p := newSimClient(t, sim, "10.0.0.1", "10.0.0.2")
+	p.ReplyTimeout = 10 * time.Millisecond
+	s := &recordingSink{}
+	p.AddSink(s)
+	runFor(t, p, 50*time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if recv := statsOf(t, p, "10.0.0.1").PacketsRecv; s.recv != recv {
+		t.Errorf("Received called %d times, want %d", s.recv, recv)
+	}
+	if s.lost == 0 || s.lost > statsOf(t, p, "10.0.0.2").PacketsSent {
+		t.Errorf("Lost called %d times, want once per request of 10.0.0.2 timed out", s.lost)
+	}
+	// the sink is closed once, after the final statistics
+	if n := len(s.calls); n < 3 || !reflect.DeepEqual(s.calls[n-3:], []string{"stats", "flush", "close"}) {
+		t.Errorf("calls %v, want them to end with stats, flush and close", s.calls)
+	}
+}
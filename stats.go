@@ -0,0 +1,438 @@
+package pingclient
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// sketchAccuracy is the relative error of percentiles read from rttSketch
+	sketchAccuracy = 0.01
+	// sketchMaxBins bounds the memory of rttSketch, 1% accuracy needs about
+	// 1200 bins to cover 1µs to 1h
+	sketchMaxBins = 2048
+	// jitterGain is the 1/16 gain of the RFC 3550 interarrival jitter estimator
+	jitterGain = 16
+	// windowSlots is the number of slots a rolling window is divided into
+	windowSlots = 60
+)
+
+// DefaultHistogramBuckets are the upper bounds of the RTT histogram reported
+// in Statistics unless PingClient.HistogramBuckets is set.
+var DefaultHistogramBuckets = []time.Duration{
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// HistogramBucket is one bucket of the RTT histogram in Statistics.
+type HistogramBucket struct {
+	// UpperBound is the inclusive upper bound of the bucket. The last bucket
+	// of a histogram is unbounded and has UpperBound math.MaxInt64.
+	UpperBound time.Duration
+
+	// Count is the number of round-trip times greater than the previous
+	// bucket's UpperBound and not greater than this one's.
+	Count int
+}
+
+// WindowStatistics are the stats of the packets sent and received within
+// the last Window, as configured by PingClient.Windows.
+type WindowStatistics struct {
+	// Window is the length of the rolling window, e.g. 5m.
+	Window time.Duration
+
+	// PacketsRecv is the number of packets received within the window.
+	PacketsRecv int
+
+	// PacketsSent is the number of packets sent within the window.
+	PacketsSent int
+
+	// PacketLoss is the percentage of packets lost within the window.
+	// Packets sent moments ago whose reply is still in flight count as lost.
+	PacketLoss float64
+
+	// MinRtt is the minimum round-trip time within the window.
+	MinRtt time.Duration
+
+	// MaxRtt is the maximum round-trip time within the window.
+	MaxRtt time.Duration
+
+	// AvgRtt is the average round-trip time within the window.
+	AvgRtt time.Duration
+
+	// StdDevRtt is the standard deviation of the round-trip times within
+	// the window.
+	StdDevRtt time.Duration
+}
+
+// rttSketch is a streaming quantile sketch of round-trip times with
+// logarithmically sized bins (as in DDSketch). Any quantile it returns is
+// within sketchAccuracy of the true value, using bounded memory no matter how
+// many round-trip times are added.
+type rttSketch struct {
+	logGamma float64
+	bins     map[int]int
+	// rtts too small to take a logarithm of
+	zero  int
+	count int
+}
+
+func newRTTSketch() *rttSketch {
+	gamma := (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	return &rttSketch{
+		logGamma: math.Log(gamma),
+		bins:     make(map[int]int),
+	}
+}
+
+func (s *rttSketch) add(rtt time.Duration) {
+	s.count++
+	if rtt < 1 {
+		s.zero++
+		return
+	}
+	s.bins[s.index(rtt)]++
+	if len(s.bins) > sketchMaxBins {
+		s.collapse()
+	}
+}
+
+func (s *rttSketch) index(rtt time.Duration) int {
+	return int(math.Ceil(math.Log(float64(rtt)) / s.logGamma))
+}
+
+// value returns the representative round-trip time of bin i
+func (s *rttSketch) value(i int) time.Duration {
+	gamma := math.Exp(s.logGamma)
+	return time.Duration(2 * math.Pow(gamma, float64(i)) / (gamma + 1))
+}
+
+// collapse merges the two lowest bins, trading accuracy of the smallest
+// round-trip times for bounded memory
+func (s *rttSketch) collapse() {
+	keys := s.keys()
+	s.bins[keys[1]] += s.bins[keys[0]]
+	delete(s.bins, keys[0])
+}
+
+// merge adds the round-trip times of o to s
+func (s *rttSketch) merge(o *rttSketch) {
+	s.count += o.count
+	s.zero += o.zero
+	for i, n := range o.bins {
+		s.bins[i] += n
+	}
+	for len(s.bins) > sketchMaxBins {
+		s.collapse()
+	}
+}
+
+func (s *rttSketch) keys() []int {
+	keys := make([]int, 0, len(s.bins))
+	for k := range s.bins {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// quantile returns the q-quantile (0 <= q <= 1) of the added round-trip times
+func (s *rttSketch) quantile(q float64) time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+	rank := int(q * float64(s.count-1))
+	seen := s.zero
+	if rank < seen {
+		return 0
+	}
+	var i int
+	for _, i = range s.keys() {
+		seen += s.bins[i]
+		if rank < seen {
+			break
+		}
+	}
+	return s.value(i)
+}
+
+// welford keeps count, mean, variance, min and max of round-trip times
+// online, with Welford's algorithm
+type welford struct {
+	n    int
+	mean float64
+	m2   float64
+	min  time.Duration
+	max  time.Duration
+}
+
+func (w *welford) add(rtt time.Duration) {
+	if w.n == 0 || rtt < w.min {
+		w.min = rtt
+	}
+	if w.n == 0 || rtt > w.max {
+		w.max = rtt
+	}
+	w.n++
+	delta := float64(rtt) - w.mean
+	w.mean += delta / float64(w.n)
+	w.m2 += delta * (float64(rtt) - w.mean)
+}
+
+// merge combines the aggregates of o into w (Chan et al.)
+func (w *welford) merge(o *welford) {
+	if o.n == 0 {
+		return
+	}
+	if w.n == 0 {
+		*w = *o
+		return
+	}
+	if o.min < w.min {
+		w.min = o.min
+	}
+	if o.max > w.max {
+		w.max = o.max
+	}
+	n := w.n + o.n
+	delta := o.mean - w.mean
+	w.m2 += o.m2 + delta*delta*float64(w.n)*float64(o.n)/float64(n)
+	w.mean += delta * float64(o.n) / float64(n)
+	w.n = n
+}
+
+func (w *welford) avg() time.Duration {
+	return time.Duration(w.mean)
+}
+
+// stdDev is the population standard deviation
+func (w *welford) stdDev() time.Duration {
+	if w.n == 0 {
+		return 0
+	}
+	return time.Duration(math.Sqrt(w.m2 / float64(w.n)))
+}
+
+// windowSlot aggregates one slot of a rollingWindow
+type windowSlot struct {
+	// epoch numbers the slot since the Unix epoch, in slot widths
+	epoch int64
+	sent  int
+	rtts  welford
+}
+
+// rollingWindow aggregates the packets of the last width in windowSlots
+// slots, reusing the oldest slot as time moves on
+type rollingWindow struct {
+	width time.Duration
+	slots [windowSlots]windowSlot
+}
+
+func newRollingWindow(width time.Duration) *rollingWindow {
+	return &rollingWindow{width: width}
+}
+
+func (w *rollingWindow) epoch(now time.Time) int64 {
+	step := int64(w.width) / windowSlots
+	if step < 1 {
+		step = 1
+	}
+	return now.UnixNano() / step
+}
+
+func (w *rollingWindow) slot(now time.Time) *windowSlot {
+	epoch := w.epoch(now)
+	slot := &w.slots[epoch%windowSlots]
+	if slot.epoch != epoch {
+		*slot = windowSlot{epoch: epoch}
+	}
+	return slot
+}
+
+// merge adds the slots of o, a window of the same width, to w
+func (w *rollingWindow) merge(o *rollingWindow) {
+	for i := range o.slots {
+		slot, other := &w.slots[i], &o.slots[i]
+		switch {
+		case other.epoch == slot.epoch:
+			slot.sent += other.sent
+			slot.rtts.merge(&other.rtts)
+		case other.epoch > slot.epoch:
+			*slot = *other
+		}
+	}
+}
+
+func (w *rollingWindow) statistics(now time.Time) *WindowStatistics {
+	epoch := w.epoch(now)
+	var sent int
+	var rtts welford
+	for i := range w.slots {
+		slot := &w.slots[i]
+		if slot.epoch > epoch-windowSlots && slot.epoch <= epoch {
+			sent += slot.sent
+			rtts.merge(&slot.rtts)
+		}
+	}
+	s := &WindowStatistics{
+		Window:      w.width,
+		PacketsSent: sent,
+		PacketsRecv: rtts.n,
+		MinRtt:      rtts.min,
+		MaxRtt:      rtts.max,
+		AvgRtt:      rtts.avg(),
+		StdDevRtt:   rtts.stdDev(),
+	}
+	if sent > 0 {
+		// replies to requests sent before the window count in it, they may
+		// outnumber the requests sent
+		loss := float64(sent-rtts.n) / float64(sent) * 100
+		s.PacketLoss = math.Max(loss, 0)
+	}
+	return s
+}
+
+// rttStats aggregates the round-trip times of one IP in bounded memory, so it
+// is kept regardless of RecordRtts and Continuous
+type rttStats struct {
+	nsent  int
+	rtts   welford
+	sketch *rttSketch
+	// exact histogram counts per upper bound in bounds, the last bucket is
+	// unbounded; the sketch only serves percentiles
+	bounds  []time.Duration
+	buckets []int
+	windows []*rollingWindow
+	// RFC 3550 interarrival jitter, in nanoseconds
+	jitter float64
+	last   time.Duration
+	// duplicated, reordered and late replies
+	duplicates int
+	reordered  int
+	late       int
+	// ICMP error messages received
+	unreachable      map[UnreachableCode]int
+	timeExceeded     int
+	parameterProblem int
+}
+
+func newRTTStats(bounds []time.Duration, windows []time.Duration) *rttStats {
+	r := &rttStats{
+		sketch:      newRTTSketch(),
+		bounds:      bounds,
+		buckets:     make([]int, len(bounds)+1),
+		unreachable: make(map[UnreachableCode]int),
+	}
+	for _, width := range windows {
+		r.windows = append(r.windows, newRollingWindow(width))
+	}
+	return r
+}
+
+// sent records a packet sent at now
+func (r *rttStats) sent(now time.Time) {
+	r.nsent++
+	for _, w := range r.windows {
+		w.slot(now).sent++
+	}
+}
+
+// add records the round-trip time of a reply received at now
+func (r *rttStats) add(rtt time.Duration, now time.Time) {
+	if r.rtts.n > 0 {
+		d := math.Abs(float64(rtt - r.last))
+		r.jitter += (d - r.jitter) / jitterGain
+	}
+	r.last = rtt
+	r.rtts.add(rtt)
+	r.sketch.add(rtt)
+	r.buckets[sort.Search(len(r.bounds), func(i int) bool { return rtt <= r.bounds[i] })]++
+	for _, w := range r.windows {
+		w.slot(now).rtts.add(rtt)
+	}
+}
+
+// merge adds the aggregates of o, kept with the same bounds and windows, to r
+func (r *rttStats) merge(o *rttStats) {
+	// the jitter of several IPs is weighted by their number of replies
+	if n := r.rtts.n + o.rtts.n; n > 0 {
+		r.jitter = (r.jitter*float64(r.rtts.n) + o.jitter*float64(o.rtts.n)) / float64(n)
+	}
+	r.nsent += o.nsent
+	r.rtts.merge(&o.rtts)
+	r.sketch.merge(o.sketch)
+	for i := range r.buckets {
+		if i < len(o.buckets) {
+			r.buckets[i] += o.buckets[i]
+		}
+	}
+	for i := range r.windows {
+		if i < len(o.windows) {
+			r.windows[i].merge(o.windows[i])
+		}
+	}
+	r.duplicates += o.duplicates
+	r.reordered += o.reordered
+	r.late += o.late
+	for code, n := range o.unreachable {
+		r.unreachable[code] += n
+	}
+	r.timeExceeded += o.timeExceeded
+	r.parameterProblem += o.parameterProblem
+}
+
+// icmpError counts an ICMP error message received in reply to a request
+func (r *rttStats) icmpError(e *ICMPError) {
+	switch e.Type {
+	case ICMPUnreachable:
+		r.unreachable[e.Unreachable]++
+	case ICMPTimeExceeded:
+		r.timeExceeded++
+	case ICMPParameterProblem:
+		r.parameterProblem++
+	}
+}
+
+// fill sets the round-trip time, window and ICMP error fields of s
+func (r *rttStats) fill(s *Statistics, now time.Time) {
+	s.MinRtt = r.rtts.min
+	s.MaxRtt = r.rtts.max
+	s.AvgRtt = r.rtts.avg()
+	s.StdDevRtt = r.rtts.stdDev()
+	s.P50Rtt = r.sketch.quantile(0.5)
+	s.P90Rtt = r.sketch.quantile(0.9)
+	s.P95Rtt = r.sketch.quantile(0.95)
+	s.P99Rtt = r.sketch.quantile(0.99)
+	s.P999Rtt = r.sketch.quantile(0.999)
+	s.Jitter = time.Duration(r.jitter)
+	s.Histogram = make([]HistogramBucket, len(r.buckets))
+	for i, n := range r.buckets {
+		s.Histogram[i] = HistogramBucket{UpperBound: math.MaxInt64, Count: n}
+		if i < len(r.bounds) {
+			s.Histogram[i].UpperBound = r.bounds[i]
+		}
+	}
+	for _, w := range r.windows {
+		s.Windows = append(s.Windows, w.statistics(now))
+	}
+	s.Unreachable = make(map[UnreachableCode]int, len(r.unreachable))
+	for code, n := range r.unreachable {
+		s.Unreachable[code] = n
+	}
+	s.TimeExceeded = r.timeExceeded
+	s.ParameterProblem = r.parameterProblem
+	s.Duplicates = r.duplicates
+	s.Reordered = r.reordered
+	s.Late = r.late
+}
@@ -0,0 +1,295 @@
+package pingclient
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// within reports whether got is within sketchAccuracy of want
+func within(got, want time.Duration) bool {
+	return math.Abs(float64(got-want)) <= sketchAccuracy*float64(want)
+}
+
+func TestRTTSketchQuantile(t *testing.T) {
+	s := newRTTSketch()
+	if got := s.quantile(0.5); got != 0 {
+		t.Errorf("quantile(0.5) of an empty sketch = %s, want 0", got)
+	}
+	for i := 1000; i >= 1; i-- {
+		s.add(time.Duration(i) * time.Millisecond)
+	}
+	for _, tt := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, time.Millisecond},
+		{0.5, 500 * time.Millisecond},
+		{0.9, 900 * time.Millisecond},
+		{0.99, 990 * time.Millisecond},
+		{0.999, 999 * time.Millisecond},
+		{1, time.Second},
+	} {
+		if got := s.quantile(tt.q); !within(got, tt.want) {
+			t.Errorf("quantile(%v) = %s, want %s within 1%%", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestRTTSketchBoundedMemory(t *testing.T) {
+	s := newRTTSketch()
+	s.add(0)
+	// 1ns to about 1000s in steps of 0.5%, more bins than sketchMaxBins
+	n := 1
+	for rtt := 1.0; rtt < 1e12; rtt *= 1.005 {
+		s.add(time.Duration(rtt))
+		n++
+	}
+	if len(s.bins) > sketchMaxBins {
+		t.Errorf("%d bins, want at most %d", len(s.bins), sketchMaxBins)
+	}
+	if s.count != n {
+		t.Errorf("count %d, want %d", s.count, n)
+	}
+	// collapsing only loses accuracy of the smallest round-trip times
+	if got, want := s.quantile(1), time.Duration(1e12); !within(got, want) {
+		t.Errorf("quantile(1) = %s, want %s within 1%%", got, want)
+	}
+}
+
+func TestRTTStatsJitter(t *testing.T) {
+	r := newRTTStats(DefaultHistogramBuckets, nil)
+	var s Statistics
+	r.fill(&s, time.Now())
+	if s.Jitter != 0 || s.P50Rtt != 0 {
+		t.Errorf("empty rttStats: Jitter %s, P50Rtt %s; want 0", s.Jitter, s.P50Rtt)
+	}
+
+	// the difference of consecutive round-trip times is always 10ms, the
+	// jitter estimate approaches it with a gain of 1/16
+	want := 0.0
+	for i := 0; i < 100; i++ {
+		r.add(time.Duration(10+10*(i%2))*time.Millisecond, time.Now())
+		if i > 0 {
+			want += (float64(10*time.Millisecond) - want) / jitterGain
+		}
+	}
+	r.fill(&s, time.Now())
+	if s.Jitter != time.Duration(want) {
+		t.Errorf("Jitter %s, want %s", s.Jitter, time.Duration(want))
+	}
+	if s.Jitter < 9*time.Millisecond || s.Jitter > 10*time.Millisecond {
+		t.Errorf("Jitter %s, want close to 10ms", s.Jitter)
+	}
+}
+
+func TestRTTStatsHistogram(t *testing.T) {
+	bounds := []time.Duration{time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 5 * time.Second}
+	r := newRTTStats(bounds, nil)
+	for _, rtt := range []time.Duration{
+		0,
+		500 * time.Microsecond,
+		// upper bounds are inclusive, round-trip times just above or below
+		// a bound count in their own bucket rather than the sketch bin's
+		time.Millisecond,
+		1005 * time.Microsecond,
+		3 * time.Millisecond,
+		4990 * time.Microsecond,
+		7 * time.Millisecond,
+		10 * time.Millisecond,
+		10050 * time.Microsecond,
+		2 * time.Second,
+		10 * time.Second,
+	} {
+		r.add(rtt, time.Now())
+	}
+	var s Statistics
+	r.fill(&s, time.Now())
+	want := []HistogramBucket{
+		{time.Millisecond, 3},
+		{5 * time.Millisecond, 3},
+		{10 * time.Millisecond, 2},
+		{5 * time.Second, 2},
+		{math.MaxInt64, 1},
+	}
+	if len(s.Histogram) != len(want) {
+		t.Fatalf("Histogram = %v, want %v", s.Histogram, want)
+	}
+	for i := range want {
+		if s.Histogram[i] != want[i] {
+			t.Errorf("Histogram = %v, want %v", s.Histogram, want)
+			break
+		}
+	}
+}
+
+func TestWelford(t *testing.T) {
+	rtts := []time.Duration{12, 7, 3, 21, 9, 15, 2, 30}
+	var w, a, b welford
+	sum := 0.0
+	for i, rtt := range rtts {
+		w.add(rtt * time.Millisecond)
+		if i < 3 {
+			a.add(rtt * time.Millisecond)
+		} else {
+			b.add(rtt * time.Millisecond)
+		}
+		sum += float64(rtt * time.Millisecond)
+	}
+	mean := sum / float64(len(rtts))
+	variance := 0.0
+	for _, rtt := range rtts {
+		d := float64(rtt*time.Millisecond) - mean
+		variance += d * d
+	}
+	stdDev := time.Duration(math.Sqrt(variance / float64(len(rtts))))
+
+	if w.n != 8 || w.min != 2*time.Millisecond || w.max != 30*time.Millisecond || w.avg() != time.Duration(mean) {
+		t.Errorf("n %d, min %s, max %s, avg %s; want 8, 2ms, 30ms, %s", w.n, w.min, w.max, w.avg(), time.Duration(mean))
+	}
+	if d := w.stdDev() - stdDev; d < -1 || d > 1 {
+		t.Errorf("stdDev %s, want %s", w.stdDev(), stdDev)
+	}
+
+	// merging the aggregates of two halves equals adding them all
+	var empty welford
+	a.merge(&empty)
+	a.merge(&b)
+	empty.merge(&a)
+	for _, m := range []welford{a, empty} {
+		if m.n != w.n || m.min != w.min || m.max != w.max || m.avg() != w.avg() {
+			t.Errorf("merged n %d, min %s, max %s, avg %s; want %d, %s, %s, %s", m.n, m.min, m.max, m.avg(), w.n, w.min, w.max, w.avg())
+		}
+		if d := m.stdDev() - w.stdDev(); d < -1 || d > 1 {
+			t.Errorf("merged stdDev %s, want %s", m.stdDev(), w.stdDev())
+		}
+	}
+}
+
+func TestRollingWindow(t *testing.T) {
+	r := newRTTStats(DefaultHistogramBuckets, []time.Duration{time.Minute, time.Hour})
+	start := time.Unix(1700000000, 0)
+	// one packet a second for 10 minutes, every fourth one lost, the
+	// round-trip time growing by 1ms a minute
+	for i := 0; i < 600; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		r.sent(now)
+		if i%4 != 0 {
+			r.add(time.Duration(1+i/60)*time.Millisecond, now)
+		}
+	}
+
+	var s Statistics
+	r.fill(&s, start.Add(599*time.Second))
+	if len(s.Windows) != 2 {
+		t.Fatalf("%d windows, want 2", len(s.Windows))
+	}
+	minute, hour := s.Windows[0], s.Windows[1]
+	if minute.Window != time.Minute || minute.PacketsSent != 60 || minute.PacketsRecv != 45 || minute.PacketLoss != 25 {
+		t.Errorf("1m window: sent %d, received %d, loss %v; want 60, 45, 25", minute.PacketsSent, minute.PacketsRecv, minute.PacketLoss)
+	}
+	if minute.MinRtt != 10*time.Millisecond || minute.MaxRtt != 10*time.Millisecond || minute.StdDevRtt != 0 {
+		t.Errorf("1m window: MinRtt %s, MaxRtt %s, StdDevRtt %s; want 10ms, 10ms, 0", minute.MinRtt, minute.MaxRtt, minute.StdDevRtt)
+	}
+	if hour.Window != time.Hour || hour.PacketsSent != 600 || hour.PacketsRecv != 450 || hour.PacketLoss != 25 {
+		t.Errorf("1h window: sent %d, received %d, loss %v; want 600, 450, 25", hour.PacketsSent, hour.PacketsRecv, hour.PacketLoss)
+	}
+	if s.MinRtt != time.Millisecond || s.MaxRtt != 10*time.Millisecond {
+		t.Errorf("MinRtt %s, MaxRtt %s; want 1ms, 10ms over the whole run", s.MinRtt, s.MaxRtt)
+	}
+
+	// a minute later nothing is left in the 1m window
+	s = Statistics{}
+	r.fill(&s, start.Add(660*time.Second))
+	if minute := s.Windows[0]; minute.PacketsSent != 0 || minute.PacketsRecv != 0 || minute.PacketLoss != 0 {
+		t.Errorf("1m window a minute later: sent %d, received %d, loss %v; want 0", minute.PacketsSent, minute.PacketsRecv, minute.PacketLoss)
+	}
+	if hour := s.Windows[1]; hour.PacketsSent != 600 {
+		t.Errorf("1h window a minute later: sent %d, want 600", hour.PacketsSent)
+	}
+}
+
+func TestRollingWindowBoundary(t *testing.T) {
+	r := newRTTStats(DefaultHistogramBuckets, []time.Duration{time.Minute})
+	start := time.Unix(1700000000, 0)
+	// a request every 10s, replied 15s later, so that the window only holds
+	// the replies to the requests sent just before it
+	for i := 0; i < 12; i++ {
+		r.sent(start.Add(time.Duration(i) * 10 * time.Second))
+	}
+	for i := 0; i < 12; i++ {
+		r.add(15*time.Second, start.Add(time.Duration(i)*10*time.Second+15*time.Second))
+	}
+
+	var s Statistics
+	r.fill(&s, start.Add(135*time.Second))
+	if minute := s.Windows[0]; minute.PacketsRecv <= minute.PacketsSent || minute.PacketLoss != 0 {
+		t.Errorf("1m window: sent %d, received %d, loss %v; want more replies than requests and no loss", minute.PacketsSent, minute.PacketsRecv, minute.PacketLoss)
+	}
+}
+
+func TestRunPercentiles(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.SetLink("10.0.0.1", &SimLink{Latency: 2 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	p := newSimClient(t, sim, "10.0.0.1")
+	p.Num = 10
+	p.Interval = 20 * time.Millisecond
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := statsOf(t, p, "10.0.0.1")
+	for _, pct := range []time.Duration{s.P50Rtt, s.P90Rtt, s.P95Rtt, s.P99Rtt, s.P999Rtt} {
+		if !within(pct, s.MinRtt) && pct < s.MinRtt || !within(pct, s.MaxRtt) && pct > s.MaxRtt {
+			t.Errorf("percentile %s outside of MinRtt %s and MaxRtt %s", pct, s.MinRtt, s.MaxRtt)
+		}
+	}
+	if s.P50Rtt > s.P90Rtt || s.P90Rtt > s.P99Rtt {
+		t.Errorf("P50Rtt %s, P90Rtt %s, P99Rtt %s; want them in order", s.P50Rtt, s.P90Rtt, s.P99Rtt)
+	}
+	if s.Jitter <= 0 || s.Jitter > s.MaxRtt-s.MinRtt {
+		t.Errorf("Jitter %s, want more than 0 and at most %s", s.Jitter, s.MaxRtt-s.MinRtt)
+	}
+	n := 0
+	for _, b := range s.Histogram {
+		n += b.Count
+	}
+	if n != s.PacketsRecv {
+		t.Errorf("%d round-trip times in Histogram, want %d", n, s.PacketsRecv)
+	}
+}
+
+func TestRTTStatsMerge(t *testing.T) {
+	windows := []time.Duration{time.Minute}
+	all, a, b := newRTTStats(DefaultHistogramBuckets, windows), newRTTStats(DefaultHistogramBuckets, windows), newRTTStats(DefaultHistogramBuckets, windows)
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		rtt := time.Duration(1+i%7) * time.Millisecond
+		all.sent(now)
+		all.add(rtt, now)
+		if i%2 == 0 {
+			a.sent(now)
+			a.add(rtt, now)
+		} else {
+			b.sent(now)
+			b.add(rtt, now)
+		}
+	}
+	a.duplicates, b.duplicates = 1, 2
+	a.merge(b)
+
+	var got, want Statistics
+	a.fill(&got, now)
+	all.fill(&want, now)
+	if got.MinRtt != want.MinRtt || got.MaxRtt != want.MaxRtt || got.AvgRtt != want.AvgRtt || got.P50Rtt != want.P50Rtt || got.P99Rtt != want.P99Rtt {
+		t.Errorf("merged min/avg/max/p50/p99 %s/%s/%s/%s/%s, want %s/%s/%s/%s/%s",
+			got.MinRtt, got.AvgRtt, got.MaxRtt, got.P50Rtt, got.P99Rtt,
+			want.MinRtt, want.AvgRtt, want.MaxRtt, want.P50Rtt, want.P99Rtt)
+	}
+	if got.Duplicates != 3 {
+		t.Errorf("merged Duplicates %d, want 3", got.Duplicates)
+	}
+	if w := got.Windows[0]; w.PacketsSent != 20 || w.PacketsRecv != 20 {
+		t.Errorf("merged window: sent %d, received %d; want 20, 20", w.PacketsSent, w.PacketsRecv)
+	}
+}
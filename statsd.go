@@ -0,0 +1,154 @@
+package pingclient
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// StatsDSink pushes the events of a PingClient to StatsD over udp:
+//
+//	<prefix>packets.received:1|c   every reply, but duplicates and late ones
+//	<prefix>packets.lost:1|c       every request without reply
+//	<prefix>rtt:5.210|ms           round-trip time of every reply
+//	<prefix>packets_sent:10|g      and packets_recv, packet_loss, avg_rtt
+//	                               (ms), min_rtt, max_rtt, stddev_rtt and
+//	                               jitter with the statistics
+//
+// With DogStatsD the metrics are tagged with client, url and ip, otherwise
+// client and ip are part of the metric names:
+// <prefix><client>.<ip>.rtt, with dots of the ip replaced by underscores.
+type StatsDSink struct {
+	// Prefix of the metric names, "pingclient." by default.
+	Prefix string
+
+	// DogStatsD tags the metrics the DogStatsD way.
+	DogStatsD bool
+
+	udp *udpWriter
+}
+
+// NewStatsDSink returns a StatsDSink sending to address "host:port".
+func NewStatsDSink(address string, prefix string, dogStatsD bool) (*StatsDSink, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("error NewStatsDSink(): address %s should be host:port", address)
+	}
+	if prefix == "" {
+		prefix = "pingclient."
+	}
+	return &StatsDSink{
+		Prefix:    prefix,
+		DogStatsD: dogStatsD,
+		udp:       &udpWriter{address: address},
+	}, nil
+}
+
+// Received sends the counter and the round-trip time of a reply.
+func (s *StatsDSink) Received(e *PacketEvent) error {
+	if e.Status == "duplicate" || e.Status == "late" {
+		return nil
+	}
+	return s.send([]string{
+		s.metric(e.Client, e.URL, e.IP, "packets.received", "1", "c"),
+		s.metric(e.Client, e.URL, e.IP, "rtt", formatMs(e.Rtt), "ms"),
+	})
+}
+
+// Lost sends the counter of a lost packet.
+func (s *StatsDSink) Lost(e *PacketEvent) error {
+	return s.send([]string{s.metric(e.Client, e.URL, e.IP, "packets.lost", "1", "c")})
+}
+
+// Stats sends the gauges of every IP.
+func (s *StatsDSink) Stats(stats []*Statistics) error {
+	lines := make([]string, 0, len(statsdGauges)*len(stats))
+	for _, stat := range stats {
+		url := stat.URL
+		if len(stat.URLs) > 0 {
+			url = strings.Join(stat.URLs, " ")
+		}
+		for _, g := range statsdGauges {
+			lines = append(lines, s.metric(stat.Name, url, stat.IP, g.name, g.value(stat), "g"))
+		}
+	}
+	return s.send(lines)
+}
+
+// statsdGauges are the gauges Stats sends for every Statistics
+var statsdGauges = []struct {
+	name  string
+	value func(*Statistics) string
+}{
+	{"packets_sent", func(s *Statistics) string { return strconv.Itoa(s.PacketsSent) }},
+	{"packets_recv", func(s *Statistics) string { return strconv.Itoa(s.PacketsRecv) }},
+	{"packet_loss", func(s *Statistics) string { return strconv.FormatFloat(s.PacketLoss, 'f', -1, 64) }},
+	{"avg_rtt", func(s *Statistics) string { return formatMs(s.AvgRtt) }},
+	{"min_rtt", func(s *Statistics) string { return formatMs(s.MinRtt) }},
+	{"max_rtt", func(s *Statistics) string { return formatMs(s.MaxRtt) }},
+	{"stddev_rtt", func(s *Statistics) string { return formatMs(s.StdDevRtt) }},
+	{"jitter", func(s *Statistics) string { return formatMs(s.Jitter) }},
+}
+
+// Flush does nothing, metrics are sent right away.
+func (s *StatsDSink) Flush() error {
+	return nil
+}
+
+// Close closes the udp socket.
+func (s *StatsDSink) Close() error {
+	if err := s.udp.close(); err != nil {
+		return fmt.Errorf("error StatsDSink: %s", err)
+	}
+	return nil
+}
+
+// metric formats a metric of the packets of client to ip
+func (s *StatsDSink) metric(client string, url string, ip string, name string, value string, typ string) string {
+	if !s.DogStatsD {
+		parts := make([]string, 0, 2)
+		for _, part := range []string{client, ip} {
+			if part != "" {
+				parts = append(parts, statsdName(part))
+			}
+		}
+		parts = append(parts, name)
+		return fmt.Sprintf("%s%s:%s|%s", s.Prefix, strings.Join(parts, "."), value, typ)
+	}
+	tags := make([]string, 0, 3)
+	for _, tag := range [][2]string{{"client", client}, {"url", url}, {"ip", ip}} {
+		if tag[1] != "" {
+			tags = append(tags, tag[0]+":"+dogStatsDTag(tag[1]))
+		}
+	}
+	return fmt.Sprintf("%s%s:%s|%s|#%s", s.Prefix, name, value, typ, strings.Join(tags, ","))
+}
+
+func (s *StatsDSink) send(lines []string) error {
+	if err := s.udp.writeLines(lines); err != nil {
+		return fmt.Errorf("error StatsDSink: %s", err)
+	}
+	return nil
+}
+
+// statsdName makes s usable in a metric name
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ' ', '%', '/':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// dogStatsDTag makes s usable as a tag value
+func dogStatsDTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,251 @@
+package pingclient
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// seqSpace is the number of distinct ICMP sequence numbers and IDs
+	seqSpace = 1 << 16
+	// sentTableAge is how long send times are kept to compute the RTT of
+	// late replies
+	sentTableAge = time.Minute
+	// pruneInterval is how often send times older than sentTableAge are
+	// forgotten, whether or not there is a ReplyTimeout
+	pruneInterval = 10 * time.Second
+	// dupWindow is the number of most recent sequence numbers duplicates
+	// are told apart for exactly, like the rcvd table of ping
+	dupWindow = 256
+)
+
+// target is the per IP state of the echo requests sent during a Run
+type target struct {
+	// ICMP ID of the echo requests, matched in replies when privileged
+	id int
+
+	// sequence number of the next echo request
+	seq int
+
+	// send times of recent echo requests by sequence number, the RTT of
+	// a reply is measured against them
+	sentAt map[int]time.Time
+
+	// outstanding echo requests by sequence number, with their send time
+	pending map[int]time.Time
+
+	// answered has a bit set for each of the last dupWindow sequence
+	// numbers replied to, at seq % dupWindow, cleared when the bit is
+	// reused by a new echo request
+	answered [dupWindow / 64]uint64
+
+	// highest sequence number replied to so far, valid if replied is true
+	highest int
+	replied bool
+}
+
+func newTarget() *target {
+	return &target{
+		id:      rand.Intn(seqSpace),
+		seq:     rand.Intn(seqSpace),
+		sentAt:  make(map[int]time.Time),
+		pending: make(map[int]time.Time),
+	}
+}
+
+// nextSeq returns the sequence number of the next echo request, wrapping
+// around after 65535
+func (t *target) nextSeq() int {
+	seq := t.seq
+	t.seq = (t.seq + 1) % seqSpace
+	return seq
+}
+
+// send records that an echo request with sequence number seq was sent
+func (t *target) send(seq int, sentAt time.Time) {
+	t.sentAt[seq] = sentAt
+	t.pending[seq] = sentAt
+	slot := seq % dupWindow
+	t.answered[slot/64] &^= 1 << uint(slot%64)
+}
+
+// reply records a reply to sequence number seq and reports when its echo
+// request was sent, and whether seq was already replied to (a duplicate), a
+// higher one was (reordered), or seq is too old to tell (late)
+func (t *target) reply(seq int) (sentAt time.Time, duplicate bool, reordered bool, late bool) {
+	sentAt, ok := t.sentAt[seq]
+	if ok {
+		delete(t.sentAt, seq)
+	}
+	delete(t.pending, seq)
+	if behind := (t.seq - seq + seqSpace) % seqSpace; behind == 0 || behind > dupWindow {
+		// out of the window, the reply is told apart by its send time
+		// only, which is forgotten once replied to or pruned: without it
+		// the reply may be a duplicate as well as the first reply to a
+		// long lost request
+		if !ok {
+			return sentAt, false, false, true
+		}
+	} else {
+		slot := seq % dupWindow
+		bit := uint64(1) << uint(slot%64)
+		if t.answered[slot/64]&bit != 0 {
+			return sentAt, true, false, false
+		}
+		t.answered[slot/64] |= bit
+	}
+	if t.replied && seqBefore(seq, t.highest) {
+		return sentAt, false, true, false
+	}
+	t.highest = seq
+	t.replied = true
+	return sentAt, false, false, false
+}
+
+// prune forgets the send times older than sentTableAge, and with
+// dropPending the outstanding requests as old, which no ReplyTimeout expires
+func (t *target) prune(now time.Time, dropPending bool) {
+	for seq, sentAt := range t.sentAt {
+		if now.Sub(sentAt) > sentTableAge {
+			delete(t.sentAt, seq)
+		}
+	}
+	if !dropPending {
+		return
+	}
+	for seq, sentAt := range t.pending {
+		if now.Sub(sentAt) > sentTableAge {
+			delete(t.pending, seq)
+		}
+	}
+}
+
+// seqBefore compares 16-bit sequence numbers with serial number arithmetic
+// (RFC 1982), so that a is before b across a wraparound too
+func seqBefore(a, b int) bool {
+	d := (b - a + seqSpace) % seqSpace
+	return d != 0 && d < seqSpace/2
+}
+
+// TargetOptions override settings of PingClient for a single IP address or
+// URL.
+type TargetOptions struct {
+	// Size of the packets sent to the target. PingClient.Size if zero.
+	Size int
+
+	// ReplyTimeout of the echo requests sent to the target.
+	// PingClient.ReplyTimeout if zero.
+	ReplyTimeout time.Duration
+}
+
+// targetOptions returns the options set for ipStr itself or else for a URL
+// resolving to it, nil if there are none. It must be called with p.mu held.
+func (p *PingClient) targetOptions(ipStr string) *TargetOptions {
+	if o, ok := p.TargetOptions[ipStr]; ok {
+		return o
+	}
+	for _, url := range p.IPToURL[ipStr] {
+		if o, ok := p.TargetOptions[url]; ok {
+			return o
+		}
+	}
+	return nil
+}
+
+// sizeOf must be called with p.mu held
+func (p *PingClient) sizeOf(ipStr string) int {
+	if o := p.targetOptions(ipStr); o != nil && o.Size > 0 {
+		return o.Size
+	}
+	return p.Size
+}
+
+// replyTimeoutOf must be called with p.mu held
+func (p *PingClient) replyTimeoutOf(ipStr string) time.Duration {
+	if o := p.targetOptions(ipStr); o != nil && o.ReplyTimeout > 0 {
+		return o.ReplyTimeout
+	}
+	return p.ReplyTimeout
+}
+
+// minReplyTimeout returns the shortest reply timeout of all the targets, 0
+// if no target has one
+func (p *PingClient) minReplyTimeout() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	min := p.ReplyTimeout
+	for _, o := range p.TargetOptions {
+		if o.ReplyTimeout > 0 && (min <= 0 || o.ReplyTimeout < min) {
+			min = o.ReplyTimeout
+		}
+	}
+	return min
+}
+
+// hasPending reports whether echo requests are still waiting for a reply
+func (p *PingClient) hasPending() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, t := range p.targets {
+		if len(t.pending) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// prune forgets the old send times of every target, and the requests of
+// targets without ReplyTimeout too old to be answered any more
+func (p *PingClient) prune(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ipStr, t := range p.targets {
+		t.prune(now, p.replyTimeoutOf(ipStr) <= 0)
+	}
+}
+
+// expired is an echo request that got no reply within ReplyTimeout
+type expired struct {
+	ipStr  string
+	seq    int
+	sentAt time.Time
+}
+
+// expirePending removes the echo requests sent more than ReplyTimeout before
+// now, or all of them if all is true, and calls OnTimeout and the sinks for
+// each of them, oldest first
+func (p *PingClient) expirePending(now time.Time, all bool) {
+	var lost []expired
+	p.mu.Lock()
+	for ipStr, t := range p.targets {
+		replyTimeout := p.replyTimeoutOf(ipStr)
+		if replyTimeout <= 0 && !all {
+			continue
+		}
+		for seq, sentAt := range t.pending {
+			if all || now.Sub(sentAt) >= replyTimeout {
+				lost = append(lost, expired{ipStr: ipStr, seq: seq, sentAt: sentAt})
+				delete(t.pending, seq)
+			}
+		}
+	}
+	pkts := make([]*Packet, 0, len(lost))
+	sort.Slice(lost, func(i, j int) bool { return lost[i].sentAt.Before(lost[j].sentAt) })
+	for _, e := range lost {
+		pkts = append(pkts, &Packet{
+			IPAddr: p.findIPAddrbyString(e.ipStr),
+			IP:     e.ipStr,
+			Seq:    e.seq,
+		})
+	}
+	p.mu.Unlock()
+
+	handler := p.OnTimeout
+	for _, pkt := range pkts {
+		if handler != nil {
+			handler(pkt)
+		}
+		p.sinkLost(pkt.IP, pkt.Seq, "timeout")
+	}
+}
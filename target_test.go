@@ -0,0 +1,132 @@
+package pingclient
+
+import (
+	"testing"
+	"time"
+)
+
+// sendN sends n echo requests on t and returns their sequence numbers
+func sendN(t *target, n int, now time.Time) []int {
+	seqs := make([]int, n)
+	for i := range seqs {
+		seqs[i] = t.nextSeq()
+		t.send(seqs[i], now)
+	}
+	return seqs
+}
+
+func TestTargetReply(t *testing.T) {
+	tg := newTarget()
+	tg.seq = seqSpace - 2 // wrap around in the middle
+	now := time.Now()
+	seqs := sendN(tg, 4, now)
+
+	tests := []struct {
+		seq                  int
+		duplicate, reordered bool
+	}{
+		{seqs[1], false, false},
+		{seqs[0], false, true},
+		{seqs[1], true, false},
+		{seqs[3], false, false},
+		{seqs[2], false, true},
+		{seqs[3], true, false},
+	}
+	for _, tt := range tests {
+		sentAt, duplicate, reordered, _ := tg.reply(tt.seq)
+		if duplicate != tt.duplicate || reordered != tt.reordered {
+			t.Errorf("reply(%d) = duplicate %v, reordered %v; want %v, %v", tt.seq, duplicate, reordered, tt.duplicate, tt.reordered)
+		}
+		if !duplicate && !sentAt.Equal(now) {
+			t.Errorf("reply(%d) sent at %v, want %v", tt.seq, sentAt, now)
+		}
+	}
+	if len(tg.pending) != 0 {
+		t.Errorf("pending = %v after every request was replied to", tg.pending)
+	}
+}
+
+func TestTargetPrune(t *testing.T) {
+	tg := newTarget()
+	now := time.Now()
+	old := sendN(tg, 2, now.Add(-2*sentTableAge))
+	recent := sendN(tg, 1, now)[0]
+	tg.prune(now, false)
+	if len(tg.sentAt) != 1 || len(tg.pending) != 3 {
+		t.Fatalf("sentAt = %v, pending = %v after prune, want only %d sent and all pending", tg.sentAt, tg.pending, recent)
+	}
+	// without ReplyTimeout old requests are given up on
+	tg.prune(now, true)
+	if len(tg.pending) != 1 {
+		t.Fatalf("pending = %v after prune, want only %d", tg.pending, recent)
+	}
+	// a reply to a forgotten request has no send time to measure against
+	if sentAt, _, _, _ := tg.reply(old[0]); !sentAt.IsZero() {
+		t.Errorf("reply(%d) sent at %v, want the zero time", old[0], sentAt)
+	}
+	if sentAt, _, _, _ := tg.reply(recent); !sentAt.Equal(now) {
+		t.Errorf("reply(%d) sent at %v, want %v", recent, sentAt, now)
+	}
+}
+
+func TestTargetDuplicateWindow(t *testing.T) {
+	tg := newTarget()
+	now := time.Now()
+	first := sendN(tg, 1, now)[0]
+	if _, duplicate, _, _ := tg.reply(first); duplicate {
+		t.Fatalf("first reply to %d is a duplicate", first)
+	}
+
+	// the slot of first is reused dupWindow requests later
+	later := sendN(tg, dupWindow, now)
+	if _, duplicate, _, _ := tg.reply(later[len(later)-1]); duplicate {
+		t.Errorf("reply to %d, in the slot of %d, is a duplicate", later[len(later)-1], first)
+	}
+	// a reply to first is now out of the window, and its send time was
+	// forgotten when it was replied to: it can't be told apart from the
+	// first reply to a forgotten request
+	if _, duplicate, _, late := tg.reply(first); duplicate || !late {
+		t.Errorf("second reply to %d, out of the window = duplicate %v, late %v; want late only", first, duplicate, late)
+	}
+	if _, duplicate, _, _ := tg.reply(later[0]); duplicate {
+		t.Errorf("first reply to %d is a duplicate", later[0])
+	}
+	if _, duplicate, _, _ := tg.reply(later[0]); !duplicate {
+		t.Errorf("second reply to %d is not a duplicate", later[0])
+	}
+}
+
+func TestTargetLateReply(t *testing.T) {
+	tg := newTarget()
+	now := time.Now()
+	late := sendN(tg, 1, now)[0]
+	sendN(tg, 2*dupWindow, now)
+
+	// out of the window but with a known send time, the reply counts once
+	if sentAt, duplicate, _, isLate := tg.reply(late); duplicate || isLate || !sentAt.Equal(now) {
+		t.Errorf("late reply to %d = duplicate %v, late %v, sent at %v; want the first reply, sent at %v", late, duplicate, isLate, sentAt, now)
+	}
+	// its send time is forgotten, a second reply may be a duplicate or not
+	if _, duplicate, _, isLate := tg.reply(late); duplicate || !isLate {
+		t.Errorf("second late reply to %d = duplicate %v, late %v; want late only", late, duplicate, isLate)
+	}
+}
+
+func TestSeqBefore(t *testing.T) {
+	tests := []struct {
+		a, b int
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{3, 3, false},
+		{seqSpace - 1, 0, true},
+		{0, seqSpace - 1, false},
+		{0, seqSpace / 2, false},
+	}
+	for _, tt := range tests {
+		if got := seqBefore(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqBefore(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
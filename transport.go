@@ -0,0 +1,103 @@
+package pingclient
+
+import (
+	"net"
+	"runtime"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// DefaultTransport is the Transport used by New, backed by golang.org/x/net/icmp
+// raw ("icmp") or datagram ("udp") sockets.
+var DefaultTransport Transport = icmpTransport{}
+
+// Transport opens the packet connections PingClient sends echo requests and
+// receives replies through. Replace PingClient.Transport (e.g. with a
+// SimNetwork) to run PingClient without real ICMP sockets.
+type Transport interface {
+	// Listen opens a packet connection for the given network protocol,
+	// one of "ip4:icmp", "ip6:ipv6-icmp", "udp4" or "udp6", bound to the
+	// source address (empty means any).
+	Listen(netProto string, source string) (PacketConn, error)
+}
+
+// PacketConn is a packet connection opened by a Transport.
+type PacketConn interface {
+	// ReadFrom reads an ICMP message into b. It returns the number of bytes
+	// read, the TTL (IPv4) or hop limit (IPv6) of the packet if known, and
+	// the source address of the packet.
+	ReadFrom(b []byte) (n int, ttl int, src net.Addr, err error)
+
+	// WriteTo writes the ICMP message b to dst.
+	WriteTo(b []byte, dst net.Addr) (int, error)
+
+	// SetReadDeadline sets the deadline for future ReadFrom calls.
+	SetReadDeadline(t time.Time) error
+
+	// Close closes the connection.
+	Close() error
+}
+
+// icmpTransport is the golang.org/x/net/icmp implementation of Transport
+type icmpTransport struct{}
+
+// icmpConn wraps *icmp.PacketConn to read TTL and hop limit control messages
+type icmpConn struct {
+	conn *icmp.PacketConn
+}
+
+func (icmpTransport) Listen(netProto string, source string) (PacketConn, error) {
+	conn, err := icmp.ListenPacket(netProto, source)
+	if err != nil {
+		return nil, err
+	}
+	if p4 := conn.IPv4PacketConn(); p4 != nil {
+		if err = p4.SetControlMessage(ipv4.FlagTTL, true); runtime.GOOS != "windows" && err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else if p6 := conn.IPv6PacketConn(); p6 != nil {
+		if err = p6.SetControlMessage(ipv6.FlagHopLimit, true); runtime.GOOS != "windows" && err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &icmpConn{conn: conn}, nil
+}
+
+func (c *icmpConn) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	var n, ttl int
+	var src net.Addr
+	var err error
+	if p4 := c.conn.IPv4PacketConn(); p4 != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, src, err = p4.ReadFrom(b)
+		if cm != nil {
+			ttl = cm.TTL
+		}
+	} else if p6 := c.conn.IPv6PacketConn(); p6 != nil {
+		var cm *ipv6.ControlMessage
+		n, cm, src, err = p6.ReadFrom(b)
+		if cm != nil {
+			ttl = cm.HopLimit
+		}
+	} else {
+		n, src, err = c.conn.ReadFrom(b)
+	}
+	return n, ttl, src, err
+}
+
+func (c *icmpConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	return c.conn.WriteTo(b, dst)
+}
+
+func (c *icmpConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *icmpConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,337 @@
+package pingclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Watcher runs the PingClients of a config file and reloads the file when it
+// changes or, except on Windows, when the process receives SIGHUP.
+//
+// On reload the PingClients are matched by name: new ones are started,
+// removed ones are stopped, and changed ones are updated in place, keeping
+// the statistics of the targets they still ping. A PingClient switching
+// between privileged and unprivileged, or to IPs of a version it has no
+// connection for, is started anew, and so is one that has finished.
+type Watcher struct {
+	// File is the yaml (or json) config file.
+	File string
+
+	// PollInterval is how often File is checked for changes. Default is 1s.
+	PollInterval time.Duration
+
+	// OnStart is called with every PingClient before it starts, e.g. to set
+	// its callbacks. It may call the Watcher, e.g. PingClients.
+	OnStart func(*PingClient)
+
+	// OnReload is called after every reload of File.
+	OnReload func(*ReloadEvent)
+
+	// Overrides are applied on top of File at every reload, see Override.
+	Overrides []*Override
+
+	mu      sync.Mutex
+	ctx     context.Context
+	clients []*watchedClient
+	wg      sync.WaitGroup
+}
+
+// ReloadEvent reports the outcome of reloading the config file of a Watcher.
+type ReloadEvent struct {
+	// Started, Stopped and Updated are the names of the PingClients
+	// started, stopped and updated in place.
+	Started []string
+	Stopped []string
+	Updated []string
+
+	// Err is the error reading or parsing the config file, in which case
+	// the running PingClients are left untouched.
+	Err error
+}
+
+// watchedClient is a PingClient run by a Watcher
+type watchedClient struct {
+	pingClient *PingClient
+	conf       *PingClientConfig
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// NewWatcher returns a Watcher of the config file name.
+func NewWatcher(name string) *Watcher {
+	return &Watcher{
+		File:         name,
+		PollInterval: time.Second,
+	}
+}
+
+// Run starts the PingClients of File and reloads it until ctx is done, then
+// stops all the PingClients and waits for them to finish. It returns the
+// error of the initial load of File, if any.
+func (w *Watcher) Run(ctx context.Context) error {
+	w.mu.Lock()
+	w.ctx = ctx
+	w.mu.Unlock()
+
+	modTime, size := w.stat()
+	if event := w.Reload(); event.Err != nil {
+		return event.Err
+	}
+
+	pollInterval := w.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	hup := make(chan os.Signal, 1)
+	if signals := reloadSignals(); len(signals) > 0 {
+		signal.Notify(hup, signals...)
+		defer signal.Stop(hup)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.stopAll()
+			return nil
+		case <-hup:
+			modTime, size = w.stat()
+			w.Reload()
+		case <-poll.C:
+			if m, s := w.stat(); !m.Equal(modTime) || s != size {
+				modTime, size = m, s
+				w.Reload()
+			}
+		}
+	}
+}
+
+// stat returns the modification time and size of File, zero if it is missing
+func (w *Watcher) stat() (time.Time, int64) {
+	info, err := os.Stat(w.File)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return info.ModTime(), info.Size()
+}
+
+// Reload reads File again and applies it to the running PingClients.
+// Run calls it on changes, it can be called to force a reload.
+func (w *Watcher) Reload() *ReloadEvent {
+	event := &ReloadEvent{}
+	defer func() {
+		if handler := w.OnReload; handler != nil {
+			handler(event)
+		}
+	}()
+
+	config, err := ParseConfigFile(w.File, w.Overrides...)
+	if err != nil {
+		event.Err = fmt.Errorf("error Reload(): %s", err)
+		return event
+	}
+
+	// OnStart may call the Watcher, e.g. PingClients, the new PingClients
+	// are run once w.mu is released
+	for _, c := range w.apply(config, event) {
+		w.run(c)
+	}
+	return event
+}
+
+// apply applies config to the running PingClients, records the changes in
+// event and returns the new PingClients to run
+func (w *Watcher) apply(config *Config, event *ReloadEvent) []*watchedClient {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx == nil {
+		event.Err = fmt.Errorf("error Reload(): Watcher is not running")
+		return nil
+	}
+
+	running := make(map[string]*watchedClient, len(w.clients))
+	for _, c := range w.clients {
+		running[c.conf.Name] = c
+	}
+	clients := make([]*watchedClient, 0, len(config.PingClientsConf))
+	started := make([]*watchedClient, 0)
+	for _, conf := range config.PingClientsConf {
+		c, ok := running[conf.Name]
+		delete(running, conf.Name)
+		switch {
+		case !ok:
+			c = w.start(conf)
+			clients = append(clients, c)
+			started = append(started, c)
+			event.Started = append(event.Started, conf.Name)
+		case sameConfig(c.conf, conf):
+			clients = append(clients, c)
+		case c.pingClient.update(conf):
+			c.conf = conf
+			clients = append(clients, c)
+			event.Updated = append(event.Updated, conf.Name)
+		default:
+			c.cancel()
+			c = w.start(conf)
+			clients = append(clients, c)
+			started = append(started, c)
+			event.Updated = append(event.Updated, conf.Name)
+		}
+	}
+	// stop the removed PingClients in the order of the previous file
+	for _, c := range w.clients {
+		if _, ok := running[c.conf.Name]; ok {
+			c.cancel()
+			event.Stopped = append(event.Stopped, c.conf.Name)
+		}
+	}
+	w.clients = clients
+	return started
+}
+
+// PingClients returns the running PingClients in the order of File.
+func (w *Watcher) PingClients() []*PingClient {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pingClients := make([]*PingClient, 0, len(w.clients))
+	for _, c := range w.clients {
+		pingClients = append(pingClients, c.pingClient)
+	}
+	return pingClients
+}
+
+// start sets up a new PingClient for conf, run by run. It must be called
+// with w.mu held, so that stopAll waits for the PingClient.
+func (w *Watcher) start(conf *PingClientConfig) *watchedClient {
+	ctx, cancel := context.WithCancel(w.ctx)
+	w.wg.Add(1)
+	return &watchedClient{
+		pingClient: NewPingClientWithConfig(conf),
+		conf:       conf,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// run calls OnStart and runs the PingClient set up by start, it must be
+// called without w.mu held
+func (w *Watcher) run(c *watchedClient) {
+	if handler := w.OnStart; handler != nil {
+		handler(c.pingClient)
+	}
+	go func() {
+		defer w.wg.Done()
+		//nolint:errcheck
+		c.pingClient.RunContext(c.ctx)
+	}()
+}
+
+// stopAll stops all the PingClients and waits for them to finish
+func (w *Watcher) stopAll() {
+	w.mu.Lock()
+	for _, c := range w.clients {
+		c.cancel()
+	}
+	w.clients = nil
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+// sameConfig compares two configs of a PingClient, leaving out the DNS
+// lookups made while parsing
+func sameConfig(a, b *PingClientConfig) bool {
+	x, y := *a, *b
+	x.dnsStats, y.dnsStats = nil, nil
+	return reflect.DeepEqual(x, y)
+}
+
+// update applies conf to the PingClient, running or not yet started,
+// keeping the statistics of the IPs conf still has. It returns false if conf
+// can only be applied by a new PingClient: when Privileged, the sinks or
+// StatsInterval change, when conf has IPs of a version the running
+// PingClient has no connection for, or when the PingClient has finished.
+func (p *PingClient) update(conf *PingClientConfig) bool {
+	if conf.Privileged != p.Privileged() {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !reflect.DeepEqual(conf.Sinks, p.sinkConfigs) || conf.StatsInterval != p.StatsInterval {
+		return false
+	}
+	if p.ran {
+		// finished, nothing would run it again
+		return false
+	}
+	select {
+	case <-p.done:
+		// finishing
+		return false
+	default:
+	}
+	if p.running {
+		for _, ipAddr := range conf.IPs {
+			if (isIPv4(ipAddr.IP) && !p.hasConn) || (!isIPv4(ipAddr.IP) && !p.hasConn6) {
+				return false
+			}
+		}
+	}
+
+	p.Interval = conf.Interval
+	p.Timeout = conf.Timeout
+	p.Num = conf.Num
+	p.Size = conf.Size
+	p.ReplyTimeout = conf.ReplyTimeout
+	confIPs, confURLs, ipToURL, literal, targetOptions := conf.copyTargets()
+	p.TargetOptions = targetOptions
+	p.Continuous = conf.Continuous
+	p.ResolveAll = conf.ResolveAll
+	p.ResolveInterval = conf.ResolveInterval
+	p.Resolver = conf.Resolver
+	p.SetNetwork(conf.Network)
+	for url, d := range conf.dnsStats {
+		if existing, ok := p.dnsStats[url]; ok {
+			existing.add(d.last, d.err)
+		} else {
+			p.dnsStats[url] = d
+		}
+	}
+
+	for _, ipAddr := range append([]*net.IPAddr(nil), p.IPs...) {
+		if !containsIP(confIPs, ipAddr) {
+			p.stopTarget(ipAddr)
+		}
+	}
+	// IPs follow the order of conf
+	ipAddrs := make([]*net.IPAddr, 0, len(confIPs))
+	for _, ipAddr := range confIPs {
+		if existing := p.findIPAddrbyString(ipAddr.String()); existing != nil {
+			ipAddr = existing
+		} else {
+			p.startTarget(ipAddr.String())
+		}
+		ipAddrs = append(ipAddrs, ipAddr)
+	}
+	p.IPs = ipAddrs
+	p.URLs = confURLs
+	p.IPToURL = ipToURL
+	p.literal = literal
+
+	if p.reconfigure != nil {
+		select {
+		case p.reconfigure <- struct{}{}:
+		default:
+			// the Run is already told
+		}
+	}
+	return true
+}
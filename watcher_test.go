@@ -0,0 +1,236 @@
+package pingclient
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// watcherTest runs a Watcher of a config file in a temporary directory,
+// with the PingClients on a SimNetwork answering every address
+type watcherTest struct {
+	t      *testing.T
+	dir    string
+	sim    *SimNetwork
+	w      *Watcher
+	events chan *ReloadEvent
+	cancel context.CancelFunc
+	done   chan error
+}
+
+func newWatcherTest(t *testing.T, config string) *watcherTest {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pingclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt := &watcherTest{
+		t:      t,
+		dir:    dir,
+		sim:    NewSimNetwork(1),
+		events: make(chan *ReloadEvent, 10),
+		done:   make(chan error, 1),
+	}
+	wt.sim.Default = &SimLink{Latency: time.Millisecond}
+	wt.write(config)
+
+	wt.w = NewWatcher(filepath.Join(dir, "config.yaml"))
+	// reloads are forced by the tests
+	wt.w.PollInterval = time.Hour
+	wt.w.OnStart = func(p *PingClient) {
+		p.Transport = wt.sim
+		p.Linger = 10 * time.Millisecond
+	}
+	wt.w.OnReload = func(e *ReloadEvent) { wt.events <- e }
+	var ctx context.Context
+	ctx, wt.cancel = context.WithCancel(context.Background())
+	go func() { wt.done <- wt.w.Run(ctx) }()
+	return wt
+}
+
+func (wt *watcherTest) write(config string) {
+	wt.t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(wt.dir, "config.yaml"), []byte(config), 0644); err != nil {
+		wt.t.Fatal(err)
+	}
+}
+
+// event returns the next ReloadEvent
+func (wt *watcherTest) event() *ReloadEvent {
+	wt.t.Helper()
+	select {
+	case e := <-wt.events:
+		return e
+	case <-time.After(5 * time.Second):
+		wt.t.Fatal("no reload")
+		return nil
+	}
+}
+
+// waitSent waits until ip was pinged more than n times
+func (wt *watcherTest) waitSent(ip string, n int) {
+	wt.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for wt.sim.Sent(ip) <= n {
+		if time.Now().After(deadline) {
+			wt.t.Fatalf("%s pinged %d times, want more than %d", ip, wt.sim.Sent(ip), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// close stops the Watcher and waits for its PingClients to finish
+func (wt *watcherTest) close() {
+	wt.cancel()
+	if err := <-wt.done; err != nil {
+		wt.t.Errorf("Run() = %v", err)
+	}
+	os.RemoveAll(wt.dir)
+}
+
+func TestWatcherReload(t *testing.T) {
+	wt := newWatcherTest(t, `
+app:
+  a:
+    ips: 10.0.0.1
+    interval: 5ms
+    continuous: true
+  b:
+    ips: 10.0.0.9
+    interval: 5ms
+    continuous: true
+`)
+	defer wt.close()
+	if e := wt.event(); e.Err != nil || !reflect.DeepEqual(e.Started, []string{"a", "b"}) {
+		t.Fatalf("first reload %+v, want a and b started", e)
+	}
+	wt.waitSent("10.0.0.1", 3)
+	a := wt.w.PingClients()[0]
+
+	wt.write(`
+app:
+  c:
+    ips: 10.0.0.3
+    interval: 5ms
+    continuous: true
+  a:
+    ips: 10.0.0.1 10.0.0.2
+    interval: 10ms
+    continuous: true
+`)
+	wt.w.Reload()
+	e := wt.event()
+	if e.Err != nil || !reflect.DeepEqual(e.Started, []string{"c"}) || !reflect.DeepEqual(e.Updated, []string{"a"}) ||
+		!reflect.DeepEqual(e.Stopped, []string{"b"}) {
+		t.Fatalf("reload %+v, want c started, a updated and b stopped", e)
+	}
+	clients := wt.w.PingClients()
+	if len(clients) != 2 || clients[0].Name != "c" || clients[1] != a {
+		t.Fatalf("PingClients() after reload, want c and a updated in place")
+	}
+
+	// a keeps the statistics of 10.0.0.1 and pings 10.0.0.2 too
+	wt.waitSent("10.0.0.2", 3)
+	wt.waitSent("10.0.0.3", 3)
+	stats := a.Statistics()
+	if len(stats) != 2 || stats[0].IP != "10.0.0.1" || stats[0].PacketsSent <= 3 {
+		t.Errorf("statistics of a after reload %+v, want those of 10.0.0.1 kept", stats[0])
+	}
+	a.mu.RLock()
+	interval := a.Interval
+	a.mu.RUnlock()
+	if interval != 10*time.Millisecond {
+		t.Errorf("Interval of a %s after reload, want 10ms", interval)
+	}
+
+	// an invalid file leaves the PingClients alone
+	wt.write("app:\n  a:\n    interval: soon\n")
+	wt.w.Reload()
+	if e := wt.event(); e.Err == nil || len(e.Started)+len(e.Updated)+len(e.Stopped) != 0 {
+		t.Errorf("reload of an invalid file %+v, want an error and no change", e)
+	}
+	if len(wt.w.PingClients()) != 2 {
+		t.Errorf("PingClients() changed by an invalid file")
+	}
+}
+
+func TestWatcherOnStartCallsWatcher(t *testing.T) {
+	wt := newWatcherTest(t, "app:\n  a:\n    ips: 10.0.0.1\n    interval: 5ms\n    continuous: true\n")
+	defer wt.close()
+	wt.event()
+	onStart := wt.w.OnStart
+	names := make(chan int, 10)
+	wt.w.OnStart = func(p *PingClient) {
+		onStart(p)
+		names <- len(wt.w.PingClients())
+	}
+
+	// OnStart runs once the Watcher is unlocked, with the new PingClient
+	// among the running ones
+	wt.write("app:\n  a:\n    ips: 10.0.0.1\n    interval: 5ms\n    continuous: true\n  b:\n    ips: 10.0.0.2\n    interval: 5ms\n    continuous: true\n")
+	go wt.w.Reload()
+	select {
+	case n := <-names:
+		if n != 2 {
+			t.Errorf("PingClients() in OnStart returned %d PingClients, want 2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnStart calling PingClients() deadlocked")
+	}
+	wt.event()
+	wt.waitSent("10.0.0.2", 0)
+}
+
+func TestWatcherReloadNewIPVersion(t *testing.T) {
+	wt := newWatcherTest(t, "app:\n  a:\n    ips: 10.0.0.1\n    interval: 5ms\n    continuous: true\n")
+	defer wt.close()
+	wt.event()
+	wt.waitSent("10.0.0.1", 0)
+	a := wt.w.PingClients()[0]
+
+	// a runs without IPv6 connection, it is started anew for 2001:db8::1
+	wt.write("app:\n  a:\n    ips: 10.0.0.1 2001:db8::1\n    interval: 5ms\n    continuous: true\n")
+	wt.w.Reload()
+	if e := wt.event(); e.Err != nil || !reflect.DeepEqual(e.Updated, []string{"a"}) {
+		t.Fatalf("reload %+v, want a updated", e)
+	}
+	if wt.w.PingClients()[0] == a {
+		t.Errorf("PingClient updated in place with an IP version it has no connection for")
+	}
+	wt.waitSent("2001:db8::1", 3)
+}
+
+func TestWatcherReloadFinished(t *testing.T) {
+	wt := newWatcherTest(t, "app:\n  a:\n    ips: 10.0.0.1\n    interval: 5ms\n    num: 2\n")
+	defer wt.close()
+	wt.event()
+	a := wt.w.PingClients()[0]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mu.RLock()
+		running := a.running
+		a.mu.RUnlock()
+		if !running && wt.sim.Sent("10.0.0.1") == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// a finished, it runs again with the new config
+	wt.write("app:\n  a:\n    ips: 10.0.0.1\n    interval: 5ms\n    num: 3\n")
+	wt.w.Reload()
+	if e := wt.event(); e.Err != nil || !reflect.DeepEqual(e.Updated, []string{"a"}) {
+		t.Fatalf("reload %+v, want a updated", e)
+	}
+	if wt.w.PingClients()[0] == a {
+		t.Errorf("finished PingClient updated in place")
+	}
+	wt.waitSent("10.0.0.1", 4)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package pingclient
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals are the signals making a Watcher reload its config file
+func reloadSignals() []os.Signal {
+	return []os.Signal{syscall.SIGHUP}
+}
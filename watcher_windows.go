@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package pingclient
+
+import "os"
+
+// reloadSignals are the signals making a Watcher reload its config file,
+// there is no SIGHUP on Windows
+func reloadSignals() []os.Signal {
+	return nil
+}